@@ -0,0 +1,448 @@
+// Audit log of who ran which JSON query or report, and with what outcome
+package main
+
+import "os"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "bufio"
+import "errors"
+import "strings"
+import "context"
+import "net/http"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgxpool"
+
+// The table used when the audit log is kept in Postgres and no table is configured
+const defaultAuditTable = "mod_reporting_audit"
+
+type auditEntry struct {
+	Timestamp  time.Time       `json:"timestamp"`
+	Tenant     string          `json:"tenant"`
+	UserId     string          `json:"userId"`
+	Username   string          `json:"username"`
+	RequestId  string          `json:"requestId"`
+	Endpoint   string          `json:"endpoint"`            // /ldp/db/query or /ldp/db/reports
+	Database   string          `json:"database"`            // "default" or the name of a 'dbinfo.NAME' database
+	Sql        string          `json:"sql,omitempty"`       // The SQL generated from a JSON query
+	ReportUrl  string          `json:"reportUrl,omitempty"` // The URL of a report
+	Hash       string          `json:"hash,omitempty"`      // SHA-256 of the SQL or the report's text
+	Params     json.RawMessage `json:"params,omitempty"`
+	RowCount   int             `json:"rowCount"`
+	DurationMs int64           `json:"durationMs"`
+	Outcome    string          `json:"outcome"` // "success", or the error code
+	Error      string          `json:"error,omitempty"`
+}
+
+// Searches are always restricted to a single tenant. Empty fields
+// and zero times do not restrict the search.
+type auditFilter struct {
+	Tenant   string
+	UserId   string
+	Username string
+	Endpoint string
+	Database string
+	Outcome  string
+	Text     string // Case-insensitive substring of the SQL or report URL
+	From     time.Time
+	To       time.Time
+}
+
+type auditStore interface {
+	record(ctx context.Context, entry auditEntry) error
+	// Returns the matching entries, most recent first, and how many there are in all
+	search(ctx context.Context, filter auditFilter, offset int, limit int) ([]auditEntry, int, error)
+	close()
+}
+
+// Opens the store named by the configuration or the environment
+// variables MOD_REPORTING_AUDIT_FILE and MOD_REPORTING_AUDIT_DB (or
+// MOD_REPORTING_AUDIT_DB_FILE). Returns nil if auditing is not enabled.
+func makeAuditStore(cfg auditConfig) (auditStore, error) {
+	filename := os.Getenv("MOD_REPORTING_AUDIT_FILE")
+	if filename == "" {
+		filename = cfg.File
+	}
+	dbUrl, err := envOrFile("MOD_REPORTING_AUDIT_DB")
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit database URL: %w", err)
+	}
+
+	if filename != "" && dbUrl != "" {
+		return nil, errors.New("audit log may go to a file or a database, not both")
+	} else if filename != "" {
+		return &fileAuditStore{filename: filename}, nil
+	} else if dbUrl != "" {
+		pool, err := pgxpool.New(context.Background(), dbUrl)
+		if err != nil {
+			return nil, fmt.Errorf("could not configure audit database: %w", err)
+		}
+		return makeDbAuditStore(pool, cfg.Table), nil
+	}
+	return nil, nil
+}
+
+func (f auditFilter) matches(e auditEntry) bool {
+	text := strings.ToLower(f.Text)
+	return e.Tenant == f.Tenant &&
+		(f.UserId == "" || e.UserId == f.UserId) &&
+		(f.Username == "" || e.Username == f.Username) &&
+		(f.Endpoint == "" || e.Endpoint == f.Endpoint) &&
+		(f.Database == "" || e.Database == f.Database) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(text == "" || strings.Contains(strings.ToLower(e.Sql), text) || strings.Contains(strings.ToLower(e.ReportUrl), text)) &&
+		(f.From.IsZero() || !e.Timestamp.Before(f.From)) &&
+		(f.To.IsZero() || e.Timestamp.Before(f.To))
+}
+
+// Appends one JSON object per line. The file is opened for each
+// record, so that it can be rotated by moving it aside.
+type fileAuditStore struct {
+	filename string
+	mutex    sync.Mutex
+}
+
+func (fs *fileAuditStore) record(ctx context.Context, entry auditEntry) error {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode audit entry: %w", err)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	file, err := os.OpenFile(fs.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) // #nosec G304
+	if err != nil {
+		return fmt.Errorf("could not open audit file: %w", err)
+	}
+	_, err = file.Write(append(bytes, '\n'))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write audit file: %w", err)
+	}
+	return file.Close()
+}
+
+// Reads the whole file, which is simple but slow for a large one:
+// the Postgres store is better suited to frequent searching
+func (fs *fileAuditStore) search(ctx context.Context, filter auditFilter, offset int, limit int) ([]auditEntry, int, error) {
+	fs.mutex.Lock()
+	file, err := os.Open(fs.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		fs.mutex.Unlock()
+		return []auditEntry{}, 0, nil
+	} else if err != nil {
+		fs.mutex.Unlock()
+		return nil, 0, fmt.Errorf("could not open audit file: %w", err)
+	}
+
+	matched := []auditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && filter.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	err = scanner.Err()
+	file.Close()
+	fs.mutex.Unlock()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read audit file: %w", err)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Timestamp.After(matched[j].Timestamp) })
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matched[offset:end], total, nil
+}
+
+func (fs *fileAuditStore) close() {
+}
+
+// Inserts a row for each record into a table that is created if it
+// does not already exist
+type dbAuditStore struct {
+	dbConn  PgxIface
+	table   string // Sanitized, and possibly schema-qualified
+	created bool   // Guarded by mutex
+	mutex   sync.Mutex
+}
+
+func makeDbAuditStore(dbConn PgxIface, table string) *dbAuditStore {
+	if table == "" {
+		table = defaultAuditTable
+	}
+	return &dbAuditStore{dbConn: dbConn, table: pgx.Identifier(strings.Split(table, ".")).Sanitize()}
+}
+
+// Creates the table on first use, rather than at startup, so that
+// mod-reporting can start while the audit database is unavailable
+func (ds *dbAuditStore) ensureTable(ctx context.Context) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.created {
+		return nil
+	}
+	_, err := ds.dbConn.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+ds.table+` (
+		id bigserial PRIMARY KEY,
+		"timestamp" timestamptz NOT NULL,
+		tenant text NOT NULL,
+		user_id text NOT NULL,
+		username text NOT NULL,
+		request_id text NOT NULL,
+		endpoint text NOT NULL,
+		database text NOT NULL,
+		sql text NOT NULL,
+		report_url text NOT NULL,
+		hash text NOT NULL,
+		params jsonb,
+		row_count integer NOT NULL,
+		duration_ms bigint NOT NULL,
+		outcome text NOT NULL,
+		error text NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("could not create audit table %s: %w", ds.table, err)
+	}
+	ds.created = true
+	return nil
+}
+
+func (ds *dbAuditStore) record(ctx context.Context, entry auditEntry) error {
+	err := ds.ensureTable(ctx)
+	if err != nil {
+		return err
+	}
+	var params any
+	if len(entry.Params) > 0 {
+		params = string(entry.Params)
+	}
+	_, err = ds.dbConn.Exec(ctx, "INSERT INTO "+ds.table+
+		` ("timestamp", tenant, user_id, username, request_id, endpoint, database, sql, report_url, hash, params, row_count, duration_ms, outcome, error)`+
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)",
+		entry.Timestamp, entry.Tenant, entry.UserId, entry.Username, entry.RequestId, entry.Endpoint, entry.Database,
+		entry.Sql, entry.ReportUrl, entry.Hash, params, entry.RowCount, entry.DurationMs, entry.Outcome, entry.Error)
+	if err != nil {
+		return fmt.Errorf("could not insert into audit table %s: %w", ds.table, err)
+	}
+	return nil
+}
+
+// Returns the WHERE clause for the filter, and its parameters
+func auditCondition(filter auditFilter) (string, []any) {
+	conds := []string{}
+	params := []any{}
+	add := func(cond string, val any) {
+		params = append(params, val)
+		conds = append(conds, strings.ReplaceAll(cond, "$?", fmt.Sprintf("$%d", len(params))))
+	}
+
+	add("tenant = $?", filter.Tenant)
+	for _, f := range []struct{ column, value string }{
+		{"user_id", filter.UserId},
+		{"username", filter.Username},
+		{"endpoint", filter.Endpoint},
+		{"database", filter.Database},
+		{"outcome", filter.Outcome},
+	} {
+		if f.value != "" {
+			add(f.column+" = $?", f.value)
+		}
+	}
+	if filter.Text != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Text)
+		add("(sql ILIKE $? OR report_url ILIKE $?)", "%"+escaped+"%")
+	}
+	if !filter.From.IsZero() {
+		add(`"timestamp" >= $?`, filter.From)
+	}
+	if !filter.To.IsZero() {
+		add(`"timestamp" < $?`, filter.To)
+	}
+	return strings.Join(conds, " AND "), params
+}
+
+func (ds *dbAuditStore) search(ctx context.Context, filter auditFilter, offset int, limit int) ([]auditEntry, int, error) {
+	err := ds.ensureTable(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, params := auditCondition(filter)
+
+	var total int
+	err = ds.dbConn.QueryRow(ctx, "SELECT count(*) FROM "+ds.table+" WHERE "+cond, params...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not count audit entries: %w", err)
+	}
+
+	sql := `SELECT "timestamp", tenant, user_id, username, request_id, endpoint, database, sql, report_url, hash, params, row_count, duration_ms, outcome, error` +
+		" FROM " + ds.table + " WHERE " + cond + ` ORDER BY "timestamp" DESC, id DESC` + fmt.Sprintf(" OFFSET %d", offset)
+	if limit >= 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := ds.dbConn.Query(ctx, sql, params...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not search audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var params []byte
+		err = rows.Scan(&e.Timestamp, &e.Tenant, &e.UserId, &e.Username, &e.RequestId, &e.Endpoint, &e.Database,
+			&e.Sql, &e.ReportUrl, &e.Hash, &params, &e.RowCount, &e.DurationMs, &e.Outcome, &e.Error)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read audit entry: %w", err)
+		}
+		e.Params = params
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func (ds *dbAuditStore) close() {
+	ds.dbConn.Close()
+}
+
+// The audit entry for a request in progress
+type auditRecord struct {
+	entry   auditEntry
+	start   time.Time
+	session *ModReportingSession
+	req     *http.Request
+}
+
+func (session *ModReportingSession) startAudit(req *http.Request, endpoint string) *auditRecord {
+	token := req.Header.Get("X-Okapi-Token")
+	entry := auditEntry{
+		Tenant:   session.folioSession.GetTenant(),
+		UserId:   userIdFromToken(token),
+		Username: usernameFromToken(token),
+		Endpoint: endpoint,
+		Database: "default",
+	}
+	info := getRequestInfo(req)
+	if info != nil {
+		entry.RequestId = info.id
+	}
+	return &auditRecord{entry: entry, start: time.Now(), session: session, req: req}
+}
+
+func (ar *auditRecord) setDatabase(dbName string) {
+	if dbName != "" {
+		ar.entry.Database = dbName
+	}
+}
+
+// Records the text that was run, and its hash: for a JSON query,
+// the generated SQL; for a report, the report's own SQL
+func (ar *auditRecord) setSql(sql string, keep bool) {
+	sum := sha256.Sum256([]byte(sql))
+	ar.entry.Hash = hex.EncodeToString(sum[:])
+	if keep {
+		ar.entry.Sql = sql
+	}
+}
+
+func (ar *auditRecord) setParams(params any) {
+	bytes, err := json.Marshal(params)
+	if err == nil {
+		ar.entry.Params = bytes
+	}
+}
+
+// Writes the entry to the audit log, if there is one. By now the
+// response has been sent, so a failure can only be logged.
+func (ar *auditRecord) finish(err error) {
+	store := ar.session.server.audit
+	if store == nil {
+		return
+	}
+
+	ar.entry.Timestamp = ar.start.UTC()
+	ar.entry.DurationMs = time.Since(ar.start).Milliseconds()
+	ar.entry.Outcome = "success"
+	if err != nil {
+		_, ar.entry.Outcome = classifyError(err)
+		ar.entry.Error = err.Error()
+	}
+
+	// The request's own context may have been cancelled
+	err = store.record(context.Background(), ar.entry)
+	if err != nil {
+		ar.session.LogReq(ar.req, "error", "could not write audit log:", err.Error())
+	}
+}
+
+type auditResponse struct {
+	TotalRecords int          `json:"totalRecords"`
+	Records      []auditEntry `json:"records"`
+}
+
+func timeParam(req *http.Request, name string) (time.Time, error) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "parameter '%s' must be an RFC 3339 time, not '%s'", name, s)
+	}
+	return t, nil
+}
+
+// GET /ldp/audit searches the current tenant's audit entries, most
+// recent first. All parameters are optional: userId, username,
+// endpoint, db, outcome, text, from, to, offset and limit.
+func handleAudit(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	store := session.server.audit
+	if store == nil {
+		return newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "audit log is not enabled")
+	}
+
+	v := req.URL.Query()
+	filter := auditFilter{
+		Tenant:   session.folioSession.GetTenant(),
+		UserId:   v.Get("userId"),
+		Username: v.Get("username"),
+		Endpoint: v.Get("endpoint"),
+		Database: v.Get("db"),
+		Outcome:  v.Get("outcome"),
+		Text:     v.Get("text"),
+	}
+	var err error
+	filter.From, err = timeParam(req, "from")
+	if err != nil {
+		return err
+	}
+	filter.To, err = timeParam(req, "to")
+	if err != nil {
+		return err
+	}
+	offset, err := intParam(req, "offset", 0)
+	if err != nil {
+		return err
+	}
+	limit, err := intParam(req, "limit", 100)
+	if err != nil {
+		return err
+	}
+
+	entries, total, err := store.search(req.Context(), filter, offset, limit)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, auditResponse{TotalRecords: total, Records: entries}, "audit entries")
+}
@@ -0,0 +1,195 @@
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "encoding/json"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func makeAuditEntries() []auditEntry {
+	base := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	return []auditEntry{
+		{Timestamp: base, Tenant: "diku", Username: "mike", Endpoint: "/ldp/db/query", Sql: `SELECT * FROM "folio_users"."users"`, Outcome: "success", RowCount: 2},
+		{Timestamp: base.Add(time.Hour), Tenant: "diku", Username: "fiona", Endpoint: "/ldp/db/reports", ReportUrl: "https://example.com/loans.sql", Outcome: "success"},
+		{Timestamp: base.Add(2 * time.Hour), Tenant: "fs09", Username: "mike", Endpoint: "/ldp/db/query", Sql: "SELECT 1", Outcome: "success"},
+		{Timestamp: base.Add(3 * time.Hour), Tenant: "diku", Username: "mike", Endpoint: "/ldp/db/query", Sql: `SELECT * FROM "folio_users"."users" LIMIT 1`, Outcome: "sql-error"},
+	}
+}
+
+func Test_fileAuditStore(t *testing.T) {
+	store := &fileAuditStore{filename: t.TempDir() + "/audit.jsonl"}
+	found, total, err := store.search(t.Context(), auditFilter{Tenant: "diku"}, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, total)
+	assert.Empty(t, found)
+
+	for _, e := range makeAuditEntries() {
+		assert.Nil(t, store.record(t.Context(), e))
+	}
+
+	tests := []struct {
+		name     string
+		filter   auditFilter
+		offset   int
+		limit    int
+		total    int
+		expected []string // Usernames and outcomes of the entries returned
+	}{
+		{name: "tenant only, most recent first", filter: auditFilter{Tenant: "diku"}, limit: -1, total: 3,
+			expected: []string{"mike/sql-error", "fiona/success", "mike/success"}},
+		{name: "paged", filter: auditFilter{Tenant: "diku"}, offset: 1, limit: 1, total: 3,
+			expected: []string{"fiona/success"}},
+		{name: "offset past the end", filter: auditFilter{Tenant: "diku"}, offset: 10, limit: 1, total: 3,
+			expected: []string{}},
+		{name: "by user", filter: auditFilter{Tenant: "diku", Username: "mike"}, limit: -1, total: 2,
+			expected: []string{"mike/sql-error", "mike/success"}},
+		{name: "by text in SQL", filter: auditFilter{Tenant: "diku", Text: "FOLIO_USERS"}, limit: -1, total: 2,
+			expected: []string{"mike/sql-error", "mike/success"}},
+		{name: "by text in report URL", filter: auditFilter{Tenant: "diku", Text: "loans"}, limit: -1, total: 1,
+			expected: []string{"fiona/success"}},
+		{name: "by outcome", filter: auditFilter{Tenant: "diku", Outcome: "sql-error"}, limit: -1, total: 1,
+			expected: []string{"mike/sql-error"}},
+		{name: "by time", limit: -1, total: 1, expected: []string{"fiona/success"},
+			filter: auditFilter{Tenant: "diku", From: time.Date(2026, 9, 1, 13, 0, 0, 0, time.UTC), To: time.Date(2026, 9, 1, 15, 0, 0, 0, time.UTC)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, total, err := store.search(t.Context(), test.filter, test.offset, test.limit)
+			assert.Nil(t, err)
+			assert.Equal(t, test.total, total)
+			got := []string{}
+			for _, e := range found {
+				got = append(got, e.Username+"/"+e.Outcome)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func Test_auditCondition(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	cond, params := auditCondition(auditFilter{Tenant: "diku", Username: "mike", Text: "50%_off", From: from})
+	assert.Equal(t, `tenant = $1 AND username = $2 AND (sql ILIKE $3 OR report_url ILIKE $3) AND "timestamp" >= $4`, cond)
+	assert.Equal(t, []any{"diku", "mike", `%50\%\_off%`, from}, params)
+}
+
+func Test_dbAuditStore(t *testing.T) {
+	mock := Must(pgxmock.NewPool())
+	store := makeDbAuditStore(mock, "audit.log")
+	entry := makeAuditEntries()[0]
+	entry.Params = json.RawMessage(`["x"]`)
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "audit"."log"`).WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+	mock.ExpectExec(`INSERT INTO "audit"."log"`).
+		WithArgs(entry.Timestamp, "diku", "", "mike", "", "/ldp/db/query", "", entry.Sql, "", "", `["x"]`, 2, int64(0), "success", "").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	assert.Nil(t, store.record(t.Context(), entry))
+
+	// The table is created only once
+	mock.ExpectQuery(`SELECT count\(\*\) FROM "audit"."log" WHERE tenant = \$1 AND outcome = \$2`).
+		WithArgs("diku", "success").
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(7))
+	mock.ExpectQuery(`SELECT "timestamp", .* FROM "audit"."log" WHERE tenant = \$1 AND outcome = \$2 ORDER BY "timestamp" DESC, id DESC OFFSET 5 LIMIT 1`).
+		WithArgs("diku", "success").
+		WillReturnRows(pgxmock.NewRows([]string{"timestamp", "tenant", "user_id", "username", "request_id", "endpoint", "database",
+			"sql", "report_url", "hash", "params", "row_count", "duration_ms", "outcome", "error"}).
+			AddRow(entry.Timestamp, "diku", "", "mike", "", "/ldp/db/query", "", entry.Sql, "", "", []byte(`["x"]`), 2, int64(0), "success", ""))
+	found, total, err := store.search(t.Context(), auditFilter{Tenant: "diku", Outcome: "success"}, 5, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, total)
+	assert.Equal(t, []auditEntry{entry}, found)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_makeAuditStore(t *testing.T) {
+	store, err := makeAuditStore(auditConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, store)
+
+	t.Setenv("MOD_REPORTING_AUDIT_FILE", "/tmp/override.jsonl")
+	store, err = makeAuditStore(auditConfig{File: "/tmp/audit.jsonl"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/override.jsonl", store.(*fileAuditStore).filename)
+
+	t.Setenv("MOD_REPORTING_AUDIT_DB", "postgres://audit:pw@localhost:5432/audit")
+	_, err = makeAuditStore(auditConfig{})
+	assert.ErrorContains(t, err, "not both")
+}
+
+func Test_auditedQueries(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	store := &fileAuditStore{filename: t.TempDir() + "/audit.jsonl"}
+	server.audit = store
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+	mock := Must(pgxmock.NewPool())
+	useMockDb(session, "", mock, true)
+	token := makeTokenFor("mike")
+
+	assert.Nil(t, establishMockForColumns(mock))
+	assert.Nil(t, establishMockForQuery(mock))
+	body := `{ "tables": [{ "schema": "folio_users", "tableName": "users" }] }`
+	req := withRequestInfo(httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(body)))
+	req.Header.Set("X-Okapi-Token", token)
+	assert.Nil(t, handleQuery(httptest.NewRecorder(), req, session))
+
+	req = httptest.NewRequest("POST", "/ldp/db/reports", strings.NewReader(`{ "url": "`+ts.URL+`/reports/noheader.sql", "params": { "x": "1" } }`))
+	req.Header.Set("X-Okapi-Token", token)
+	assert.NotNil(t, handleReport(httptest.NewRecorder(), req, session))
+
+	found, total, err := store.search(t.Context(), auditFilter{Tenant: "diku"}, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	report, query := found[0], found[1]
+
+	assert.Equal(t, "mike", query.Username)
+	assert.Equal(t, "123", query.UserId)
+	assert.Equal(t, "/ldp/db/query", query.Endpoint)
+	assert.Equal(t, "default", query.Database)
+	assert.Equal(t, `SELECT * FROM "folio_users"."users"`, query.Sql)
+	assert.Len(t, query.Hash, 64)
+	assert.JSONEq(t, `[]`, string(query.Params))
+	assert.Equal(t, 2, query.RowCount)
+	assert.Equal(t, "success", query.Outcome)
+	assert.NotEmpty(t, query.RequestId)
+
+	assert.Equal(t, "/ldp/db/reports", report.Endpoint)
+	assert.Equal(t, ts.URL+"/reports/noheader.sql", report.ReportUrl)
+	assert.Equal(t, "", report.Sql)
+	assert.JSONEq(t, `{"x":"1"}`, string(report.Params))
+	assert.Equal(t, errInvalidReport, report.Outcome)
+	assert.Contains(t, report.Error, "could not extract SQL function name")
+}
+
+func Test_handleAudit(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+
+	err := handleAudit(httptest.NewRecorder(), httptest.NewRequest("GET", "/ldp/audit", nil), session)
+	status, code := classifyError(err)
+	assert.Equal(t, 501, status)
+	assert.Equal(t, errNotImplemented, code)
+
+	store := &fileAuditStore{filename: t.TempDir() + "/audit.jsonl"}
+	server.audit = store
+	for _, e := range makeAuditEntries() {
+		assert.Nil(t, store.record(t.Context(), e))
+	}
+
+	w := httptest.NewRecorder()
+	err = handleAudit(w, httptest.NewRequest("GET", "/ldp/audit?username=mike&from=2026-09-01T12:30:00Z&limit=5", nil), session)
+	assert.Nil(t, err)
+	var resp auditResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.TotalRecords)
+	assert.Equal(t, "sql-error", resp.Records[0].Outcome)
+
+	err = handleAudit(httptest.NewRecorder(), httptest.NewRequest("GET", "/ldp/audit?from=yesterday", nil), session)
+	assert.ErrorContains(t, err, "parameter 'from' must be an RFC 3339 time")
+}
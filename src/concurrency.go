@@ -0,0 +1,195 @@
+// Limits on the number of queries running at once, with a bounded wait for a slot
+package main
+
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "strconv"
+import "net/http"
+import "encoding/json"
+
+// A request that is waiting for a slot
+type queuedRequest struct {
+	tenant string
+	user   string
+	ready  chan struct{} // Closed when the request is admitted
+}
+
+// Counts the queries running globally, per tenant and per user, and
+// queues requests that would exceed a limit. When a slot is freed,
+// queued requests are admitted in the order they arrived, skipping
+// those that are still blocked by their own tenant's or user's limit.
+type concurrencyLimiter struct {
+	cfg           concurrencyConfig
+	mutex         sync.Mutex
+	running       int
+	tenantRunning map[string]int
+	userRunning   map[string]int // Keyed by tenant:user
+	queue         []*queuedRequest
+}
+
+func makeConcurrencyLimiter(cfg concurrencyConfig) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		cfg:           cfg,
+		tenantRunning: map[string]int{},
+		userRunning:   map[string]int{},
+	}
+}
+
+func (cl *concurrencyLimiter) tenantLimit(tenant string) int {
+	limit, ok := cl.cfg.Tenants[tenant]
+	if ok {
+		return limit
+	}
+	return cl.cfg.PerTenant
+}
+
+// Must be called with the mutex held. A limit of zero means no limit.
+func (cl *concurrencyLimiter) fits(tenant string, user string) bool {
+	tenantLimit := cl.tenantLimit(tenant)
+	return (cl.cfg.Global == 0 || cl.running < cl.cfg.Global) &&
+		(tenantLimit == 0 || cl.tenantRunning[tenant] < tenantLimit) &&
+		(cl.cfg.PerUser == 0 || cl.userRunning[tenant+":"+user] < cl.cfg.PerUser)
+}
+
+// Must be called with the mutex held
+func (cl *concurrencyLimiter) start(tenant string, user string) {
+	cl.running++
+	cl.tenantRunning[tenant]++
+	cl.userRunning[tenant+":"+user]++
+}
+
+// Waits until the query may run, for at most the configured queue
+// timeout. The returned function must be called when it has finished.
+func (cl *concurrencyLimiter) acquire(ctx context.Context, tenant string, user string) (func(), error) {
+	release := func() { cl.release(tenant, user) }
+
+	cl.mutex.Lock()
+	if cl.fits(tenant, user) {
+		cl.start(tenant, user)
+		cl.mutex.Unlock()
+		return release, nil
+	}
+	qr := &queuedRequest{tenant: tenant, user: user, ready: make(chan struct{})}
+	cl.queue = append(cl.queue, qr)
+	cl.mutex.Unlock()
+
+	timer := time.NewTimer(time.Duration(cl.cfg.QueueTimeout) * time.Second)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-qr.ready:
+		return release, nil
+	case <-timer.C:
+		err = newHTTPErrorf(http.StatusTooManyRequests, errTooManyRequests,
+			"too many queries running: gave up waiting after %d seconds", cl.cfg.QueueTimeout)
+	case <-ctx.Done():
+		err = fmt.Errorf("gave up waiting to run query: %w", ctx.Err())
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	for i, other := range cl.queue {
+		if other == qr {
+			cl.queue = append(cl.queue[:i], cl.queue[i+1:]...)
+			return nil, err
+		}
+	}
+	// Admitted just as we gave up: too late to refuse the slot
+	return release, nil
+}
+
+func (cl *concurrencyLimiter) release(tenant string, user string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.running--
+	cl.tenantRunning[tenant]--
+	if cl.tenantRunning[tenant] == 0 {
+		delete(cl.tenantRunning, tenant)
+	}
+	cl.userRunning[tenant+":"+user]--
+	if cl.userRunning[tenant+":"+user] == 0 {
+		delete(cl.userRunning, tenant+":"+user)
+	}
+
+	remaining := []*queuedRequest{}
+	for _, qr := range cl.queue {
+		if cl.fits(qr.tenant, qr.user) {
+			cl.start(qr.tenant, qr.user)
+			close(qr.ready)
+		} else {
+			remaining = append(remaining, qr)
+		}
+	}
+	cl.queue = remaining
+}
+
+type tenantQueueStatus struct {
+	Tenant  string `json:"tenant"`
+	Running int    `json:"running"`
+	Queued  int    `json:"queued"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+type queueStatus struct {
+	Running int                 `json:"running"`
+	Queued  int                 `json:"queued"`
+	Limits  concurrencyConfig   `json:"limits"`
+	Tenants []tenantQueueStatus `json:"tenants"`
+}
+
+func (cl *concurrencyLimiter) status() queueStatus {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	tenant2status := map[string]*tenantQueueStatus{}
+	get := func(tenant string) *tenantQueueStatus {
+		ts := tenant2status[tenant]
+		if ts == nil {
+			ts = &tenantQueueStatus{Tenant: tenant, Limit: cl.tenantLimit(tenant)}
+			tenant2status[tenant] = ts
+		}
+		return ts
+	}
+	for tenant, n := range cl.tenantRunning {
+		get(tenant).Running = n
+	}
+	for _, qr := range cl.queue {
+		get(qr.tenant).Queued++
+	}
+
+	qs := queueStatus{Running: cl.running, Queued: len(cl.queue), Limits: cl.cfg, Tenants: []tenantQueueStatus{}}
+	for _, tenant := range sortedKeys(tenant2status) {
+		qs.Tenants = append(qs.Tenants, *tenant2status[tenant])
+	}
+	return qs
+}
+
+// Waits for a slot for a request to a limited route. If none is free
+// in time, sets Retry-After to suggest waiting as long again.
+func (server *ModReportingServer) acquireSlot(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (func(), error) {
+	tenant := session.folioSession.GetTenant()
+	user := userIdFromToken(req.Header.Get("X-Okapi-Token"))
+	release, err := server.limiter.acquire(req.Context(), tenant, user)
+	if err != nil {
+		status, _ := classifyError(err)
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", strconv.Itoa(max(server.config.Concurrency.QueueTimeout, 1)))
+		}
+		return nil, err
+	}
+	return release, nil
+}
+
+// GET /admin/queue reports how many queries are running and queued
+func handleQueue(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	bytes, err := json.Marshal(server.limiter.status())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "could not encode JSON for queue: %s\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,101 @@
+package main
+
+import "time"
+import "context"
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_concurrencyLimiter(t *testing.T) {
+	t.Run("no limits", func(t *testing.T) {
+		cl := makeConcurrencyLimiter(concurrencyConfig{QueueTimeout: 1})
+		for i := 0; i < 10; i++ {
+			_, err := cl.acquire(t.Context(), "diku", "mike")
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 10, cl.status().Running)
+	})
+
+	t.Run("queued request is admitted when a slot is freed", func(t *testing.T) {
+		cl := makeConcurrencyLimiter(concurrencyConfig{PerUser: 1, QueueTimeout: 10})
+		release1 := Must(cl.acquire(t.Context(), "diku", "mike"))
+
+		admitted := make(chan func())
+		go func() {
+			release, err := cl.acquire(t.Context(), "diku", "mike")
+			assert.Nil(t, err)
+			admitted <- release
+		}()
+		assert.Eventually(t, func() bool { return cl.status().Queued == 1 }, time.Second, time.Millisecond)
+		assert.Equal(t, []tenantQueueStatus{{Tenant: "diku", Running: 1, Queued: 1}}, cl.status().Tenants)
+
+		// Another user is not held up by mike's limit
+		release3 := Must(cl.acquire(t.Context(), "diku", "fiona"))
+		release3()
+
+		release1()
+		release2 := <-admitted
+		assert.Equal(t, 1, cl.status().Running)
+		release2()
+		assert.Equal(t, queueStatus{Limits: cl.cfg, Tenants: []tenantQueueStatus{}}, cl.status())
+	})
+
+	t.Run("tenant limit and override", func(t *testing.T) {
+		cl := makeConcurrencyLimiter(concurrencyConfig{PerTenant: 1, Tenants: map[string]int{"big": 2}, QueueTimeout: 10})
+		_ = Must(cl.acquire(t.Context(), "big", "mike"))
+		_ = Must(cl.acquire(t.Context(), "big", "fiona"))
+		_ = Must(cl.acquire(t.Context(), "diku", "mike"))
+
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+		_, err := cl.acquire(ctx, "diku", "fiona")
+		assert.ErrorContains(t, err, "gave up waiting to run query")
+		assert.Equal(t, 0, cl.status().Queued)
+		assert.Equal(t, []tenantQueueStatus{
+			{Tenant: "big", Running: 2, Limit: 2},
+			{Tenant: "diku", Running: 1, Limit: 1},
+		}, cl.status().Tenants)
+	})
+
+	t.Run("global limit times out", func(t *testing.T) {
+		cl := makeConcurrencyLimiter(concurrencyConfig{Global: 1, QueueTimeout: 1})
+		_ = Must(cl.acquire(t.Context(), "diku", "mike"))
+		_, err := cl.acquire(t.Context(), "fs09", "fiona")
+		assert.ErrorContains(t, err, "gave up waiting after 1 seconds")
+		status, code := classifyError(err)
+		assert.Equal(t, 429, status)
+		assert.Equal(t, errTooManyRequests, code)
+	})
+}
+
+func Test_limitedRoute(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	server.config.Concurrency = concurrencyConfig{PerUser: 1, QueueTimeout: 1}
+	server.limiter = makeConcurrencyLimiter(server.config.Concurrency)
+	release := Must(server.limiter.acquire(t.Context(), "diku", "123"))
+	defer release()
+
+	req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+	req.Header.Set("X-Okapi-Url", ts.URL)
+	req.Header.Set("X-Okapi-Tenant", "diku")
+	req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+	w := httptest.NewRecorder()
+	handler(w, req, server)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"too-many-requests"`)
+
+	// Unlimited routes are unaffected
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin/queue", nil)
+	handler(w, req, server)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{
+	  "running": 1,
+	  "queued": 0,
+	  "limits": { "global": 0, "perTenant": 0, "perUser": 1, "queueTimeout": 1 },
+	  "tenants": [{ "tenant": "diku", "running": 1, "queued": 0 }]
+	}`, w.Body.String())
+}
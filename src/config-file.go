@@ -2,13 +2,21 @@ package main
 
 import "os"
 import "io"
+import "fmt"
 import "encoding/json"
 import "strconv"
+import "strings"
+import "net/url"
 
 type loggingConfig struct {
 	Categories string `json:"categories"`
 	Prefix     string `json:"prefix"`
 	Timestamp  bool   `json:"timestamp"`
+	Format     string `json:"format"`
+}
+
+func (cl loggingConfig) isJSON() bool {
+	return cl.Format == "json"
 }
 
 type listenConfig struct {
@@ -18,11 +26,101 @@ type listenConfig struct {
 
 type reportUrlWhitelistConfig []string
 
+type corsConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedHeaders []string `json:"allowedHeaders"`
+	MaxAge         int      `json:"maxAge"`
+}
+
+var defaultCorsAllowedHeaders = []string{
+	"Content-Type",
+	"X-Okapi-Tenant",
+	"X-Okapi-Token",
+	"X-Okapi-Url",
+	"X-Okapi-Request-Id",
+	"X-Reporting-Db",
+}
+
+// Reporting-database connection details that override the 'dbinfo'
+// setting. Values given inline override those read from the file.
+type dbCredentials struct {
+	Url             string `json:"url"`
+	User            string `json:"user"`
+	Pass            string `json:"pass"`
+	CredentialsFile string `json:"credentialsFile"` // JSON file with url, user and pass
+}
+
+// So that logging the configuration does not reveal passwords
+func (dc dbCredentials) String() string {
+	pass := ""
+	if dc.Pass != "" {
+		pass = "********"
+	}
+	dbUrl := dc.Url
+	u, err := url.Parse(dc.Url)
+	if err == nil {
+		dbUrl = u.Redacted()
+	}
+	return fmt.Sprintf("{Url:%s User:%s Pass:%s CredentialsFile:%s}", dbUrl, dc.User, pass, dc.CredentialsFile)
+}
+
+type databaseConfig struct {
+	CredentialsFile string                   `json:"credentialsFile"` // Used for all tenants
+	Tenants         map[string]dbCredentials `json:"tenants"`         // Keyed by tenant ID
+}
+
+// Maps FOLIO users to the Postgres roles that their queries and
+// reports run as. Keys of Users are either "username", or
+// "tenant:username" for a mapping that applies only in one tenant.
+type rolesConfig struct {
+	Mode        string            `json:"mode"` // "role" (the default) or "session-authorization"
+	Users       map[string]string `json:"users"`
+	DefaultRole string            `json:"defaultRole"` // For users not listed in Users
+}
+
+// Where the audit log of queries and reports is kept. Alternatively,
+// the log may be kept in the Postgres database named by the
+// environment variable MOD_REPORTING_AUDIT_DB, in the table Table.
+type auditConfig struct {
+	File  string `json:"file"`  // Appended to as JSON lines
+	Table string `json:"table"` // Defaults to mod_reporting_audit
+}
+
+// Limits on the number of queries and reports running at once. Zero
+// means no limit. Requests over a limit wait up to QueueTimeout seconds.
+type concurrencyConfig struct {
+	Global       int            `json:"global"`
+	PerTenant    int            `json:"perTenant"`
+	PerUser      int            `json:"perUser"`
+	Tenants      map[string]int `json:"tenants,omitempty"` // Overrides PerTenant for particular tenants
+	QueueTimeout int            `json:"queueTimeout"`
+}
+
+// Results of queries and reports are cached for up to Ttl seconds,
+// in at most MaxMemory megabytes. The cache is off unless MaxMemory is set.
+type cacheConfig struct {
+	Ttl       int `json:"ttl"`
+	MaxMemory int `json:"maxMemory"`
+}
+
+// Limits on ad-hoc SQL run through /ldp/db/sql
+type sqlConfig struct {
+	MaxRows int `json:"maxRows"` // Defaults to 10000
+}
+
 type config struct {
-	Logging            loggingConfig            `json:"logging"`
-	Listen             listenConfig             `json:"listen"`
-	QueryTimeout       int                      `json:"queryTimeout"`
-	ReportUrlWhitelist reportUrlWhitelistConfig `json:"reportUrlWhitelist"`
+	Logging             loggingConfig            `json:"logging"`
+	Listen              listenConfig             `json:"listen"`
+	QueryTimeout        int                      `json:"queryTimeout"`
+	ShutdownGracePeriod int                      `json:"shutdownGracePeriod"`
+	ReportUrlWhitelist  reportUrlWhitelistConfig `json:"reportUrlWhitelist"`
+	Cors                corsConfig               `json:"cors"`
+	Database            databaseConfig           `json:"database"`
+	Roles               rolesConfig              `json:"roles"`
+	Audit               auditConfig              `json:"audit"`
+	Concurrency         concurrencyConfig        `json:"concurrency"`
+	Cache               cacheConfig              `json:"cache"`
+	Sql                 sqlConfig                `json:"sql"`
 }
 
 func readConfig(name string) (*config, error) {
@@ -39,6 +137,11 @@ func readConfig(name string) (*config, error) {
 		return nil, err
 	}
 
+	logFormat := os.Getenv("LOGGING_FORMAT")
+	if logFormat != "" {
+		cfg.Logging.Format = logFormat
+	}
+
 	queryTimeoutString := os.Getenv("MOD_REPORTING_QUERY_TIMEOUT")
 	if queryTimeoutString != "" {
 		cfg.QueryTimeout, _ = strconv.Atoi(queryTimeoutString)
@@ -46,5 +149,55 @@ func readConfig(name string) (*config, error) {
 		cfg.QueryTimeout = 60
 	}
 
+	gracePeriodString := os.Getenv("MOD_REPORTING_SHUTDOWN_GRACE_PERIOD")
+	if gracePeriodString != "" {
+		cfg.ShutdownGracePeriod, _ = strconv.Atoi(gracePeriodString)
+	} else if cfg.ShutdownGracePeriod == 0 {
+		cfg.ShutdownGracePeriod = 20
+	}
+
+	corsOrigins := os.Getenv("MOD_REPORTING_CORS_ALLOWED_ORIGINS")
+	if corsOrigins != "" {
+		cfg.Cors.AllowedOrigins = strings.Split(corsOrigins, ",")
+	}
+	if cfg.Cors.AllowedHeaders == nil {
+		cfg.Cors.AllowedHeaders = defaultCorsAllowedHeaders
+	}
+
+	for _, limit := range []struct {
+		env   string
+		value *int
+	}{
+		{"MOD_REPORTING_MAX_QUERIES", &cfg.Concurrency.Global},
+		{"MOD_REPORTING_MAX_QUERIES_PER_TENANT", &cfg.Concurrency.PerTenant},
+		{"MOD_REPORTING_MAX_QUERIES_PER_USER", &cfg.Concurrency.PerUser},
+		{"MOD_REPORTING_QUEUE_TIMEOUT", &cfg.Concurrency.QueueTimeout},
+		{"MOD_REPORTING_CACHE_TTL", &cfg.Cache.Ttl},
+		{"MOD_REPORTING_CACHE_MAX_MEMORY", &cfg.Cache.MaxMemory},
+		{"MOD_REPORTING_SQL_MAX_ROWS", &cfg.Sql.MaxRows},
+	} {
+		s := os.Getenv(limit.env)
+		if s != "" {
+			*limit.value, _ = strconv.Atoi(s)
+		}
+	}
+	if cfg.Concurrency.QueueTimeout == 0 {
+		cfg.Concurrency.QueueTimeout = 30
+	}
+	if cfg.Cache.Ttl == 0 {
+		cfg.Cache.Ttl = 300
+	}
+	if cfg.Sql.MaxRows <= 0 {
+		cfg.Sql.MaxRows = 10000
+	}
+
+	defaultRole := os.Getenv("MOD_REPORTING_DEFAULT_ROLE")
+	if defaultRole != "" {
+		cfg.Roles.DefaultRole = defaultRole
+	}
+	if cfg.Roles.Mode != "" && cfg.Roles.Mode != roleModeRole && cfg.Roles.Mode != roleModeSessionAuthorization {
+		return nil, fmt.Errorf("roles.mode must be '%s' or '%s', not '%s'", roleModeRole, roleModeSessionAuthorization, cfg.Roles.Mode)
+	}
+
 	return &cfg, nil
 }
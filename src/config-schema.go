@@ -0,0 +1,318 @@
+// JSON Schemas for the values of well-known config keys, and a validator for them
+package main
+
+import "fmt"
+import "math"
+import "regexp"
+import "strings"
+import "net/http"
+import "encoding/json"
+
+// The schemas are published verbatim at /ldp/config-schemas, so that
+// the UI can use them too. Keys not listed here are not validated.
+var configSchemaSources = map[string]string{
+	"dbinfo": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Reporting database connection",
+  "type": "object",
+  "properties": {
+    "url": {
+      "type": "string",
+      "minLength": 1,
+      "description": "Host, port and database name, optionally prefixed by postgres:// or jdbc:postgresql://"
+    },
+    "user": { "type": "string", "minLength": 1 },
+    "pass": { "type": "string" },
+    "hosts": {
+      "type": "array",
+      "description": "If present, replaces the host in the URL. JSON queries go to the first available replica, or to a primary if none is available",
+      "items": {
+        "type": "object",
+        "properties": {
+          "host": { "type": "string", "minLength": 1, "description": "Host and optional port, e.g. replica.example.com:5432" },
+          "role": { "enum": [ "primary", "replica" ] }
+        },
+        "required": [ "host", "role" ]
+      }
+    },
+    "metadata": {
+      "enum": [ "primary", "replica" ],
+      "description": "Where to send requests for tables, columns, logs, version, updates and processes. Defaults to primary"
+    }
+  },
+  "required": [ "url", "user", "pass" ]
+}`,
+	"tqrepos": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "GitHub repositories of report queries",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "user": { "type": "string", "minLength": 1 },
+      "repo": { "type": "string", "minLength": 1 },
+      "branch": { "type": "string" },
+      "dir": { "type": "string" }
+    },
+    "required": [ "user", "repo" ]
+  }
+}`,
+	"sqconfig": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "GitHub repository for saved queries",
+  "type": "object",
+  "properties": {
+    "user": { "type": "string", "minLength": 1 },
+    "repo": { "type": "string", "minLength": 1 },
+    "branch": { "type": "string" },
+    "dir": { "type": "string" },
+    "token": { "type": "string" }
+  },
+  "required": [ "user", "repo" ]
+}`,
+	"default-record-limits": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Default and maximum numbers of records to show and export",
+  "type": "object",
+  "properties": {
+    "defaultShow": { "type": "integer", "minimum": 1 },
+    "maxShow": { "type": "integer", "minimum": 1 },
+    "defaultExport": { "type": "integer", "minimum": 1 },
+    "maxExport": { "type": "integer", "minimum": 1 }
+  }
+}`,
+	"table-access": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "FOLIO permissions required to read reporting-database schemas and tables",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "schema": { "type": "string", "minLength": 1 },
+      "table": { "type": "string", "minLength": 1, "description": "If omitted, the rule covers every table in the schema" },
+      "permission": { "enum": [ "ldp.access.personal-data", "ldp.access.restricted" ] }
+    },
+    "required": [ "schema", "permission" ],
+    "additionalProperties": false
+  }
+}`,
+	"column-masking": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Masking of columns in query and report results",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "description": "A rule masks the columns that match all the fields it specifies. The first matching rule applies",
+    "properties": {
+      "schema": { "type": "string", "minLength": 1 },
+      "table": { "type": "string", "minLength": 1 },
+      "column": { "type": "string", "minLength": 1 },
+      "pattern": { "type": "string", "minLength": 1, "description": "Case-insensitive column name, in which * matches any characters, e.g. *email*" },
+      "mode": { "enum": [ "redact", "hash", "partial" ] }
+    },
+    "required": [ "mode" ],
+    "additionalProperties": false
+  }
+}`,
+	"query-cost-limits": `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Limits on the planner's estimates for JSON queries, above which they are not run",
+  "type": "object",
+  "properties": {
+    "maxCost": { "type": "number", "minimum": 0, "description": "Maximum estimated total cost, in the planner's units. 0 means no limit" },
+    "maxRows": { "type": "integer", "minimum": 0, "description": "Maximum estimated number of rows. 0 means no limit" },
+    "action": { "enum": [ "confirm", "reject" ], "description": "Whether a query over the limits may be run anyway if confirmed. Defaults to confirm" }
+  },
+  "additionalProperties": false
+}`,
+}
+
+// The subset of JSON Schema that we need for the config schemas
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	MinLength            *int                   `json:"minLength"`
+	Pattern              string                 `json:"pattern"`
+}
+
+var configSchemas = parseConfigSchemas(configSchemaSources)
+
+// The sources are constants, so a failure here is a programming error
+func parseConfigSchemas(sources map[string]string) map[string]*jsonSchema {
+	schemas := map[string]*jsonSchema{}
+	for key, source := range sources {
+		var schema jsonSchema
+		err := json.Unmarshal([]byte(source), &schema)
+		if err != nil {
+			panic(fmt.Sprintf("could not parse JSON Schema for config key '%s': %s", key, err))
+		}
+		schemas[key] = &schema
+	}
+	return schemas
+}
+
+type schemaViolation struct {
+	Path    string `json:"path"` // JSON Pointer to the offending part of the value
+	Message string `json:"message"`
+}
+
+func jsonType(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+func (schema *jsonSchema) validate(val interface{}, path string) []schemaViolation {
+	violations := []schemaViolation{}
+	fail := func(format string, args ...any) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		violations = append(violations, schemaViolation{Path: p, Message: fmt.Sprintf(format, args...)})
+	}
+
+	actualType := jsonType(val)
+	if schema.Type != "" && schema.Type != actualType && !(schema.Type == "number" && actualType == "integer") {
+		fail("must be of type %s, not %s", schema.Type, actualType)
+		return violations
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, candidate := range schema.Enum {
+			if candidate == val {
+				found = true
+			}
+		}
+		if !found {
+			fail("must be one of %v", schema.Enum)
+		}
+	}
+
+	switch v := val.(type) {
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			fail("must be at least %g", *schema.Minimum)
+		}
+	case string:
+		if schema.MinLength != nil && len(v) < *schema.MinLength {
+			fail("must be at least %d characters long", *schema.MinLength)
+		}
+		if schema.Pattern != "" {
+			re, err := regexp.Compile(schema.Pattern)
+			if err == nil && !re.MatchString(v) {
+				fail("must match pattern %s", schema.Pattern)
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				violations = append(violations, schema.Items.validate(item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property '%s'", name)
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			subPath := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			if propSchema, ok := schema.Properties[name]; ok {
+				violations = append(violations, propSchema.validate(v[name], subPath)...)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				violations = append(violations, schemaViolation{Path: subPath, Message: "is not an allowed property"})
+			}
+		}
+	}
+
+	return violations
+}
+
+// Checks that the value (which is always sent to us as a string) is
+// JSON that conforms to the key's schema, if it has one
+func validateConfigValue(key string, value string) error {
+	schema := configSchemas[key]
+	if isDbinfoKey(key) {
+		// Named databases such as 'dbinfo.metadb' share the schema of 'dbinfo'
+		dbName := strings.TrimPrefix(key, "dbinfo.")
+		if key != "dbinfo" && (!dbNameRegexp.MatchString(dbName) || dbName == "default") {
+			return newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidConfigValue,
+				"invalid database name '%s' in config key '%s': use letters, digits, '-' and '_'", dbName, key)
+		}
+		schema = configSchemas["dbinfo"]
+	}
+	if schema == nil {
+		return nil
+	}
+
+	var val interface{}
+	err := json.Unmarshal([]byte(value), &val)
+	if err != nil {
+		return newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidConfigValue, "value for config key '%s' is not valid JSON: %w", key, err)
+	}
+
+	violations := schema.validate(val, "")
+	if len(violations) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = v.Path + " " + v.Message
+	}
+	httpErr := newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidConfigValue,
+		"value for config key '%s' does not match its schema: %s", key, strings.Join(messages, "; "))
+	httpErr.details = map[string]interface{}{"violations": violations}
+	return httpErr
+}
+
+// GET /ldp/config-schemas returns an object mapping each key to its
+// schema; GET /ldp/config-schemas/{key} returns a single schema
+func handleConfigSchemas(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	var bytes []byte
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/ldp/config-schemas"), "/")
+	if key != "" {
+		source, ok := configSchemaSources[key]
+		if !ok {
+			sendError(w, req, newHTTPErrorf(http.StatusNotFound, errNotFound, "no schema for config key '%s'", key))
+			return
+		}
+		bytes = []byte(source)
+	} else {
+		all := map[string]json.RawMessage{}
+		for key, source := range configSchemaSources {
+			all[key] = json.RawMessage(source)
+		}
+		var err error
+		bytes, err = json.Marshal(all)
+		if err != nil {
+			sendError(w, req, fmt.Errorf("could not serialize JSON: %w", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+import "encoding/json"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_validateConfigValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		errorstr string
+	}{
+		{"key with no schema", "config", "not JSON at all", ""},
+		{"good dbinfo", "dbinfo", `{"url":"postgres://h:5432/db","user":"u","pass":"p"}`, ""},
+		{"dbinfo that is not JSON", "dbinfo", `{"url":`, "is not valid JSON"},
+		{"dbinfo of the wrong type", "dbinfo", `"postgres://h:5432/db"`, "/ must be of type object, not string"},
+		{"dbinfo with missing and empty fields", "dbinfo", `{"url":"","pass":"p"}`,
+			"/ missing required property 'user'; /url must be at least 1 characters long"},
+		{"good named dbinfo", "dbinfo.metadb", `{"url":"postgres://h:5432/db","user":"u","pass":"p"}`, ""},
+		{"bad named dbinfo", "dbinfo.metadb", `{"url":"postgres://h:5432/db"}`, "missing required property 'user'"},
+		{"dbinfo with bad name", "dbinfo.my db", `{"url":"postgres://h:5432/db","user":"u","pass":"p"}`, "invalid database name 'my db'"},
+		{"dbinfo named default", "dbinfo.default", `{"url":"postgres://h:5432/db","user":"u","pass":"p"}`, "invalid database name 'default'"},
+		{"good tqrepos", "tqrepos", `[{"user":"folio-org","repo":"folio-analytics","branch":"main","dir":"sql_metadb"}]`, ""},
+		{"tqrepos with bad item", "tqrepos", `[{"user":"folio-org","repo":"x"},{"user":"folio-org","branch":1}]`,
+			"/1 missing required property 'repo'; /1/branch must be of type string, not integer"},
+		{"good record limits", "default-record-limits", `{"defaultShow":100,"maxShow":1000}`, ""},
+		{"bad record limits", "default-record-limits", `{"defaultShow":0,"maxShow":1.5}`,
+			"/defaultShow must be at least 1; /maxShow must be of type integer, not number"},
+		{"good table-access", "table-access", `[{"schema":"folio_users","permission":"ldp.access.personal-data"}]`, ""},
+		{"table-access with unknown permission", "table-access", `[{"schema":"folio_users","table":"users","permission":"ldp.all"}]`,
+			"/0/permission must be one of [ldp.access.personal-data ldp.access.restricted]"},
+		{"good query-cost-limits", "query-cost-limits", `{"maxCost":1e7,"maxRows":1000000,"action":"reject"}`, ""},
+		{"bad query-cost-limits", "query-cost-limits", `{"maxRows":-1,"action":"ask"}`,
+			"/action must be one of [confirm reject]; /maxRows must be at least 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateConfigValue(test.key, test.value)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+				status, code := classifyError(err)
+				assert.Equal(t, 422, status)
+				assert.Equal(t, errInvalidConfigValue, code)
+			}
+		})
+	}
+}
+
+func Test_violationDetails(t *testing.T) {
+	err := validateConfigValue("sqconfig", `{"user":"u","repo":""}`)
+	details := errorDetails(err)
+	assert.Equal(t, []schemaViolation{{Path: "/repo", Message: "must be at least 1 characters long"}}, details["violations"])
+}
+
+func Test_handleConfigSchemas(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleConfigSchemas(w, httptest.NewRequest("GET", "/ldp/config-schemas", nil), nil)
+	assert.Equal(t, 200, w.Code)
+	var all map[string]map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &all))
+	assert.Equal(t, len(configSchemaSources), len(all))
+	assert.Equal(t, "object", all["dbinfo"]["type"])
+
+	w = httptest.NewRecorder()
+	handleConfigSchemas(w, httptest.NewRequest("GET", "/ldp/config-schemas/tqrepos", nil), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"type": "array"`)
+
+	w = httptest.NewRecorder()
+	handleConfigSchemas(w, httptest.NewRequest("GET", "/ldp/config-schemas/nothing", nil), nil)
+	assert.Equal(t, 404, w.Code)
+}
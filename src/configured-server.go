@@ -1,8 +1,6 @@
 package main
 
 import "fmt"
-import "regexp"
-import "github.com/MikeTaylor/catlogger"
 
 func MakeConfiguredServer(configFile string, httpRoot string) (*ModReportingServer, error) {
 	var cfg *config
@@ -11,11 +9,12 @@ func MakeConfiguredServer(configFile string, httpRoot string) (*ModReportingServ
 		return nil, fmt.Errorf("cannot read config file '%s': %w", configFile, err)
 	}
 
-	cl := cfg.Logging
-	logger := catlogger.MakeLogger(cl.Categories, cl.Prefix, cl.Timestamp)
-	logger.AddTransformation(regexp.MustCompile(`\\"pass\\":\\"[^"]*\\"`), `\"pass\":\"********\"`)
-	logger.Log("config", fmt.Sprintf("%+v", cfg))
-
+	logger := makeLogger(cfg.Logging)
 	server := MakeModReportingServer(cfg, logger, httpRoot)
+	server.audit, err = makeAuditStore(cfg.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	server.Log("config", fmt.Sprintf("%+v", cfg))
 	return server, nil
 }
@@ -0,0 +1,86 @@
+// Refusal of JSON queries whose planner estimates exceed the tenant's limits
+package main
+
+import "fmt"
+import "net/http"
+import "encoding/json"
+
+const queryCostLimitsKey = "query-cost-limits"
+
+const (
+	costActionConfirm = "confirm" // The default
+	costActionReject  = "reject"
+)
+
+// Zero means no limit
+type queryCostLimits struct {
+	MaxCost float64 `json:"maxCost"`
+	MaxRows float64 `json:"maxRows"`
+	Action  string  `json:"action"`
+}
+
+// Parses the limits stored under queryCostLimitsKey, returning nil if
+// there are none
+func makeQueryCostLimits(value string) (*queryCostLimits, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var limits queryCostLimits
+	err := json.Unmarshal([]byte(value), &limits)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s' limits: %w", queryCostLimitsKey, err)
+	}
+	if limits.MaxCost == 0 && limits.MaxRows == 0 {
+		return nil, nil
+	}
+	return &limits, nil
+}
+
+// Unless the action is "reject", the caller may confirm that the query
+// should run anyway
+func (limits *queryCostLimits) check(plan *explainResponse, confirmed bool) error {
+	overCost := limits.MaxCost > 0 && plan.EstimatedCost > limits.MaxCost
+	overRows := limits.MaxRows > 0 && plan.EstimatedRows > limits.MaxRows
+	if !overCost && !overRows {
+		return nil
+	}
+	confirmable := limits.Action != costActionReject
+	if confirmable && confirmed {
+		return nil
+	}
+
+	msg := "query is estimated to cost %g and return %g rows, exceeding this tenant's limits"
+	if confirmable {
+		msg += ": resend with confirm=true to run it anyway"
+	}
+	httpErr := newHTTPErrorf(http.StatusUnprocessableEntity, errQueryTooExpensive, msg, plan.EstimatedCost, plan.EstimatedRows)
+	httpErr.details = map[string]interface{}{
+		"estimatedCost": plan.EstimatedCost,
+		"estimatedRows": plan.EstimatedRows,
+		"maxCost":       limits.MaxCost,
+		"maxRows":       limits.MaxRows,
+		"confirmable":   confirmable,
+	}
+	return httpErr
+}
+
+// Asks the planner what the query will cost before it is run. Nothing
+// is checked if the tenant has set no limits.
+func (session *ModReportingSession) guardQueryCost(req *http.Request, db *reportingDb, limits *queryCostLimits, sql string, params []any) error {
+	if limits == nil {
+		return nil
+	}
+
+	rows, done, err := session.queryAsUser(req, db.queryDbConn(), explainCommand(sql, false), params...)
+	if err != nil {
+		return fmt.Errorf("could not estimate cost of SQL from JSON query: %w", err)
+	}
+	defer done()
+	plan, err := readExplainOutput(rows, sql, params)
+	if err != nil {
+		return err
+	}
+
+	session.LogReq(req, "db", fmt.Sprintf("estimated cost %g, rows %g", plan.EstimatedCost, plan.EstimatedRows))
+	return limits.check(plan, req.URL.Query().Get("confirm") == "true")
+}
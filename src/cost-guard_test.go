@@ -0,0 +1,98 @@
+package main
+
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+func Test_queryCostLimitsCheck(t *testing.T) {
+	plan := &explainResponse{EstimatedCost: 5000, EstimatedRows: 200000}
+
+	tests := []struct {
+		name        string
+		limits      queryCostLimits
+		confirmed   bool
+		confirmable bool // If an error is expected
+		ok          bool
+	}{
+		{name: "under both limits", limits: queryCostLimits{MaxCost: 10000, MaxRows: 500000}, ok: true},
+		{name: "cost over limit", limits: queryCostLimits{MaxCost: 1000}, confirmable: true},
+		{name: "rows over limit", limits: queryCostLimits{MaxCost: 10000, MaxRows: 1000}, confirmable: true},
+		{name: "confirmed", limits: queryCostLimits{MaxRows: 1000}, confirmed: true, ok: true},
+		{name: "rejected despite confirmation", limits: queryCostLimits{MaxRows: 1000, Action: costActionReject}, confirmed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.limits.check(plan, test.confirmed)
+			if test.ok {
+				assert.Nil(t, err)
+				return
+			}
+			status, code := classifyError(err)
+			assert.Equal(t, 422, status)
+			assert.Equal(t, errQueryTooExpensive, code)
+			assert.Equal(t, test.confirmable, errorDetails(err)["confirmable"])
+			assert.Equal(t, test.confirmable, strings.Contains(err.Error(), "confirm=true"))
+		})
+	}
+}
+
+func Test_guardedQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.RawQuery, "query-cost-limits") {
+			_, _ = w.Write([]byte(`{
+			  "items": [{
+			    "id": "0e1d8ac4-4b9e-4d38-8f3e-2d4a2d6b7c1f",
+			    "scope": "ui-ldp.admin",
+			    "key": "query-cost-limits",
+			    "value": { "maxRows": 10000 }
+			  }],
+			  "resultInfo": { "totalRecords": 1 }
+			}`))
+		} else {
+			_, _ = w.Write([]byte(`{ "items": [], "resultInfo": { "totalRecords": 0 } }`))
+		}
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name     string
+		path     string
+		runs     bool
+		errorstr string
+	}{
+		{name: "refused", path: "/ldp/db/query", errorstr: "estimated to cost 1234.5 and return 40000 rows"},
+		{name: "confirmed", path: "/ldp/db/query?confirm=true", runs: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			mock.ExpectQuery(`EXPLAIN \(FORMAT JSON\) SELECT \* FROM "folio_users"."users"`).
+				WillReturnRows(pgxmock.NewRows([]string{"QUERY PLAN"}).AddRow(samplePlan))
+			if test.runs {
+				assert.Nil(t, establishMockForQuery(mock))
+			}
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			body := `{ "tables": [{ "schema": "folio_users", "tableName": "users" }] }`
+			req := httptest.NewRequest("POST", test.path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			err := handleQuery(w, req, session)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Contains(t, w.Body.String(), "fiona@example.com")
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
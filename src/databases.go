@@ -0,0 +1,81 @@
+// List the reporting databases available to a tenant
+package main
+
+import "strings"
+import "net/http"
+import "encoding/json"
+
+type databaseEntry struct {
+	Name         string   `json:"name"` // "default", or the NAME of a 'dbinfo.NAME' setting
+	Key          string   `json:"key,omitempty"`
+	Url          string   `json:"url"`
+	User         string   `json:"user"`
+	Hosts        []dbHost `json:"hosts,omitempty"`
+	Source       string   `json:"source"` // "settings" or "local" (the config file or environment)
+	Connected    bool     `json:"connected"`
+	DatabaseType string   `json:"databaseType,omitempty"` // Known only once connected
+}
+
+// GET /ldp/db/databases lists the default database and those named by
+// 'dbinfo.NAME' settings. Any of these names may be passed to the
+// other /ldp/db/* endpoints in the db parameter or X-Reporting-Db header,
+// so settings whose names could not be passed there are omitted.
+// Passwords are never shown, even when given in the URL.
+func handleDatabases(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	items, err := fetchSettingsItems(req, session, settingsQuery("dbinfo*"), 0, -1)
+	if err != nil {
+		return err
+	}
+
+	entries := []databaseEntry{}
+	creds, overridden, err := overrideDbInfo(session.server.config.Database, session.folioSession.GetTenant())
+	if err != nil {
+		return err
+	}
+	if overridden {
+		entries = append(entries, databaseEntry{Name: "default", Url: redactDbUrl(creds.Url), User: creds.User, Source: "local"})
+	}
+
+	for _, item := range items {
+		if !isDbinfoKey(item.Key) || (item.Key == "dbinfo" && overridden) {
+			continue
+		}
+		name := strings.TrimPrefix(item.Key, "dbinfo.")
+		if item.Key == "dbinfo" {
+			name = "default"
+		} else if !dbNameRegexp.MatchString(name) || name == "default" {
+			// Written before names were checked, e.g. 'dbinfo.a.b'
+			continue
+		}
+		value, err := rawSettingsValue(item)
+		if err != nil {
+			return err
+		}
+		var sv settingsValue
+		// A malformed value is still listed, so that it can be found and fixed
+		_ = json.Unmarshal([]byte(value), &sv)
+
+		entries = append(entries, databaseEntry{Name: name, Key: item.Key, Url: redactDbUrl(sv.Url), User: sv.User, Hosts: sv.Hosts, Source: "settings"})
+	}
+
+	open := map[string]*reportingDb{}
+	for _, db := range session.openDbs() {
+		name := db.name
+		if name == "" {
+			name = "default"
+		}
+		open[name] = db
+	}
+	for i := range entries {
+		db := open[entries[i].Name]
+		if db != nil {
+			entries[i].Connected = true
+			entries[i].DatabaseType = "LDP Classic"
+			if db.isMDB {
+				entries[i].DatabaseType = "MetaDB"
+			}
+		}
+	}
+
+	return sendJSON(w, entries, "databases")
+}
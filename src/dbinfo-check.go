@@ -0,0 +1,176 @@
+// Test-connect to a proposed reporting database before its details are saved as 'dbinfo'
+package main
+
+import "fmt"
+import "time"
+import "context"
+import "net/http"
+import "encoding/json"
+
+// How long to allow for connecting and running the checks
+const dbinfoCheckTimeout = 10 * time.Second
+
+// Schemas that mod-reporting's own queries rely on for each kind of database
+var metaDBSchemas = []string{"metadb", "folio_derived"}
+var ldpClassicSchemas = []string{"public", "folio_reporting", "local"}
+
+type schemaVisibility struct {
+	Schema string `json:"schema"`
+	Exists bool   `json:"exists"`
+	Usable bool   `json:"usable"` // The user has USAGE privilege
+}
+
+type dbinfoCheckResult struct {
+	Ok            bool               `json:"ok"` // Connected, and all expected schemas are usable
+	Connected     bool               `json:"connected"`
+	ServerVersion string             `json:"serverVersion,omitempty"`
+	DatabaseType  string             `json:"databaseType,omitempty"`
+	Schemas       []schemaVisibility `json:"schemas,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	// When dbinfo lists hosts, the above describe the primary
+	Replicas []dbinfoReplicaCheck `json:"replicas,omitempty"`
+}
+
+type dbinfoReplicaCheck struct {
+	Host string `json:"host"`
+	dbinfoCheckResult
+}
+
+// Connects to the database using the same logic as makeDbConn, but
+// using the specified details rather than those stored in mod-settings
+func checkDbinfo(ctx context.Context, dbUrl string, dbUser string, dbPass string) dbinfoCheckResult {
+	var result dbinfoCheckResult
+	ctx, cancel := context.WithTimeout(ctx, dbinfoCheckTimeout)
+	defer cancel()
+
+	dbConn, err := openReportingDb(ctx, dbUrl, dbUser, dbPass, nil)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot connect to DB: %s", err)
+		return result
+	}
+	defer dbConn.Close()
+
+	err = dbConn.Ping(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot connect to DB: %s", err)
+		return result
+	}
+	result.Connected = true
+
+	err = dbConn.QueryRow(ctx, "SHOW server_version").Scan(&result.ServerVersion)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot determine server version: %s", err)
+		return result
+	}
+
+	isMDB, err := isMetaDB(ctx, dbConn)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot determine whether reporting DB is MetaDB: %s", err)
+		return result
+	}
+	expected := ldpClassicSchemas
+	result.DatabaseType = "LDP Classic"
+	if isMDB {
+		expected = metaDBSchemas
+		result.DatabaseType = "MetaDB"
+	}
+
+	rows, err := dbConn.Query(ctx, "SELECT nspname, has_schema_privilege(nspname, 'USAGE') FROM pg_namespace WHERE nspname = ANY($1)", expected)
+	if err != nil {
+		result.Error = fmt.Sprintf("cannot check schemas: %s", err)
+		return result
+	}
+	defer rows.Close()
+	usable := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var canUse bool
+		err = rows.Scan(&name, &canUse)
+		if err != nil {
+			result.Error = fmt.Sprintf("cannot check schemas: %s", err)
+			return result
+		}
+		usable[name] = canUse
+	}
+
+	result.Ok = true
+	for _, name := range expected {
+		canUse, exists := usable[name]
+		result.Schemas = append(result.Schemas, schemaVisibility{Schema: name, Exists: exists, Usable: canUse})
+		if !canUse {
+			result.Ok = false
+		}
+	}
+	return result
+}
+
+func dbinfoCheckSummary(result dbinfoCheckResult) string {
+	if result.Error != "" {
+		return result.Error
+	}
+	for _, sv := range result.Schemas {
+		if !sv.Exists {
+			return fmt.Sprintf("schema '%s' does not exist", sv.Schema)
+		} else if !sv.Usable {
+			return fmt.Sprintf("user cannot use schema '%s'", sv.Schema)
+		}
+	}
+	for _, replica := range result.Replicas {
+		if !replica.Ok {
+			return fmt.Sprintf("replica '%s': %s", replica.Host, dbinfoCheckSummary(replica.dbinfoCheckResult))
+		}
+	}
+	return "ok"
+}
+
+// Validates and decodes the proposed dbinfo value, then checks it
+func checkDbinfoValue(ctx context.Context, value string) (dbinfoCheckResult, error) {
+	err := validateConfigValue("dbinfo", value)
+	if err != nil {
+		return dbinfoCheckResult{}, err
+	}
+
+	var sv settingsValue
+	err = json.Unmarshal([]byte(value), &sv)
+	if err != nil {
+		// Should not happen, as the value has been validated
+		return dbinfoCheckResult{}, fmt.Errorf("could not decode dbinfo value: %w", err)
+	}
+
+	if len(sv.Hosts) == 0 {
+		return checkDbinfo(ctx, sv.Url, sv.User, sv.Pass), nil
+	}
+
+	// The host in the URL is replaced by those listed, as in makeDbConn
+	primaryUrl, replicas, err := splitHosts(sv.Url, sv.Hosts)
+	if err != nil {
+		return dbinfoCheckResult{Error: err.Error()}, nil
+	}
+	result := checkDbinfo(ctx, primaryUrl, sv.User, sv.Pass)
+	for _, host := range replicas {
+		replica := checkDbinfo(ctx, hostUrl(sv.Url, host, ""), sv.User, sv.Pass)
+		result.Replicas = append(result.Replicas, dbinfoReplicaCheck{Host: host, dbinfoCheckResult: replica})
+		if !replica.Ok {
+			result.Ok = false
+		}
+	}
+	return result, nil
+}
+
+// POST /ldp/config/dbinfo/test takes the same body as PUT
+// /ldp/config/dbinfo, but reports on the proposed database rather
+// than saving it
+func handleDbinfoTest(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	item, err := readConfigItem(req)
+	if err != nil {
+		return err
+	}
+
+	result, err := checkDbinfoValue(req.Context(), item.Value)
+	if err != nil {
+		return err
+	}
+	session.LogReq(req, "db", fmt.Sprintf("dbinfo test: ok=%v, connected=%v, type=%s", result.Ok, result.Connected, result.DatabaseType))
+
+	return sendJSON(w, result, "dbinfo test result")
+}
@@ -0,0 +1,185 @@
+package main
+
+import "time"
+import "errors"
+import "context"
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "github.com/jackc/pgx/v5"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func Test_checkDbinfo(t *testing.T) {
+	realOpen := openReportingDb
+	defer func() { openReportingDb = realOpen }()
+
+	var mock pgxmock.PgxPoolIface
+	var openedWith string
+	openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+		openedWith = dbConnString(dbUrl, dbUser, dbPass)
+		return mock, nil
+	}
+
+	expectChecks := func(derivedUsable bool) {
+		mock = Must(pgxmock.NewPool())
+		mock.ExpectPing()
+		mock.ExpectQuery("SHOW server_version").
+			WillReturnRows(pgxmock.NewRows([]string{"server_version"}).AddRow("16.2"))
+		mock.ExpectQuery("SELECT 1 FROM pg_class").WillReturnError(pgx.ErrNoRows)
+		mock.ExpectQuery("has_schema_privilege").WithArgs(metaDBSchemas).
+			WillReturnRows(pgxmock.NewRows([]string{"nspname", "has_schema_privilege"}).
+				AddRow("metadb", true).
+				AddRow("folio_derived", derivedUsable))
+		mock.ExpectClose()
+	}
+
+	t.Run("usable MetaDB", func(t *testing.T) {
+		expectChecks(true)
+		result := checkDbinfo(context.Background(), "jdbc:postgresql://localhost:5432/metadb", "fiona", "pw")
+		assert.Equal(t, "postgres://fiona:pw@localhost:5432/metadb", openedWith)
+		assert.True(t, result.Ok)
+		assert.True(t, result.Connected)
+		assert.Equal(t, "16.2", result.ServerVersion)
+		assert.Equal(t, "MetaDB", result.DatabaseType)
+		assert.Equal(t, []schemaVisibility{{"metadb", true, true}, {"folio_derived", true, true}}, result.Schemas)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("schema not usable", func(t *testing.T) {
+		expectChecks(false)
+		result := checkDbinfo(context.Background(), "localhost:5432/metadb", "fiona", "pw")
+		assert.False(t, result.Ok)
+		assert.True(t, result.Connected)
+		assert.Equal(t, "user cannot use schema 'folio_derived'", dbinfoCheckSummary(result))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("MetaDB detection is bounded by the timeout", func(t *testing.T) {
+		mock = Must(pgxmock.NewPool())
+		mock.ExpectPing()
+		mock.ExpectQuery("SHOW server_version").
+			WillReturnRows(pgxmock.NewRows([]string{"server_version"}).AddRow("16.2"))
+		mock.ExpectQuery("SELECT 1 FROM pg_class").WillDelayFor(time.Minute).WillReturnError(pgx.ErrNoRows)
+		mock.ExpectClose()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		result := checkDbinfo(ctx, "localhost:5432/metadb", "fiona", "pw")
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.False(t, result.Ok)
+		assert.Contains(t, result.Error, "cannot determine whether reporting DB is MetaDB")
+		assert.Contains(t, result.Error, "deadline exceeded")
+	})
+
+	t.Run("cannot connect", func(t *testing.T) {
+		mock = Must(pgxmock.NewPool())
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+		mock.ExpectClose()
+		result := checkDbinfo(context.Background(), "localhost:5432/metadb", "fiona", "pw")
+		assert.False(t, result.Ok)
+		assert.False(t, result.Connected)
+		assert.Equal(t, "cannot connect to DB: connection refused", dbinfoCheckSummary(result))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+	goodValue := `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"u\",\"user\":\"fiona\",\"pass\":\"pw\"}"}`
+
+	t.Run("test endpoint", func(t *testing.T) {
+		expectChecks(true)
+		req := httptest.NewRequest("POST", "/ldp/config/dbinfo/test", strings.NewReader(goodValue))
+		w := httptest.NewRecorder()
+		assert.Nil(t, handleDbinfoTest(w, req, session))
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `{"ok":true,"connected":true,"serverVersion":"16.2","databaseType":"MetaDB"`)
+	})
+
+	t.Run("test endpoint with invalid value", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ldp/config/dbinfo/test", strings.NewReader(`{"value":"{}"}`))
+		err := handleDbinfoTest(httptest.NewRecorder(), req, session)
+		assert.ErrorContains(t, err, "missing required property 'url'")
+	})
+
+	t.Run("PUT with validation that fails", func(t *testing.T) {
+		expectChecks(false)
+		req := httptest.NewRequest("PUT", "/ldp/config/dbinfo?validate=true", strings.NewReader(goodValue))
+		err := handleConfigKey(httptest.NewRecorder(), req, session)
+		assert.ErrorContains(t, err, "not saving 'dbinfo' as it failed the test: user cannot use schema 'folio_derived'")
+		status, code := classifyError(err)
+		assert.Equal(t, 422, status)
+		assert.Equal(t, errDbinfoCheckFailed, code)
+	})
+
+	t.Run("PUT with validation that succeeds", func(t *testing.T) {
+		expectChecks(true)
+		req := httptest.NewRequest("PUT", "/ldp/config/dbinfo?validate=true", strings.NewReader(goodValue))
+		w := httptest.NewRecorder()
+		assert.Nil(t, handleConfigKey(w, req, session))
+		assert.Equal(t, 200, w.Code)
+	})
+}
+
+func Test_checkDbinfoHosts(t *testing.T) {
+	realOpen := openReportingDb
+	defer func() { openReportingDb = realOpen }()
+
+	// Only the hosts listed here can be reached
+	usable := map[string]bool{}
+	opened := []string{}
+	openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+		opened = append(opened, dbUrl)
+		mock := Must(pgxmock.NewPool())
+		host := dbUrl[:strings.IndexAny(dbUrl, "/?")]
+		ok, found := usable[host]
+		if !found {
+			mock.ExpectPing().WillReturnError(errors.New("no such host"))
+		} else {
+			mock.ExpectPing()
+			mock.ExpectQuery("SHOW server_version").
+				WillReturnRows(pgxmock.NewRows([]string{"server_version"}).AddRow("16.2"))
+			mock.ExpectQuery("SELECT 1 FROM pg_class").WillReturnError(pgx.ErrNoRows)
+			mock.ExpectQuery("has_schema_privilege").WithArgs(metaDBSchemas).
+				WillReturnRows(pgxmock.NewRows([]string{"nspname", "has_schema_privilege"}).
+					AddRow("metadb", true).
+					AddRow("folio_derived", ok))
+		}
+		mock.ExpectClose()
+		return mock, nil
+	}
+
+	value := `{"url":"postgres://placeholder:5432/metadb","user":"fiona","pass":"pw","hosts":[` +
+		`{"host":"db1:5432","role":"primary"},{"host":"db2:5432","role":"replica"},{"host":"db3:5432","role":"replica"}]}`
+
+	t.Run("all hosts usable", func(t *testing.T) {
+		usable = map[string]bool{"db1:5432": true, "db2:5432": true, "db3:5432": true}
+		opened = nil
+		result, err := checkDbinfoValue(context.Background(), value)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"db1:5432/metadb", "db2:5432/metadb", "db3:5432/metadb"}, opened)
+		assert.True(t, result.Ok)
+		assert.Equal(t, "MetaDB", result.DatabaseType)
+		assert.Len(t, result.Replicas, 2)
+		assert.Equal(t, "db3:5432", result.Replicas[1].Host)
+		assert.True(t, result.Replicas[1].Ok)
+	})
+
+	t.Run("replica unreachable", func(t *testing.T) {
+		usable = map[string]bool{"db1:5432": true, "db2:5432": true}
+		result, err := checkDbinfoValue(context.Background(), value)
+		assert.Nil(t, err)
+		assert.False(t, result.Ok)
+		assert.True(t, result.Connected)
+		assert.Equal(t, "replica 'db3:5432': cannot connect to DB: no such host", dbinfoCheckSummary(result))
+	})
+
+	t.Run("no primary", func(t *testing.T) {
+		result, err := checkDbinfoValue(context.Background(), `{"url":"u","user":"fiona","pass":"pw","hosts":[{"host":"db2:5432","role":"replica"}]}`)
+		assert.Nil(t, err)
+		assert.False(t, result.Ok)
+		assert.Equal(t, "no host has the role 'primary'", dbinfoCheckSummary(result))
+	})
+}
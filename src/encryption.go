@@ -0,0 +1,199 @@
+// Encryption at rest of the reporting-database passwords stored in 'dbinfo' and 'dbinfo.NAME'
+package main
+
+import "os"
+import "fmt"
+import "errors"
+import "strings"
+import "net/http"
+import "crypto/aes"
+import "crypto/rand"
+import "crypto/cipher"
+import "crypto/sha256"
+import "encoding/json"
+import "encoding/base64"
+
+// Encrypted passwords are stored as this prefix followed by the
+// base64-encoded AES-256-GCM nonce and ciphertext. Anything without
+// the prefix is a legacy plaintext password.
+const encryptedPasswordPrefix = "enc:v1:"
+
+// Returns the AES key derived from the secret in the environment
+// variable MOD_REPORTING_DBINFO_KEY or, failing that, the file named by
+// MOD_REPORTING_DBINFO_KEY_FILE. If neither is set, returns nil:
+// passwords are then stored in plaintext, as in earlier releases.
+func dbinfoEncryptionKey() ([]byte, error) {
+	secret, err := envOrFile("MOD_REPORTING_DBINFO_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("could not read dbinfo encryption key: %w", err)
+	}
+	if secret == "" {
+		filename := os.Getenv("MOD_REPORTING_DBINFO_KEY_FILE")
+		if filename != "" {
+			return nil, fmt.Errorf("dbinfo encryption key file '%s' is empty", filename)
+		}
+		return nil, nil
+	}
+
+	// Hashing allows the secret to be a passphrase of any length
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+func isEncryptedPassword(s string) bool {
+	return strings.HasPrefix(s, encryptedPasswordPrefix)
+}
+
+func makeGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not make cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptPassword(key []byte, plaintext string) (string, error) {
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPasswordPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptPassword(key []byte, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, encryptedPasswordPrefix))
+	if err != nil {
+		return "", fmt.Errorf("could not decode encrypted password: %w", err)
+	}
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted password is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt password (wrong key?): %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Returns the plaintext of a password from 'dbinfo', which may or may not be encrypted
+func revealPassword(pass string) (string, error) {
+	if !isEncryptedPassword(pass) {
+		return pass, nil
+	}
+	key, err := dbinfoEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", errors.New("'dbinfo' password is encrypted but no encryption key is configured")
+	}
+	return decryptPassword(key, pass)
+}
+
+// Returns the JSON-encoded value of 'dbinfo' with its password
+// encrypted, and whether this was a change. The value is returned
+// unchanged if there is no key or the password is already encrypted.
+func encryptDbinfoValue(value string) (string, bool, error) {
+	key, err := dbinfoEncryptionKey()
+	if err != nil || key == nil {
+		return value, false, err
+	}
+
+	// Decode into a map rather than settingsValue, to retain any other fields
+	var fields map[string]interface{}
+	err = json.Unmarshal([]byte(value), &fields)
+	if err != nil {
+		return "", false, fmt.Errorf("could not decode 'dbinfo' value: %w", err)
+	}
+	pass, ok := fields["pass"].(string)
+	if !ok || pass == "" || isEncryptedPassword(pass) {
+		return value, false, nil
+	}
+
+	fields["pass"], err = encryptPassword(key, pass)
+	if err != nil {
+		return "", false, err
+	}
+	bytes, err := json.Marshal(fields)
+	if err != nil {
+		return "", false, fmt.Errorf("could not encode 'dbinfo' value: %w", err)
+	}
+	return string(bytes), true, nil
+}
+
+type encryptionMigrationResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"` // "encrypted", "unchanged" (already encrypted, or no password) or "not-found"
+}
+
+// POST /ldp/config/dbinfo/encrypt encrypts the passwords of existing
+// 'dbinfo' and 'dbinfo.NAME' records that were stored in plaintext by
+// an earlier release
+func handleEncryptDbinfo(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	key, err := dbinfoEncryptionKey()
+	if err != nil {
+		return newHTTPError(http.StatusServiceUnavailable, errEncryptionNotConfigured, err)
+	}
+	if key == nil {
+		return newHTTPErrorf(http.StatusServiceUnavailable, errEncryptionNotConfigured,
+			"no encryption key: set MOD_REPORTING_DBINFO_KEY or MOD_REPORTING_DBINFO_KEY_FILE")
+	}
+
+	items, err := fetchSettingsItems(req, session, settingsQuery("dbinfo*"), 0, -1)
+	if err != nil {
+		return err
+	}
+
+	results := []encryptionMigrationResult{}
+	for i := range items {
+		existing := &items[i]
+		if !isDbinfoKey(existing.Key) {
+			continue
+		}
+		result, err := encryptSettingsItem(req, session, existing)
+		if err != nil {
+			return err
+		}
+		session.LogReq(req, "config", existing.Key, "password encryption:", result.Status)
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		results = append(results, encryptionMigrationResult{Key: "dbinfo", Status: "not-found"})
+	}
+
+	return sendJSON(w, results, "encryption results")
+}
+
+func encryptSettingsItem(req *http.Request, session *ModReportingSession, existing *settingsItemGeneral) (encryptionMigrationResult, error) {
+	result := encryptionMigrationResult{Key: existing.Key, Status: "unchanged"}
+	value, err := rawSettingsValue(*existing)
+	if err != nil {
+		return result, err
+	}
+	newValue, changed, err := encryptDbinfoValue(value)
+	if err != nil {
+		return result, err
+	}
+
+	if changed {
+		_, err = storeConfigValue(req, session, existing.Key, newValue, existing, true)
+		if err != nil {
+			return result, err
+		}
+		result.Status = "encrypted"
+	}
+	return result, nil
+}
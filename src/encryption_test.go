@@ -0,0 +1,108 @@
+package main
+
+import "os"
+import "strings"
+import "testing"
+import "encoding/json"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_passwordEncryption(t *testing.T) {
+	key := Must(dbinfoEncryptionKeyFromSecret(t, "swordfish"))
+	otherKey := Must(dbinfoEncryptionKeyFromSecret(t, "haddock"))
+
+	encrypted := Must(encryptPassword(key, "pw"))
+	assert.True(t, isEncryptedPassword(encrypted))
+	assert.NotEqual(t, encrypted, Must(encryptPassword(key, "pw")), "nonce should differ each time")
+	assert.Equal(t, "pw", Must(decryptPassword(key, encrypted)))
+
+	_, err := decryptPassword(otherKey, encrypted)
+	assert.ErrorContains(t, err, "wrong key?")
+	_, err = decryptPassword(key, encryptedPasswordPrefix+"AAAA")
+	assert.ErrorContains(t, err, "too short")
+	_, err = decryptPassword(key, encryptedPasswordPrefix+"!!!")
+	assert.ErrorContains(t, err, "could not decode")
+}
+
+// Sets the environment so that dbinfoEncryptionKey uses the secret
+func dbinfoEncryptionKeyFromSecret(t *testing.T, secret string) ([]byte, error) {
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", secret)
+	return dbinfoEncryptionKey()
+}
+
+func Test_dbinfoEncryptionKey(t *testing.T) {
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", "")
+	t.Setenv("MOD_REPORTING_DBINFO_KEY_FILE", "")
+	assert.Nil(t, Must(dbinfoEncryptionKey()))
+
+	filename := t.TempDir() + "/key"
+	assert.Nil(t, os.WriteFile(filename, []byte("swordfish\n"), 0600))
+	t.Setenv("MOD_REPORTING_DBINFO_KEY_FILE", filename)
+	fromFile := Must(dbinfoEncryptionKey())
+	assert.Len(t, fromFile, 32)
+
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", "swordfish")
+	assert.Equal(t, fromFile, Must(dbinfoEncryptionKey()), "trailing newline in file should be ignored")
+
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", "")
+	t.Setenv("MOD_REPORTING_DBINFO_KEY_FILE", filename+".missing")
+	_, err := dbinfoEncryptionKey()
+	assert.ErrorContains(t, err, "could not read dbinfo encryption key")
+}
+
+func Test_encryptDbinfoValue(t *testing.T) {
+	original := `{"pass":"pw","url":"u","user":"fiona","extra":1}`
+
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", "")
+	value, changed, err := encryptDbinfoValue(original)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, original, value)
+
+	_, err = revealPassword(encryptedPasswordPrefix + "AAAA")
+	assert.ErrorContains(t, err, "no encryption key is configured")
+
+	t.Setenv("MOD_REPORTING_DBINFO_KEY", "swordfish")
+	value, changed, err = encryptDbinfoValue(original)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(value), &fields))
+	assert.Equal(t, "fiona", fields["user"])
+	assert.Equal(t, float64(1), fields["extra"])
+	pass := fields["pass"].(string)
+	assert.True(t, isEncryptedPassword(pass))
+	assert.Equal(t, "pw", Must(revealPassword(pass)))
+	assert.Equal(t, "legacy", Must(revealPassword("legacy")))
+
+	again, changed, err := encryptDbinfoValue(value)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, value, again)
+}
+
+func Test_handleEncryptDbinfo(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	t.Run("no key", func(t *testing.T) {
+		t.Setenv("MOD_REPORTING_DBINFO_KEY", "")
+		t.Setenv("MOD_REPORTING_DBINFO_KEY_FILE", "")
+		req := httptest.NewRequest("POST", "/ldp/config/dbinfo/encrypt", nil)
+		err := handleEncryptDbinfo(httptest.NewRecorder(), req, session)
+		assert.ErrorContains(t, err, "no encryption key")
+		status, code := classifyError(err)
+		assert.Equal(t, 503, status)
+		assert.Equal(t, errEncryptionNotConfigured, code)
+	})
+
+	t.Run("plaintext password is encrypted", func(t *testing.T) {
+		t.Setenv("MOD_REPORTING_DBINFO_KEY", "swordfish")
+		req := httptest.NewRequest("POST", "/ldp/config/dbinfo/encrypt", nil)
+		w := httptest.NewRecorder()
+		assert.Nil(t, handleEncryptDbinfo(w, req, session))
+		assert.Equal(t, `[{"key":"dbinfo","status":"encrypted"},{"key":"dbinfo.ldp","status":"unchanged"}]`, strings.TrimSpace(w.Body.String()))
+	})
+}
@@ -0,0 +1,174 @@
+// EXPLAIN output for JSON queries and reports, so that expensive ones can be spotted before they are run
+package main
+
+import "fmt"
+import "context"
+import "net/http"
+import "encoding/json"
+import "github.com/jackc/pgx/v5"
+
+// EXPLAIN ANALYZE runs the query, so it needs more than permission to explain
+const explainAnalyzePermission = "ldp.explain.analyze"
+
+type explainResponse struct {
+	Sql           string          `json:"sql"`
+	Params        []any           `json:"params"`
+	EstimatedRows float64         `json:"estimatedRows"`
+	EstimatedCost float64         `json:"estimatedCost"`
+	ActualRows    *float64        `json:"actualRows,omitempty"`    // Only with ANALYZE
+	ExecutionTime *float64        `json:"executionTime,omitempty"` // Milliseconds, only with ANALYZE
+	Plan          json.RawMessage `json:"plan"`
+}
+
+// The parts of Postgres's EXPLAIN (FORMAT JSON) output that we summarize
+type explainOutput []struct {
+	Plan struct {
+		TotalCost  float64  `json:"Total Cost"`
+		PlanRows   float64  `json:"Plan Rows"`
+		ActualRows *float64 `json:"Actual Rows"`
+	} `json:"Plan"`
+	ExecutionTime *float64 `json:"Execution Time"`
+}
+
+// Returns whether the request asks for ANALYZE, failing if the caller
+// lacks the permission for it
+func wantsAnalyze(req *http.Request) (bool, error) {
+	if req.URL.Query().Get("analyze") != "true" {
+		return false, nil
+	}
+	if !containsString(okapiPermissions(req), explainAnalyzePermission) {
+		httpErr := newHTTPErrorf(http.StatusForbidden, errAccessDenied,
+			"EXPLAIN ANALYZE requires permission '%s'", explainAnalyzePermission)
+		httpErr.details = map[string]interface{}{"permission": explainAnalyzePermission}
+		return false, httpErr
+	}
+	return true, nil
+}
+
+func explainCommand(sql string, analyze bool) string {
+	if analyze {
+		return "EXPLAIN (ANALYZE, FORMAT JSON) " + sql
+	}
+	return "EXPLAIN (FORMAT JSON) " + sql
+}
+
+// Reads the single JSON value that EXPLAIN returns and summarizes it
+func readExplainOutput(rows pgx.Rows, sql string, params []any) (*explainResponse, error) {
+	plan, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("could not read EXPLAIN output: %w", err)
+	}
+	var output explainOutput
+	err = json.Unmarshal([]byte(plan), &output)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse EXPLAIN output: %w", err)
+	}
+	if len(output) == 0 {
+		return nil, fmt.Errorf("EXPLAIN output contains no plan")
+	}
+
+	return &explainResponse{
+		Sql:           sql,
+		Params:        params,
+		EstimatedRows: output[0].Plan.PlanRows,
+		EstimatedCost: output[0].Plan.TotalCost,
+		ActualRows:    output[0].Plan.ActualRows,
+		ExecutionTime: output[0].ExecutionTime,
+		Plan:          json.RawMessage(plan),
+	}, nil
+}
+
+// ANALYZE runs the query, so it must wait its turn like any other
+func (session *ModReportingSession) slotForAnalyze(w http.ResponseWriter, req *http.Request, analyze bool) (func(), error) {
+	if !analyze {
+		return func() {}, nil
+	}
+	return session.server.acquireSlot(w, req, session)
+}
+
+func handleQueryExplain(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/query/explain")
+	defer func() { audit.finish(err) }()
+
+	analyze, err := wantsAnalyze(req)
+	if err != nil {
+		return err
+	}
+	db, err := session.findRequestedDb(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	audit.setDatabase(db.name)
+
+	policy, err := fetchQueryPolicy(req, session)
+	if err != nil {
+		return err
+	}
+	_, sql, params, err := session.prepareQuery(req, db, audit, policy)
+	if err != nil {
+		return err
+	}
+
+	release, err := session.slotForAnalyze(w, req, analyze)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rows, done, err := session.queryAsUser(req, db.queryDbConn(), explainCommand(sql, analyze), params...)
+	if err != nil {
+		return fmt.Errorf("could not explain SQL from JSON query: %w", err)
+	}
+	defer done()
+
+	response, err := readExplainOutput(rows, sql, params)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, response, "query plan")
+}
+
+// The report's function is registered, as it would be to run the
+// report, so that the call of it can be explained
+func handleReportExplain(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/reports/explain")
+	defer func() { audit.finish(err) }()
+
+	analyze, err := wantsAnalyze(req)
+	if err != nil {
+		return err
+	}
+	db, err := session.findRequestedDb(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	audit.setDatabase(db.name)
+
+	report, err := session.prepareReport(req, db, audit)
+	if err != nil {
+		return err
+	}
+
+	release, err := session.slotForAnalyze(w, req, analyze)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tx, err := session.beginReport(req, db, report.sql)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+
+	rows, err := tx.Query(req.Context(), explainCommand(report.cmd, analyze), report.params...)
+	if err != nil {
+		return fmt.Errorf("could not explain SQL from report: %w", err)
+	}
+
+	response, err := readExplainOutput(rows, report.cmd, report.params)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, response, "report plan")
+}
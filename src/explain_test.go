@@ -0,0 +1,98 @@
+package main
+
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+const samplePlan = `[{"Plan": {"Node Type": "Seq Scan", "Relation Name": "users", "Startup Cost": 0.00, "Total Cost": 1234.5, "Plan Rows": 40000, "Plan Width": 64}}]`
+const sampleAnalyzedPlan = `[{"Plan": {"Node Type": "Function Scan", "Total Cost": 10.0, "Plan Rows": 1000, "Actual Rows": 1, "Actual Loops": 1}, "Planning Time": 0.1, "Execution Time": 2.5}]`
+
+func Test_wantsAnalyze(t *testing.T) {
+	req := httptest.NewRequest("POST", "/ldp/db/query/explain", nil)
+	assert.False(t, Must(wantsAnalyze(req)))
+
+	req = httptest.NewRequest("POST", "/ldp/db/query/explain?analyze=true", nil)
+	_, err := wantsAnalyze(req)
+	status, code := classifyError(err)
+	assert.Equal(t, 403, status)
+	assert.Equal(t, errAccessDenied, code)
+	assert.Equal(t, map[string]interface{}{"permission": explainAnalyzePermission}, errorDetails(err))
+
+	req.Header.Set("X-Okapi-Permissions", `["ldp.explain.analyze"]`)
+	assert.True(t, Must(wantsAnalyze(req)))
+}
+
+func Test_queryExplain(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name     string
+		analyze  bool
+		plan     string
+		expected string
+	}{
+		{
+			name:     "plain",
+			plan:     samplePlan,
+			expected: `"sql":"SELECT * FROM \"folio_users\".\"users\"","params":[],"estimatedRows":40000,"estimatedCost":1234.5,"plan":`,
+		},
+		{
+			name:     "analyzed",
+			analyze:  true,
+			plan:     sampleAnalyzedPlan,
+			expected: `"estimatedRows":1000,"estimatedCost":10,"actualRows":1,"executionTime":2.5,"plan":`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			cmd := `EXPLAIN \(FORMAT JSON\) SELECT \* FROM "folio_users"."users"`
+			path := "/ldp/db/query/explain"
+			if test.analyze {
+				cmd = `EXPLAIN \(ANALYZE, FORMAT JSON\) SELECT \* FROM "folio_users"."users"`
+				path += "?analyze=true"
+			}
+			mock.ExpectQuery(cmd).WillReturnRows(pgxmock.NewRows([]string{"QUERY PLAN"}).AddRow(test.plan))
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			body := `{ "tables": [{ "schema": "folio_users", "tableName": "users" }] }`
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			req.Header.Set("X-Okapi-Permissions", `["ldp.explain.analyze"]`)
+			w := httptest.NewRecorder()
+			assert.Nil(t, handleQueryExplain(w, req, session))
+			assert.Contains(t, w.Body.String(), test.expected)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_reportExplain(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+
+	mock := Must(pgxmock.NewPool())
+	mock.ExpectBegin()
+	mock.ExpectExec("--metadb:function count_loans").WillReturnResult(pgxmock.NewResult("CREATE FUNCTION", 1))
+	mock.ExpectExec(`SET statement_timeout TO 60000`).WillReturnResult(pgxmock.NewResult("SET", 1))
+	mock.ExpectQuery(`EXPLAIN \(FORMAT JSON\) SELECT \* FROM count_loans\(\) LIMIT 10`).
+		WillReturnRows(pgxmock.NewRows([]string{"QUERY PLAN"}).AddRow(samplePlan))
+	mock.ExpectRollback()
+	useMockDb(session, "", mock, true)
+
+	body := strings.NewReader(`{ "url": "` + ts.URL + `/reports/loans.sql", "limit": 10 }`)
+	req := httptest.NewRequest("POST", "/ldp/db/reports/explain", body)
+	w := httptest.NewRecorder()
+	assert.Nil(t, handleReportExplain(w, req, session))
+	assert.Contains(t, w.Body.String(), `{"sql":"SELECT * FROM count_loans() LIMIT 10","params":[],"estimatedRows":40000,"estimatedCost":1234.5,"plan":[{`)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
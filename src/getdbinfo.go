@@ -1,7 +1,8 @@
 package main
 
 import "os"
-import "errors"
+import "sync"
+import "time"
 import "strings"
 import "fmt"
 import "encoding/json"
@@ -11,6 +12,10 @@ type settingsValue struct {
 	Url  string `json:"url"`
 	Pass string `json:"pass"`
 	User string `json:"user"`
+	// Optional: if present, these replace the host in the URL
+	Hosts []dbHost `json:"hosts,omitempty"`
+	// Where the metadata endpoints are sent: "primary" (the default) or "replica"
+	Metadata string `json:"metadata,omitempty"`
 }
 
 type settingsItem struct {
@@ -36,45 +41,172 @@ type oldSettingsResponse struct {
 	ResultInfo settingsResultInfo `json:"resultInfo"`
 }
 
-func getDbInfo(session foliogo.Session, token string) (string, string, string, error) {
-	// If defined, environment variables override the setting from the database
-	dburl := os.Getenv("REPORTING_DB_URL")
-	dbuser := os.Getenv("REPORTING_DB_USER")
-	dbpass := os.Getenv("REPORTING_DB_PASS")
-	if dburl != "" && dbuser != "" && dbpass != "" {
-		return dburl, dbuser, dbpass, nil
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+var fileCache = map[string]cachedFile{}
+var fileCacheMutex sync.Mutex
+
+// Returns the contents of a file, re-reading it only if it has
+// changed since it was last read. Kubernetes updates secret mounts by
+// swapping a symbolic link, which os.Stat follows.
+func readCachedFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileCacheMutex.Lock()
+	defer fileCacheMutex.Unlock()
+	cached, ok := fileCache[path]
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.content, nil
+	}
+
+	content, err := os.ReadFile(path) // #nosec G304 -- path supplied by administrator
+	if err != nil {
+		return nil, err
+	}
+	fileCache[path] = cachedFile{modTime: info.ModTime(), size: info.Size(), content: content}
+	return content, nil
+}
+
+// Returns the value of the named environment variable or, if it is
+// not set, the contents of the file named by the variable with _FILE
+// appended to its name
+func envOrFile(name string) (string, error) {
+	val := os.Getenv(name)
+	if val != "" {
+		return val, nil
+	}
+	filename := os.Getenv(name + "_FILE")
+	if filename == "" {
+		return "", nil
+	}
+	bytes, err := readCachedFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func readCredentialsFile(filename string) (dbCredentials, error) {
+	var creds dbCredentials
+	bytes, err := readCachedFile(filename)
+	if err != nil {
+		return creds, fmt.Errorf("cannot read credentials file: %w", err)
+	}
+	err = json.Unmarshal(bytes, &creds)
+	if err != nil {
+		return creds, fmt.Errorf("cannot decode credentials file '%s': %w", filename, err)
+	}
+	return creds, nil
+}
+
+// Returns reporting-database credentials that override the 'dbinfo'
+// setting, and whether there are any. In order of precedence, these
+// come from the tenant's entry in the config file, from
+// REPORTING_DB_* environment variables (or the files named by their
+// _FILE variants), or from the config file's credentials file.
+func overrideDbInfo(dbCfg databaseConfig, tenant string) (dbCredentials, bool, error) {
+	tenantCreds, ok := dbCfg.Tenants[tenant]
+	if ok {
+		creds := tenantCreds
+		if tenantCreds.CredentialsFile != "" {
+			var err error
+			creds, err = readCredentialsFile(tenantCreds.CredentialsFile)
+			if err != nil {
+				return creds, false, fmt.Errorf("tenant '%s': %w", tenant, err)
+			}
+			if tenantCreds.Url != "" {
+				creds.Url = tenantCreds.Url
+			}
+			if tenantCreds.User != "" {
+				creds.User = tenantCreds.User
+			}
+			if tenantCreds.Pass != "" {
+				creds.Pass = tenantCreds.Pass
+			}
+		}
+		return creds, true, nil
+	}
+
+	var creds dbCredentials
+	var err error
+	creds.Url, err = envOrFile("REPORTING_DB_URL")
+	if err == nil {
+		creds.User, err = envOrFile("REPORTING_DB_USER")
+	}
+	if err == nil {
+		creds.Pass, err = envOrFile("REPORTING_DB_PASS")
+	}
+	if err != nil {
+		return creds, false, err
+	}
+	if creds.Url != "" && creds.User != "" && creds.Pass != "" {
+		return creds, true, nil
+	}
+
+	if dbCfg.CredentialsFile != "" {
+		creds, err = readCredentialsFile(dbCfg.CredentialsFile)
+		return creds, err == nil, err
+	}
+	return dbCredentials{}, false, nil
+}
+
+// Returns the connection details stored under the key, which is
+// 'dbinfo' for the default reporting database or 'dbinfo.NAME' for
+// another, with the password decrypted. Locally configured
+// credentials apply only to the default.
+func getDbInfo(session foliogo.Session, token string, dbCfg databaseConfig, key string) (settingsValue, error) {
+	if key == "dbinfo" {
+		// If defined, locally configured credentials override the setting from the database
+		creds, found, err := overrideDbInfo(dbCfg, session.GetTenant())
+		if err != nil {
+			return settingsValue{}, err
+		}
+		if found {
+			return settingsValue{Url: creds.Url, User: creds.User, Pass: creds.Pass}, nil
+		}
 	}
 
 	params := foliogo.RequestParams{Token: token}
-	bytes, err := session.Fetch("settings/entries?query=scope==%22ui-ldp.admin%22+and+key==%22dbinfo%22", params)
+	bytes, err := session.Fetch("settings/entries?query=scope==%22ui-ldp.admin%22+and+key==%22"+key+"%22", params)
 	if err != nil {
-		return "", "", "", fmt.Errorf("cannot fetch 'dbinfo' from config: %w", err)
+		return settingsValue{}, fmt.Errorf("cannot fetch '%s' from config: %w", key, err)
 	}
 
 	var r settingsResponse
 	err = json.Unmarshal(bytes, &r)
 	if err != nil {
 		if !strings.Contains(err.Error(), "Go struct field settingsItem.items.value") {
-			return "", "", "", fmt.Errorf("decode 'dbinfo' JSON failed: %w", err)
+			return settingsValue{}, fmt.Errorf("decode '%s' JSON failed: %w", key, err)
 		}
 
 		var oldR oldSettingsResponse
 		err = json.Unmarshal(bytes, &oldR)
 		if err != nil {
-			return "", "", "", fmt.Errorf("decode 'dbinfo' old-style JSON failed: %w", err)
+			return settingsValue{}, fmt.Errorf("decode '%s' old-style JSON failed: %w", key, err)
 		}
 
 		err = convertResultInfo(oldR, &r)
 		if err != nil {
-			return "", "", "", err
+			return settingsValue{}, err
 		}
 	}
 
 	if r.ResultInfo.TotalRecords < 1 {
-		return "", "", "", errors.New("no 'dbinfo' setting in FOLIO database")
+		return settingsValue{}, fmt.Errorf("no '%s' setting in FOLIO database", key)
 	}
 	value := r.Items[0].Value
-	return value.Url, value.User, value.Pass, nil
+	value.Pass, err = revealPassword(value.Pass)
+	if err != nil {
+		return settingsValue{}, err
+	}
+	return value, nil
 }
 
 func convertResultInfo(oldR oldSettingsResponse, r *settingsResponse) error {
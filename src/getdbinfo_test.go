@@ -1,7 +1,10 @@
 package main
 
 import "os"
+import "time"
+import "context"
 import "testing"
+import "github.com/jackc/pgx/v5/pgxpool"
 import "github.com/stretchr/testify/assert"
 
 func Test_getDbInfo(t *testing.T) {
@@ -20,21 +23,133 @@ func Test_getDbInfo(t *testing.T) {
 		os.Setenv("REPORTING_DB_URL", url)
 		os.Setenv("REPORTING_DB_USER", "mike")
 		os.Setenv("REPORTING_DB_PASS", "swordfish")
-		dburl, dbuser, dbpass, err := getDbInfo(session.folioSession, "")
+		info, err := getDbInfo(session.folioSession, "", databaseConfig{}, "dbinfo")
 		assert.Nil(t, err)
-		assert.Equal(t, url, dburl)
-		assert.Equal(t, "mike", dbuser)
-		assert.Equal(t, "swordfish", dbpass)
+		assert.Equal(t, url, info.Url)
+		assert.Equal(t, "mike", info.User)
+		assert.Equal(t, "swordfish", info.Pass)
 	})
 
 	t.Run("info from FOLIO", func(t *testing.T) {
 		os.Setenv("REPORTING_DB_URL", "")
 		os.Setenv("REPORTING_DB_USER", "")
 		os.Setenv("REPORTING_DB_PASS", "")
-		dburl, dbuser, dbpass, err := getDbInfo(session.folioSession, "")
+		info, err := getDbInfo(session.folioSession, "", databaseConfig{}, "dbinfo")
 		assert.Nil(t, err)
-		assert.Equal(t, "dummyUrl", dburl)
-		assert.Equal(t, "fiona", dbuser)
-		assert.Equal(t, "pw", dbpass)
+		assert.Equal(t, "dummyUrl", info.Url)
+		assert.Equal(t, "fiona", info.User)
+		assert.Equal(t, "pw", info.Pass)
 	})
+
+	t.Run("named database ignores environment", func(t *testing.T) {
+		t.Setenv("REPORTING_DB_URL", "http://metadb.example.com:12345/db")
+		t.Setenv("REPORTING_DB_USER", "mike")
+		t.Setenv("REPORTING_DB_PASS", "swordfish")
+		info, err := getDbInfo(session.folioSession, "", databaseConfig{}, "dbinfo.ldp")
+		assert.Nil(t, err)
+		assert.Equal(t, "ldpUrl", info.Url)
+		assert.Equal(t, "lenny", info.User)
+		assert.Equal(t, "pw2", info.Pass)
+	})
+
+	t.Run("no such named database", func(t *testing.T) {
+		_, err := getDbInfo(session.folioSession, "", databaseConfig{}, "dbinfo.reshare")
+		assert.ErrorContains(t, err, "no 'dbinfo.reshare' setting")
+	})
+}
+
+func Test_overrideDbInfo(t *testing.T) {
+	t.Setenv("REPORTING_DB_URL", "")
+	t.Setenv("REPORTING_DB_USER", "")
+	t.Setenv("REPORTING_DB_PASS", "")
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		path := dir + "/" + name
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	t.Run("nothing configured", func(t *testing.T) {
+		_, found, err := overrideDbInfo(databaseConfig{}, "diku")
+		assert.Nil(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("environment with _FILE variants", func(t *testing.T) {
+		t.Setenv("REPORTING_DB_URL", "localhost:5432/metadb")
+		t.Setenv("REPORTING_DB_USER_FILE", writeFile("user", "mike\n"))
+		t.Setenv("REPORTING_DB_PASS_FILE", writeFile("pass", "swordfish\n"))
+		creds, found, err := overrideDbInfo(databaseConfig{}, "diku")
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, dbCredentials{Url: "localhost:5432/metadb", User: "mike", Pass: "swordfish"}, creds)
+
+		t.Setenv("REPORTING_DB_PASS_FILE", dir+"/missing")
+		_, _, err = overrideDbInfo(databaseConfig{}, "diku")
+		assert.ErrorContains(t, err, "cannot read REPORTING_DB_PASS_FILE")
+	})
+
+	t.Run("credentials file for all tenants", func(t *testing.T) {
+		path := writeFile("all.json", `{"url":"localhost:5432/metadb","user":"mike","pass":"swordfish"}`)
+		creds, found, err := overrideDbInfo(databaseConfig{CredentialsFile: path}, "diku")
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "swordfish", creds.Pass)
+
+		_, found, err = overrideDbInfo(databaseConfig{CredentialsFile: writeFile("bad.json", "{")}, "diku")
+		assert.ErrorContains(t, err, "cannot decode credentials file")
+		assert.False(t, found)
+	})
+
+	t.Run("per-tenant overrides", func(t *testing.T) {
+		t.Setenv("REPORTING_DB_URL", "env-url")
+		t.Setenv("REPORTING_DB_USER", "env-user")
+		t.Setenv("REPORTING_DB_PASS", "env-pass")
+		dbCfg := databaseConfig{
+			Tenants: map[string]dbCredentials{
+				"diku": {Url: "diku-url", User: "diku-user", Pass: "diku-pass"},
+				"fs09": {CredentialsFile: writeFile("fs09.json", `{"url":"file-url","user":"file-user","pass":"file-pass"}`), Url: "fs09-url"},
+			},
+		}
+
+		creds, _, _ := overrideDbInfo(dbCfg, "diku")
+		assert.Equal(t, dbCredentials{Url: "diku-url", User: "diku-user", Pass: "diku-pass"}, creds)
+		creds, _, _ = overrideDbInfo(dbCfg, "fs09")
+		assert.Equal(t, dbCredentials{Url: "fs09-url", User: "file-user", Pass: "file-pass"}, creds)
+		creds, _, _ = overrideDbInfo(dbCfg, "other")
+		assert.Equal(t, "env-url", creds.Url)
+	})
+
+	t.Run("changed file is re-read", func(t *testing.T) {
+		path := writeFile("rotate.json", `{"url":"u","user":"mike","pass":"old"}`)
+		dbCfg := databaseConfig{CredentialsFile: path}
+		creds, _, _ := overrideDbInfo(dbCfg, "diku")
+		assert.Equal(t, "old", creds.Pass)
+
+		writeFile("rotate.json", `{"url":"u","user":"mike","pass":"new"}`)
+		later := time.Now().Add(time.Minute)
+		assert.Nil(t, os.Chtimes(path, later, later))
+		creds, _, _ = overrideDbInfo(dbCfg, "diku")
+		assert.Equal(t, "new", creds.Pass)
+	})
+}
+
+func Test_openReportingDbRefresh(t *testing.T) {
+	refresh := func() (string, string, string, error) {
+		return "jdbc:postgresql://newhost:5433/newdb", "newuser", "newpass", nil
+	}
+	dbConn, err := openReportingDb(context.Background(), "oldhost:5432/olddb", "olduser", "oldpass", refresh)
+	assert.Nil(t, err)
+	defer dbConn.Close()
+
+	// The pool connects lazily, so we can check the hook without a database
+	poolConfig := dbConn.(*pgxpool.Pool).Config()
+	cc := poolConfig.ConnConfig.Copy()
+	assert.Equal(t, "olduser", cc.User)
+	assert.Nil(t, poolConfig.BeforeConnect(context.Background(), cc))
+	assert.Equal(t, "newhost", cc.Host)
+	assert.Equal(t, uint16(5433), cc.Port)
+	assert.Equal(t, "newdb", cc.Database)
+	assert.Equal(t, "newuser", cc.User)
+	assert.Equal(t, "newpass", cc.Password)
 }
@@ -0,0 +1,194 @@
+// handle the /admin/ready readiness-check endpoint
+package main
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "encoding/json"
+import "net/http"
+import "github.com/indexdata/foliogo"
+
+// How long to wait for each individual check before declaring it failed
+const readinessCheckTimeout = 5 * time.Second
+
+const (
+	statusUp       = "up"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+)
+
+type poolReadiness struct {
+	Tenant       string  `json:"tenant"`
+	OkapiUrl     string  `json:"okapiUrl"`
+	Database     string  `json:"database"` // "default", or the name of a 'dbinfo.NAME' setting
+	Host         string  `json:"host,omitempty"`
+	Role         string  `json:"role"` // "primary" or "replica"
+	DatabaseType string  `json:"databaseType"`
+	Status       string  `json:"status"`
+	PingMillis   float64 `json:"pingMillis"`
+	Error        string  `json:"error,omitempty"`
+}
+
+type settingsReadiness struct {
+	OkapiUrl      string  `json:"okapiUrl"`
+	Status        string  `json:"status"`
+	LatencyMillis float64 `json:"latencyMillis"`
+	Error         string  `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status   string             `json:"status"`
+	Pools    []poolReadiness    `json:"pools"`
+	Settings *settingsReadiness `json:"settings,omitempty"`
+}
+
+func handleReady(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	report := server.checkReadiness()
+
+	status := http.StatusOK
+	if report.Status == statusDown {
+		status = http.StatusServiceUnavailable
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "could not encode JSON for readiness: %s\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// Pings the reporting-database pool for each host of every active
+// session, and (if OKAPI_URL is set) checks that mod-settings can be
+// reached. The overall status is up if all checks pass, down if all
+// fail, and degraded otherwise.
+func (server *ModReportingServer) checkReadiness() readinessReport {
+	type sessionPool struct {
+		session *ModReportingSession
+		db      *reportingDb
+		hp      *hostPool
+	}
+	pools := []sessionPool{}
+	for _, session := range server.activeSessions() {
+		for _, db := range session.openDbs() {
+			for _, hp := range db.hostPools() {
+				pools = append(pools, sessionPool{session, db, hp})
+			}
+		}
+	}
+
+	report := readinessReport{Pools: make([]poolReadiness, len(pools))}
+	var wg sync.WaitGroup
+	for i, pool := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Pools[i] = pool.session.checkPool(pool.db, pool.hp)
+		}()
+	}
+	if os.Getenv("OKAPI_URL") != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Settings = server.checkSettings()
+		}()
+	}
+	wg.Wait()
+
+	checks, failures := len(report.Pools), 0
+	for _, pr := range report.Pools {
+		if pr.Status != statusUp {
+			failures++
+		}
+	}
+	if report.Settings != nil {
+		checks++
+		if report.Settings.Status != statusUp {
+			failures++
+		}
+	}
+
+	if failures == 0 {
+		report.Status = statusUp
+	} else if failures < checks {
+		report.Status = statusDegraded
+	} else {
+		report.Status = statusDown
+	}
+	return report
+}
+
+func (session *ModReportingSession) checkPool(db *reportingDb, hp *hostPool) poolReadiness {
+	pr := poolReadiness{
+		Tenant:       session.tenant,
+		OkapiUrl:     session.url,
+		Database:     "default",
+		Host:         hp.host,
+		Role:         hp.role,
+		DatabaseType: "LDP Classic",
+		Status:       statusUp,
+	}
+	if db.name != "" {
+		pr.Database = db.name
+	}
+	if db.isMDB {
+		pr.DatabaseType = "MetaDB"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := hp.dbConn.Ping(ctx)
+	pr.PingMillis = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		pr.Status = statusDown
+		pr.Error = err.Error()
+		session.Log("error", fmt.Sprintf("readiness: cannot ping reporting DB '%s' (%s %s) for tenant '%s': %s", pr.Database, pr.Role, pr.Host, session.tenant, err))
+	}
+	return pr
+}
+
+// Uses the default FOLIO session, as specified by OKAPI_URL and
+// related environment variables, to make a trivial mod-settings request
+func (server *ModReportingServer) checkSettings() *settingsReadiness {
+	sr := settingsReadiness{
+		OkapiUrl: os.Getenv("OKAPI_URL"),
+		Status:   statusUp,
+	}
+
+	start := time.Now()
+	err := server.pingSettings()
+	sr.LatencyMillis = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		sr.Status = statusDown
+		sr.Error = err.Error()
+		server.Log("error", "readiness: cannot reach mod-settings:", err.Error())
+	}
+	return &sr
+}
+
+// The session may need to log in to FOLIO first, so that too is
+// subject to the timeout
+func (server *ModReportingServer) pingSettings() error {
+	errChan := make(chan error, 1)
+	go func() {
+		session, err := server.findSession("", "", "")
+		if err == nil {
+			_, err = session.folioSession.Fetch("settings/entries?limit=1", foliogo.RequestParams{})
+		}
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(readinessCheckTimeout):
+		return fmt.Errorf("no response from mod-settings after %v", readinessCheckTimeout)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "os"
+import "errors"
+import "time"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func Test_checkReadiness(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+
+	makeSession := func(t *testing.T, server *ModReportingServer, tenant string, isMDB bool, pingErr error) *ModReportingSession {
+		session, err := NewModReportingSession(server, ts.URL, tenant, "dummyToken")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		expectation := mock.ExpectPing()
+		if pingErr != nil {
+			expectation.WillReturnError(pingErr)
+		}
+		useMockDb(session, "", mock, isMDB)
+		server.sessions[session.key()] = session
+		return session
+	}
+
+	os.Setenv("OKAPI_URL", "")
+
+	t.Run("no sessions", func(t *testing.T) {
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		report := server.checkReadiness()
+		assert.Equal(t, statusUp, report.Status)
+		assert.Empty(t, report.Pools)
+		assert.Nil(t, report.Settings)
+	})
+
+	t.Run("all pools up", func(t *testing.T) {
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		makeSession(t, server, "t1", true, nil)
+		makeSession(t, server, "t2", false, nil)
+		report := server.checkReadiness()
+		assert.Equal(t, statusUp, report.Status)
+		assert.Len(t, report.Pools, 2)
+		types := []string{report.Pools[0].DatabaseType, report.Pools[1].DatabaseType}
+		assert.ElementsMatch(t, []string{"MetaDB", "LDP Classic"}, types)
+	})
+
+	t.Run("one pool down", func(t *testing.T) {
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		makeSession(t, server, "t1", true, nil)
+		makeSession(t, server, "t2", true, errors.New("connection refused"))
+		report := server.checkReadiness()
+		assert.Equal(t, statusDegraded, report.Status)
+	})
+
+	t.Run("all pools down", func(t *testing.T) {
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		session := makeSession(t, server, "t1", true, errors.New("connection refused"))
+		report := server.checkReadiness()
+		assert.Equal(t, statusDown, report.Status)
+		assert.Equal(t, "t1", report.Pools[0].Tenant)
+		assert.Equal(t, statusDown, report.Pools[0].Status)
+		assert.Equal(t, "connection refused", report.Pools[0].Error)
+		assert.Nil(t, session.dbs[""].dbConn.(pgxmock.PgxPoolIface).ExpectationsWereMet())
+	})
+
+	t.Run("mod-settings reachable", func(t *testing.T) {
+		os.Setenv("OKAPI_URL", ts.URL)
+		os.Setenv("OKAPI_TENANT", "diku")
+		os.Setenv("OKAPI_USER", "mike")
+		os.Setenv("OKAPI_PW", "swordfish")
+		defer os.Setenv("OKAPI_URL", "")
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		report := server.checkReadiness()
+		assert.Equal(t, statusUp, report.Status)
+		assert.Equal(t, statusUp, report.Settings.Status)
+	})
+
+	t.Run("mod-settings unreachable", func(t *testing.T) {
+		os.Setenv("OKAPI_URL", "http://made.up.hostname.abc123:9000")
+		defer os.Setenv("OKAPI_URL", "")
+		server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+		makeSession(t, server, "t1", true, nil)
+		report := server.checkReadiness()
+		assert.Equal(t, statusDegraded, report.Status)
+		assert.Equal(t, statusDown, report.Settings.Status)
+	})
+}
+
+// Logging in to FOLIO for the readiness probe must not hold up
+// other requests, which all need the sessions mutex
+func Test_pingSettingsDoesNotBlockSessions(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	defer close(release)
+	t.Setenv("OKAPI_URL", ts.URL)
+	t.Setenv("OKAPI_TENANT", "diku")
+	t.Setenv("OKAPI_USER", "diku_admin")
+	t.Setenv("OKAPI_PW", "swordfish")
+
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	go func() { _ = server.pingSettings() }()
+	time.Sleep(50 * time.Millisecond) // Long enough for the login to begin
+
+	locked := server.sessionsMutex.TryLock()
+	assert.True(t, locked, "sessions mutex is held while logging in")
+	if locked {
+		server.sessionsMutex.Unlock()
+	}
+}
+
+// Nor must a readiness probe that waits for a session's databases
+func Test_checkReadinessDoesNotBlockSessions(t *testing.T) {
+	t.Setenv("OKAPI_URL", "")
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, "http://localhost:9130", "t1", "dummyToken"))
+	server.sessions[session.key()] = session
+
+	session.dbsMutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		_ = server.checkReadiness()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond) // Long enough to reach openDbs
+
+	locked := server.sessionsMutex.TryLock()
+	assert.True(t, locked, "sessions mutex is held while waiting for databases")
+	if locked {
+		server.sessionsMutex.Unlock()
+	}
+	session.dbsMutex.Unlock()
+	<-done
+}
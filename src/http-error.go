@@ -1,18 +1,168 @@
 package main
 
-/*
 import "fmt"
+import "html"
+import "errors"
+import "strings"
+import "net/http"
+import "encoding/json"
+import "github.com/jackc/pgx/v5/pgconn"
 
-type httpError struct {
-	status int
+// Stable error codes, included in JSON error responses so that
+// clients need not parse the human-readable message
+const (
+	errInvalidJson             = "invalid-json"
+	errMissingParameter        = "missing-parameter"
+	errInvalidParameter        = "invalid-parameter"
+	errMissingHeader           = "missing-header"
+	errInvalidQuery            = "invalid-query"
+	errInvalidConfigValue      = "invalid-config-value"
+	errDbinfoCheckFailed       = "dbinfo-check-failed"
+	errInvalidReport           = "invalid-report"
+	errReportUrlRejected       = "report-url-rejected"
+	errReportNotFound          = "report-not-found"
+	errWrongDatabaseType       = "wrong-database-type"
+	errNotFound                = "not-found"
+	errMethodNotAllowed        = "method-not-allowed"
+	errAlreadyExists           = "already-exists"
+	errVersionConflict         = "version-conflict"
+	errQueryTimeout            = "query-timeout"
+	errSqlError                = "sql-error"
+	errQueryTooExpensive       = "query-too-expensive"
+	errNotImplemented          = "not-implemented"
+	errDatabaseUnavailable     = "database-unavailable"
+	errSettingsUnavailable     = "settings-unavailable"
+	errEncryptionNotConfigured = "encryption-not-configured"
+	errFolioSessionFailed      = "folio-session-failed"
+	errAccessDenied            = "access-denied"
+	errTooManyRequests         = "too-many-requests"
+	errInternal                = "internal-error"
+	errDatabaseError           = "database-error"
+)
+
+// An error that knows what HTTP status it should be reported
+// with. It may wrap an underlying cause, in which case its message
+// is that of the cause.
+type HTTPError struct {
+	status  int
+	code    string
 	message string
+	cause   error
+	details map[string]interface{} // Optional: included in the JSON response
+}
+
+func (m *HTTPError) Error() string {
+	return m.message
+}
+
+func (m *HTTPError) Unwrap() error {
+	return m.cause
+}
+
+func newHTTPError(status int, code string, cause error) *HTTPError {
+	return &HTTPError{status: status, code: code, message: cause.Error(), cause: cause}
+}
+
+func newHTTPErrorf(status int, code string, format string, args ...any) *HTTPError {
+	return newHTTPError(status, code, fmt.Errorf(format, args...))
 }
 
-func MakeHttpError(status int, message string) *httpError {
-	return &httpError{status: status, message: message}
+type errorResponse struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestId string                 `json:"requestId,omitempty"`
 }
 
-func (err httpError) String() string {
-	return fmt.Sprintf("HTTP error %d: %s", err.status, err.message)
+// Determines the HTTP status and error code for an error. An
+// HTTPError anywhere in the chain of wrapped errors takes precedence;
+// otherwise Postgres errors are classified by their SQLSTATE.
+func classifyError(err error) (int, string) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.status, httpErr.code
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && len(pgErr.Code) == 5 {
+		// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+		class := pgErr.Code[:2]
+		switch {
+		case pgErr.Code == "57014": // query_canceled, i.e. statement timeout
+			return http.StatusRequestTimeout, errQueryTimeout
+		case class == "08" || pgErr.Code == "57P01" || pgErr.Code == "57P03": // connection exception, admin shutdown, cannot connect now
+			return http.StatusServiceUnavailable, errDatabaseUnavailable
+		case class == "22" || class == "42" || pgErr.Code == "25006": // data exception, syntax error or access rule violation, read-only transaction
+			return http.StatusUnprocessableEntity, errSqlError
+		default:
+			return http.StatusInternalServerError, errDatabaseError
+		}
+	}
+
+	return http.StatusInternalServerError, errInternal
+}
+
+func errorDetails(err error) map[string]interface{} {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.details != nil {
+		return httpErr.details
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+
+	details := map[string]interface{}{"sqlstate": pgErr.Code}
+	if pgErr.Position != 0 {
+		details["position"] = pgErr.Position
+	}
+	if pgErr.Detail != "" {
+		details["detail"] = pgErr.Detail
+	}
+	if pgErr.Hint != "" {
+		details["hint"] = pgErr.Hint
+	}
+	return details
+}
+
+// Old clients that explicitly ask for plain text (and not JSON) get
+// the HTML-escaped message that was all we used to send
+func wantsPlainText(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+func sendError(w http.ResponseWriter, req *http.Request, err error) {
+	status, code := classifyError(err)
+
+	if wantsPlainText(req) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, html.EscapeString(err.Error()))
+		return
+	}
+
+	response := errorResponse{
+		Code:    code,
+		Message: err.Error(),
+		Details: errorDetails(err),
+	}
+	info := getRequestInfo(req)
+	if info != nil {
+		response.RequestId = info.id
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		// Should never happen, but fall back to text if it does
+		w.WriteHeader(status)
+		fmt.Fprintln(w, html.EscapeString(response.Message))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// If w.write fails there is no way to report this to the client: see MODREP-37.
+	_, _ = w.Write(bytes)
 }
-*/
@@ -0,0 +1,70 @@
+package main
+
+import "io"
+import "fmt"
+import "errors"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/stretchr/testify/assert"
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"plain error", errors.New("oops"), 500, errInternal},
+		{"HTTP error", newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "not here"), 501, errNotImplemented},
+		{"wrapped HTTP error", fmt.Errorf("outer: %w", newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "bad")), 400, errInvalidJson},
+		{"statement timeout", fmt.Errorf("outer: %w", &pgconn.PgError{Code: "57014"}), 408, errQueryTimeout},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, 503, errDatabaseUnavailable},
+		{"syntax error", &pgconn.PgError{Code: "42601"}, 422, errSqlError},
+		{"invalid date", &pgconn.PgError{Code: "22007"}, 422, errSqlError},
+		{"disk full", &pgconn.PgError{Code: "53100"}, 500, errDatabaseError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, code := classifyError(test.err)
+			assert.Equal(t, test.status, status)
+			assert.Equal(t, test.code, code)
+		})
+	}
+}
+
+func Test_sendError(t *testing.T) {
+	pgErr := &pgconn.PgError{Severity: "ERROR", Code: "42703", Message: `column "xid" does not exist`, Position: 8}
+	err := fmt.Errorf("could not execute SQL from JSON query: %w", pgErr)
+
+	t.Run("JSON", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+		req.Header.Add("X-Okapi-Request-Id", "123456/ldp")
+		req = withRequestInfo(req)
+		w := httptest.NewRecorder()
+		sendError(w, req, err)
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, 422, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.JSONEq(t, `{
+			"code": "sql-error",
+			"message": "could not execute SQL from JSON query: ERROR: column \"xid\" does not exist (SQLSTATE 42703)",
+			"details": { "sqlstate": "42703", "position": 8 },
+			"requestId": "123456/ldp"
+		}`, string(body))
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+		req.Header.Add("Accept", "text/plain")
+		w := httptest.NewRecorder()
+		sendError(w, req, newHTTPErrorf(http.StatusNotFound, errNotFound, "no config item with key '<x>'"))
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, 404, resp.StatusCode)
+		assert.Equal(t, "no config item with key &#39;&lt;x&gt;&#39;\n", string(body))
+	})
+}
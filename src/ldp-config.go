@@ -4,6 +4,8 @@ package main
 import "io"
 import "fmt"
 import "strings"
+import "strconv"
+import "net/url"
 import "net/http"
 import "encoding/json"
 import "github.com/google/uuid"
@@ -17,6 +19,8 @@ type settingsItemGeneral struct {
 	Scope string `json:"scope"`
 	Key   string `json:"key"`
 	Value interface{}
+	// Incremented by mod-settings on each change: used for optimistic locking
+	Version int `json:"_version"`
 }
 
 type settingsResultInfoGeneral struct {
@@ -53,9 +57,11 @@ func fetchWithToken0(req *http.Request, folioSession foliogo.Session, path strin
 
 // This type is used only by the censorPassword function
 type configItemDbinfo struct {
-	User string `json:"user"`
-	Url  string `json:"url"`
-	Pass string `json:"pass"`
+	User     string   `json:"user"`
+	Url      string   `json:"url"`
+	Pass     string   `json:"pass"`
+	Hosts    []dbHost `json:"hosts,omitempty"`
+	Metadata string   `json:"metadata,omitempty"`
 }
 
 func censorPassword(value string) (string, error) {
@@ -72,22 +78,31 @@ func censorPassword(value string) (string, error) {
 	return string(bytes), err
 }
 
-func settingsItemToConfigItem(item settingsItemGeneral, tenant string) (configItem, error) {
+// Returns the item's value as a string, serializing it if necessary
+func rawSettingsValue(item settingsItemGeneral) (string, error) {
 	value, ok := item.Value.(string)
 	if !ok {
 		// mod-settings can contain values of any type: needs serializing
 		bytes, err := json.Marshal(item.Value)
 		if err != nil {
-			return configItem{}, fmt.Errorf("could not serialize value from mod-settings: %w", err)
+			return "", fmt.Errorf("could not serialize value from mod-settings: %w", err)
 		}
 		value = string(bytes)
 	}
+	return value, nil
+}
+
+func settingsItemToConfigItem(item settingsItemGeneral, tenant string) (configItem, error) {
+	value, err := rawSettingsValue(item)
+	if err != nil {
+		return configItem{}, err
+	}
 	ci := configItem{
 		Key:    item.Key,
 		Value:  value,
 		Tenant: tenant,
 	}
-	if item.Scope == "ui-ldp.admin" && item.Key == "dbinfo" {
+	if item.Scope == "ui-ldp.admin" && isDbinfoKey(item.Key) {
 		newValue, err := censorPassword(ci.Value)
 		if err != nil {
 			return configItem{}, fmt.Errorf("could not censor password: %w", err)
@@ -97,35 +112,168 @@ func settingsItemToConfigItem(item settingsItemGeneral, tenant string) (configIt
 	return ci, nil
 }
 
-// The /ldp/config endpoint only supports GET, with no URL parameters
-func handleConfig(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	bytes, err := fetchWithToken0(req, session.folioSession, "settings/entries?query=scope==%22ui-ldp.admin%22")
+// How many entries to ask mod-settings for at a time
+const settingsPageSize = 100
+
+// Parses an optional non-negative integer URL parameter
+func intParam(req *http.Request, name string, defaultValue int) (int, error) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "parameter '%s' must be a non-negative integer, not '%s'", name, s)
+	}
+	return n, nil
+}
+
+// Saved queries are kept in the ui-ldp.admin scope, but they have
+// their own endpoints, which check who owns them. They are hidden
+// from the /ldp/config endpoints, which would not.
+func isReservedConfigKey(key string) bool {
+	return strings.HasPrefix(key, savedQueryKeyPrefix)
+}
+
+func refuseReservedConfigKey(key string) error {
+	if isReservedConfigKey(key) {
+		return newHTTPErrorf(http.StatusForbidden, errAccessDenied, "config key '%s' is reserved: use /ldp/db/saved-queries", key)
+	}
+	return nil
+}
+
+// Characters that are special in CQL strings: the masking characters
+// *, ? and ^, and the quote and backslash
+var cqlEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `?`, `\?`, `^`, `\^`)
+var cqlPatternEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `?`, `\?`, `^`, `\^`)
+
+// Makes a mod-settings CQL query for the ui-ldp.admin scope, with
+// keys optionally restricted by a pattern, in which * is a wildcard
+func settingsQuery(keyPattern string) string {
+	// A stable order is needed for paging to be consistent
+	return settingsCondition(keyPattern) + "+sortby+key"
+}
+
+// As settingsQuery, but omitting the reserved keys, so that mod-settings
+// pages through and counts only the items that /ldp/config may return
+func configSettingsQuery(keyPattern string) string {
+	reserved := url.QueryEscape(cqlPatternEscaper.Replace(savedQueryKeyPrefix + "*"))
+	return settingsCondition(keyPattern) + "+not+key==%22" + reserved + "%22+sortby+key"
+}
+
+func settingsCondition(keyPattern string) string {
+	query := "scope==%22ui-ldp.admin%22"
+	if keyPattern != "" {
+		escaped := cqlPatternEscaper.Replace(keyPattern)
+		query += "+and+key==%22" + url.QueryEscape(escaped) + "%22"
+	}
+	return query
+}
+
+// Makes a mod-settings CQL query for the one key in the ui-ldp.admin
+// scope, in which no character is a wildcard
+func settingsKeyQuery(key string) string {
+	return "scope==%22ui-ldp.admin%22+and+key==%22" + url.QueryEscape(cqlEscaper.Replace(key)) + "%22"
+}
+
+// Makes a mod-settings CQL query for any of the keys in the
+// ui-ldp.admin scope, so that several can be read in one request
+func settingsKeysQuery(keys ...string) string {
+	terms := make([]string, len(keys))
+	for i, key := range keys {
+		terms[i] = "key==%22" + url.QueryEscape(cqlEscaper.Replace(key)) + "%22"
+	}
+	return "scope==%22ui-ldp.admin%22+and+%28" + strings.Join(terms, "+or+") + "%29+sortby+key"
+}
+
+// Fetches the values of the keys in the ui-ldp.admin scope, keyed by
+// key. Keys that are not set are omitted.
+func fetchSettingsValues(req *http.Request, session *ModReportingSession, keys ...string) (map[string]string, error) {
+	items, err := fetchSettingsItems(req, session, settingsKeysQuery(keys...), 0, -1)
 	if err != nil {
-		return fmt.Errorf("could not fetch from mod-settings: %w", err)
+		return nil, err
 	}
+	values := map[string]string{}
+	for _, item := range items {
+		if !containsString(keys, item.Key) {
+			continue
+		}
+		values[item.Key], err = rawSettingsValue(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
 
-	var r settingsResponseGeneral
-	err = json.Unmarshal(bytes, &r)
+// Fetches up to limit items from mod-settings, starting at offset,
+// in as many pages as needed. A negative limit means no limit.
+func fetchSettingsItems(req *http.Request, session *ModReportingSession, query string, offset int, limit int) ([]settingsItemGeneral, error) {
+	items := []settingsItemGeneral{}
+	for limit < 0 || len(items) < limit {
+		pageSize := settingsPageSize
+		if limit >= 0 && limit-len(items) < pageSize {
+			pageSize = limit - len(items)
+		}
+		path := fmt.Sprintf("settings/entries?query=%s&limit=%d&offset=%d", query, pageSize, offset)
+		bytes, err := fetchWithToken0(req, session.folioSession, path)
+		if err != nil {
+			return nil, newHTTPErrorf(http.StatusServiceUnavailable, errSettingsUnavailable, "could not fetch from mod-settings: %w", err)
+		}
+
+		var r settingsResponseGeneral
+		err = json.Unmarshal(bytes, &r)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize JSON from mod-settings: %w", err)
+		}
+
+		items = append(items, r.Items...)
+		offset += len(r.Items)
+		if len(r.Items) == 0 || offset >= r.ResultInfo.TotalRecords {
+			break
+		}
+	}
+	return items, nil
+}
+
+// The /ldp/config endpoint supports GET and POST. GET accepts the
+// optional URL parameters offset, limit and key (a pattern in
+// which * matches any sequence of characters).
+func handleConfig(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	if req.Method == "POST" {
+		return createConfigKey(w, req, session)
+	}
+
+	offset, err := intParam(req, "offset", 0)
 	if err != nil {
-		return fmt.Errorf("could not deserialize JSON from mod-settings: %w", err)
+		return err
+	}
+	limit, err := intParam(req, "limit", -1)
+	if err != nil {
+		return err
 	}
 
-	// XXX in a system with many settings, we might get back less
-	// than the full set, in which case we'd need to using paging
-	// to accumulate them all. In practice, that's never going to
-	// happen. But we could look at resultInfo.totalRecords to
-	// determine whether this has happened.
+	query := configSettingsQuery(req.URL.Query().Get("key"))
+	items, err := fetchSettingsItems(req, session, query, offset, limit)
+	if err != nil {
+		return err
+	}
 
 	tenant := session.folioSession.GetTenant()
-	config := make([]configItem, len(r.Items))
-	for i, item := range r.Items {
-		config[i], err = settingsItemToConfigItem(item, tenant)
+	config := make([]configItem, 0, len(items))
+	for _, item := range items {
+		if isReservedConfigKey(item.Key) {
+			// Excluded by the query, but not if mod-settings ignores the "not"
+			continue
+		}
+		ci, err := settingsItemToConfigItem(item, tenant)
 		if err != nil {
 			return err
 		}
+		config = append(config, ci)
 	}
 
-	bytes, err = json.Marshal(config)
+	bytes, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("could not serialize JSON: %w", err)
 	}
@@ -135,89 +283,140 @@ func handleConfig(w http.ResponseWriter, req *http.Request, session *ModReportin
 	return nil
 }
 
-// The /ldp/config/{key} endpoint only supports GET and PUT
+// Returns the mod-settings record for the key, or nil if there is none
+func fetchSettingsItem(req *http.Request, session *ModReportingSession, key string) (*settingsItemGeneral, error) {
+	path := "settings/entries?query=" + settingsKeyQuery(key)
+	bytes, err := fetchWithToken0(req, session.folioSession, path)
+	if err != nil {
+		return nil, newHTTPErrorf(http.StatusServiceUnavailable, errSettingsUnavailable, "could not read from mod-settings: %w", err)
+	}
+
+	var r settingsResponseGeneral
+	err = json.Unmarshal(bytes, &r)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize JSON %+v from mod-settings: %w", bytes, err)
+	}
+
+	// In case mod-settings does not honour the escaping, only an
+	// exact match will do: a record with a similar key is not this one
+	for i := range r.Items {
+		if r.Items[i].Key == key {
+			return &r.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// The ETag of a config item is its mod-settings _version
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// Checks an If-Match header, if there is one, against the current
+// version of the item. "*" matches any version of an existing item.
+func checkIfMatch(req *http.Request, key string, item *settingsItemGeneral) error {
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+	if item == nil {
+		return newHTTPErrorf(http.StatusPreconditionFailed, errVersionConflict, "If-Match given but there is no config item with key '%s'", key)
+	}
+
+	etag := versionETag(item.Version)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag || `"`+candidate+`"` == etag {
+			return nil
+		}
+	}
+	return newHTTPErrorf(http.StatusPreconditionFailed, errVersionConflict,
+		"config item '%s' has been modified: current version is %s, not %s", key, etag, ifMatch)
+}
+
+// The /ldp/config/{key} endpoint supports GET, PUT and DELETE
 func handleConfigKey(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
 	key := strings.Replace(req.URL.Path, "/ldp/config/", "", 1)
-	var bytes []byte
-	var err error
+	err := refuseReservedConfigKey(key)
+	if err != nil {
+		return err
+	}
 
 	if req.Method == "PUT" {
 		return writeConfigKey(w, req, session, key)
+	} else if req.Method == "DELETE" {
+		return deleteConfigKey(w, req, session, key)
 	}
 
 	// Assume GET
-	path := "settings/entries?query=scope==%22ui-ldp.admin%22+and+key==%22" + key + "%22"
-	bytes, err = fetchWithToken0(req, session.folioSession, path)
-	if err != nil {
-		return fmt.Errorf("could not read from mod-settings: %w", err)
-	}
-
-	var r settingsResponseGeneral
-	err = json.Unmarshal(bytes, &r)
+	item, err := fetchSettingsItem(req, session, key)
 	if err != nil {
-		return fmt.Errorf("could not deserialize JSON %+v from mod-settings: %w", bytes, err)
+		return err
 	}
-
-	if r.ResultInfo.TotalRecords < 1 {
-		return fmt.Errorf("no config item with key '%s'", key)
+	if item == nil {
+		return newHTTPErrorf(http.StatusNotFound, errNotFound, "no config item with key '%s'", key)
 	}
 
-	item := r.Items[0]
 	tenant := session.folioSession.GetTenant()
-	config, err := settingsItemToConfigItem(item, tenant)
+	config, err := settingsItemToConfigItem(*item, tenant)
 	if err != nil {
 		return err
 	}
 
-	bytes, err = json.Marshal(config)
+	bytes, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("could not serialize JSON: %w", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", versionETag(item.Version))
 	_, err = w.Write(bytes)
 	return err
 }
 
-func writeConfigKey(w http.ResponseWriter, req *http.Request, session *ModReportingSession, key string) error {
+func readConfigItem(req *http.Request) (configItem, error) {
+	var item configItem
 	bytes, err := io.ReadAll(req.Body)
 	if err != nil {
-		return fmt.Errorf("could not read HTTP request body: %w", err)
+		return item, fmt.Errorf("could not read HTTP request body: %w", err)
 	}
 
-	var item configItem
 	err = json.Unmarshal(bytes, &item)
 	if err != nil {
-		return fmt.Errorf("could not deserialize JSON from body: %w", err)
+		return item, newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
 	}
-	// fmt.Println("item.Value =", item.Value)
+	return item, nil
+}
 
-	// Irritatingly, the WSAPI for mod-settings is different if
-	// we're creating a new key from if we're replacing an
-	// existing one, so we need first to search for an existing
-	// record
-	path := "settings/entries?query=scope==%22ui-ldp.admin%22+and+key==%22" + key + "%22"
-	bytes, err = fetchWithToken0(req, session.folioSession, path)
+// Creates a new mod-settings record if existing is nil, and replaces
+// existing otherwise. If checkVersion is set, the replacement carries
+// the existing record's _version so that mod-settings will reject it
+// if someone else has modified the record in the meantime.
+func storeConfigValue(req *http.Request, session *ModReportingSession, key string, value string, existing *settingsItemGeneral, checkVersion bool) (map[string]interface{}, error) {
+	err := validateConfigValue(key, value)
 	if err != nil {
-		return fmt.Errorf("could not read from mod-settings: %w", err)
+		return nil, err
 	}
-
-	var r settingsResponseGeneral
-	err = json.Unmarshal(bytes, &r)
-	if err != nil {
-		return fmt.Errorf("could not deserialize JSON %+v from mod-settings: %w", bytes, err)
+	if isDbinfoKey(key) {
+		value, _, err = encryptDbinfoValue(value)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var id, method string
-	if r.ResultInfo.TotalRecords > 0 {
+	// Irritatingly, the WSAPI for mod-settings is different if
+	// we're creating a new key from if we're replacing an
+	// existing one
+	var id, method, path string
+	if existing != nil {
 		// We need to PUT to the existing record
-		id = r.Items[0].Id
+		id = existing.Id
 		method = "PUT"
 		path = "settings/entries/" + id
 	} else {
 		dumbId, err2 := uuid.NewRandom()
 		if err2 != nil {
-			return fmt.Errorf("could not generate v4 UUID: %w", err2)
+			return nil, fmt.Errorf("could not generate v4 UUID: %w", err2)
 		}
 		id = dumbId.String()
 		method = "POST"
@@ -228,21 +427,130 @@ func writeConfigKey(w http.ResponseWriter, req *http.Request, session *ModReport
 		"id":    id,
 		"scope": "ui-ldp.admin",
 		"key":   key,
-		"value": item.Value,
+		"value": value,
+	}
+	if existing != nil && checkVersion {
+		simpleSettingsItem["_version"] = existing.Version
 	}
 	_, err = fetchWithToken(req, session.folioSession, path, foliogo.RequestParams{
 		Method: method,
 		Json:   simpleSettingsItem,
 	})
-	if err != nil {
-		return fmt.Errorf("could not write to mod-settings: %w", err)
+	if err != nil && isSettingsConflict(err) {
+		if existing == nil {
+			return nil, newHTTPErrorf(http.StatusConflict, errAlreadyExists, "config item with key '%s' already exists: %w", key, err)
+		}
+		return nil, newHTTPErrorf(http.StatusPreconditionFailed, errVersionConflict, "config item '%s' has been modified by someone else: %w", key, err)
+	} else if err != nil {
+		return nil, newHTTPErrorf(http.StatusServiceUnavailable, errSettingsUnavailable, "could not write to mod-settings: %w", err)
 	}
+	delete(simpleSettingsItem, "_version")
+	return simpleSettingsItem, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	bytes, err = json.Marshal(simpleSettingsItem)
+// mod-settings rejects a write with 409 when the _version is stale,
+// or when creating a record whose key is already in use. foliogo
+// reports only the HTTP status, in the error message.
+func isSettingsConflict(err error) bool {
+	return strings.Contains(err.Error(), "409 Conflict")
+}
+
+func sendStoredConfigValue(w http.ResponseWriter, item map[string]interface{}, status int) error {
+	bytes, err := json.Marshal(item)
 	if err != nil {
 		return fmt.Errorf("could not serialize JSON for response: %w", err)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	_, _ = w.Write(bytes)
 	return nil
 }
+
+func writeConfigKey(w http.ResponseWriter, req *http.Request, session *ModReportingSession, key string) error {
+	item, err := readConfigItem(req)
+	if err != nil {
+		return err
+	}
+	// fmt.Println("item.Value =", item.Value)
+
+	if isDbinfoKey(key) && req.URL.Query().Get("validate") == "true" {
+		result, err2 := checkDbinfoValue(req.Context(), item.Value)
+		if err2 != nil {
+			return err2
+		}
+		if !result.Ok {
+			httpErr := newHTTPErrorf(http.StatusUnprocessableEntity, errDbinfoCheckFailed, "not saving '%s' as it failed the test: %s", key, dbinfoCheckSummary(result))
+			httpErr.details = map[string]interface{}{"check": result}
+			return httpErr
+		}
+	}
+
+	existing, err := fetchSettingsItem(req, session, key)
+	if err != nil {
+		return err
+	}
+	err = checkIfMatch(req, key, existing)
+	if err != nil {
+		return err
+	}
+
+	stored, err := storeConfigValue(req, session, key, item.Value, existing, req.Header.Get("If-Match") != "")
+	if err != nil {
+		return err
+	}
+	return sendStoredConfigValue(w, stored, http.StatusOK)
+}
+
+// POST /ldp/config creates a new item, taking the key from the body
+func createConfigKey(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	item, err := readConfigItem(req)
+	if err != nil {
+		return err
+	}
+	if item.Key == "" {
+		return newHTTPErrorf(http.StatusBadRequest, errMissingParameter, "config item must have a key")
+	}
+	err = refuseReservedConfigKey(item.Key)
+	if err != nil {
+		return err
+	}
+
+	existing, err := fetchSettingsItem(req, session, item.Key)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return newHTTPErrorf(http.StatusConflict, errAlreadyExists, "config item with key '%s' already exists", item.Key)
+	}
+
+	stored, err := storeConfigValue(req, session, item.Key, item.Value, nil, false)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/ldp/config/"+item.Key)
+	return sendStoredConfigValue(w, stored, http.StatusCreated)
+}
+
+func deleteConfigKey(w http.ResponseWriter, req *http.Request, session *ModReportingSession, key string) error {
+	existing, err := fetchSettingsItem(req, session, key)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return newHTTPErrorf(http.StatusNotFound, errNotFound, "no config item with key '%s'", key)
+	}
+	err = checkIfMatch(req, key, existing)
+	if err != nil {
+		return err
+	}
+
+	_, err = fetchWithToken(req, session.folioSession, "settings/entries/"+existing.Id, foliogo.RequestParams{
+		Method: "DELETE",
+	})
+	if err != nil {
+		return newHTTPErrorf(http.StatusServiceUnavailable, errSettingsUnavailable, "could not delete from mod-settings: %w", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
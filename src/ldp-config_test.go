@@ -3,6 +3,7 @@ package main
 import "io"
 import "strings"
 import "testing"
+import "net/http"
 import "github.com/stretchr/testify/assert"
 import "net/http/httptest"
 
@@ -14,6 +15,30 @@ func Test_handleConfig(t *testing.T) {
 			function: handleConfig,
 			expected: `\[{"key":"config","tenant":"dummyTenant","value":"v1"}\]`,
 		},
+		{
+			name:     "fetch all configs matching a key pattern, in several pages",
+			path:     "/ldp/config?key=page*",
+			function: handleConfig,
+			expected: `^\[{"key":"page000",.*{"key":"page249","tenant":"dummyTenant","value":"v249"}\]$`,
+		},
+		{
+			name:     "fetch configs with offset",
+			path:     "/ldp/config?key=page*&offset=240",
+			function: handleConfig,
+			expected: `^\[{"key":"page240",[^\]]*"page249"[^\]]*\]$`,
+		},
+		{
+			name:     "fetch configs with offset and limit",
+			path:     "/ldp/config?key=page*&offset=99&limit=3",
+			function: handleConfig,
+			expected: `^\[{"key":"page099",[^\]]*},{"key":"page100",[^\]]*},{"key":"page101",[^\]]*}\]$`,
+		},
+		{
+			name:     "bad limit",
+			path:     "/ldp/config?limit=-1",
+			function: handleConfig,
+			errorstr: "parameter 'limit' must be a non-negative integer",
+		},
 		{
 			name:     "fetch single config",
 			path:     "/ldp/config/dbinfo",
@@ -55,7 +80,7 @@ func Test_handleConfig(t *testing.T) {
 		{
 			name:     "rewrite an existing config value",
 			path:     "/ldp/config/dbinfo",
-			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"user\":\"abc456\"}"}`,
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"dummyUrl\",\"user\":\"abc456\",\"pass\":\"pw\"}"}`,
 			function: handleConfigKey,
 			expected: "abc456",
 		},
@@ -108,3 +133,211 @@ func Test_handleConfig(t *testing.T) {
 		})
 	}
 }
+
+func Test_configCrud(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		sendData string
+		ifMatch  string
+		status   int
+		expected string
+	}{
+		{
+			name:     "read returns version as ETag",
+			method:   "GET",
+			path:     "/ldp/config/dbinfo",
+			status:   200,
+			expected: `"key":"dbinfo"`,
+		},
+		{
+			name:     "create a new item",
+			method:   "POST",
+			path:     "/ldp/config",
+			sendData: `{"key":"foo","tenant":"diku","value":"v2"}`,
+			status:   201,
+			expected: `"key":"foo"`,
+		},
+		{
+			name:     "create an item that already exists",
+			method:   "POST",
+			path:     "/ldp/config",
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"v2"}`,
+			status:   409,
+			expected: `"code":"already-exists"`,
+		},
+		{
+			name:     "create an item with no key",
+			method:   "POST",
+			path:     "/ldp/config",
+			sendData: `{"value":"v2"}`,
+			status:   400,
+			expected: `"code":"missing-parameter"`,
+		},
+		{
+			name:     "replace with matching version",
+			method:   "PUT",
+			path:     "/ldp/config/dbinfo",
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"u\",\"user\":\"fiona\",\"pass\":\"pw\"}"}`,
+			ifMatch:  `"3"`,
+			status:   200,
+			expected: `"key":"dbinfo"`,
+		},
+		{
+			name:     "replace with wildcard version",
+			method:   "PUT",
+			path:     "/ldp/config/dbinfo",
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"u\",\"user\":\"fiona\",\"pass\":\"pw\"}"}`,
+			ifMatch:  `*`,
+			status:   200,
+			expected: `"key":"dbinfo"`,
+		},
+		{
+			name:     "replace with stale version",
+			method:   "PUT",
+			path:     "/ldp/config/dbinfo",
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"u\",\"user\":\"fiona\",\"pass\":\"pw\"}"}`,
+			ifMatch:  `"2"`,
+			status:   412,
+			expected: `"code":"version-conflict"`,
+		},
+		{
+			name:     "conditionally replace a missing item",
+			method:   "PUT",
+			path:     "/ldp/config/foo",
+			sendData: `{"key":"foo","tenant":"diku","value":"{\"url\":\"u\",\"user\":\"fiona\",\"pass\":\"pw\"}"}`,
+			ifMatch:  `"1"`,
+			status:   412,
+			expected: `"code":"version-conflict"`,
+		},
+		{
+			name:     "replace with a value that does not match the schema",
+			method:   "PUT",
+			path:     "/ldp/config/dbinfo",
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"user\":\"fiona\"}"}`,
+			status:   422,
+			expected: `"code":"invalid-config-value".*"violations":\[{"path":"/","message":"missing required property 'url'"}`,
+		},
+		{
+			name:   "delete an item",
+			method: "DELETE",
+			path:   "/ldp/config/dbinfo",
+			status: 204,
+		},
+		{
+			name:     "delete with stale version",
+			method:   "DELETE",
+			path:     "/ldp/config/dbinfo",
+			ifMatch:  `"4"`,
+			status:   412,
+			expected: `"code":"version-conflict"`,
+		},
+		{
+			name:     "delete a missing item",
+			method:   "DELETE",
+			path:     "/ldp/config/not-there",
+			status:   404,
+			expected: `"code":"not-found"`,
+		},
+		{
+			name:     "wildcard in key is not a wildcard",
+			method:   "DELETE",
+			path:     "/ldp/config/dbinfo*",
+			status:   404,
+			expected: `"code":"not-found"`,
+		},
+	}
+
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	baseUrl := ts.URL
+
+	cfg, err := readConfig("../etc/silent.json")
+	assert.Nil(t, err)
+	server := MakeModReportingServer(cfg, nil, "")
+	session, err := NewModReportingSession(server, baseUrl, "dummyTenant", "dummyToken")
+	assert.Nil(t, err)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reader io.Reader
+			if test.sendData != "" {
+				reader = strings.NewReader(test.sendData)
+			}
+			req := httptest.NewRequest(test.method, baseUrl+test.path, reader)
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+
+			function := handleConfigKey
+			if test.path == "/ldp/config" {
+				function = handleConfig
+			}
+			w := httptest.NewRecorder()
+			err := function(w, req, session)
+			if err != nil {
+				sendError(w, req, err)
+			}
+			resp := w.Result()
+			assert.Equal(t, test.status, resp.StatusCode)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Regexp(t, test.expected, string(body))
+			if test.method == "GET" {
+				assert.Equal(t, `"3"`, resp.Header.Get("ETag"))
+			}
+		})
+	}
+}
+
+func Test_settingsKeyQuery(t *testing.T) {
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+and+key==%22dbinfo%22", settingsKeyQuery("dbinfo"))
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+and+key==%22dbinfo%5C%2A%22", settingsKeyQuery("dbinfo*"))
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+and+key==%22a%5C%22+or+key%3D%3D%5C%22b%5C%3F%5C%5E%5C%5C%22", settingsKeyQuery(`a" or key=="b?^\`))
+	// In patterns for lists of keys, * remains a wildcard
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+and+key==%22dbinfo%2A%5C%3F%22+sortby+key", settingsQuery("dbinfo*?"))
+	// Reserved keys are excluded by mod-settings, so that pages are full
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+not+key==%22saved-query.%2A%22+sortby+key", configSettingsQuery(""))
+	assert.Equal(t, "scope==%22ui-ldp.admin%22+and+key==%22s%2A%22+not+key==%22saved-query.%2A%22+sortby+key", configSettingsQuery("s*"))
+}
+
+func Test_fetchSettingsItemExactKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// As if mod-settings had treated the key as a pattern
+		_, _ = w.Write([]byte(`{ "items": [{ "id": "1", "scope": "ui-ldp.admin", "key": "dbinfo.other", "value": "v" }], "resultInfo": { "totalRecords": 1 } }`))
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	req := httptest.NewRequest("GET", "/ldp/config/dbinfo*", nil)
+	item, err := fetchSettingsItem(req, session, "dbinfo*")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+}
+
+func Test_storeConfigValueConflict(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			_, _ = w.Write([]byte(`{ "items": [{ "id": "1", "scope": "ui-ldp.admin", "key": "foo", "value": "v", "_version": 3 }], "resultInfo": { "totalRecords": 1 } }`))
+			return
+		}
+		// As if someone else had modified the record after we read it
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	req := httptest.NewRequest("PUT", "/ldp/config/foo", strings.NewReader(`{"key":"foo","tenant":"diku","value":"v2"}`))
+	req.Header.Set("If-Match", `"3"`)
+	err := handleConfigKey(httptest.NewRecorder(), req, session)
+	status, code := classifyError(err)
+	assert.Equal(t, 412, status)
+	assert.Equal(t, errVersionConflict, code)
+
+	_, err = storeConfigValue(req, session, "foo", "v2", nil, false)
+	status, code = classifyError(err)
+	assert.Equal(t, 409, status)
+	assert.Equal(t, errAlreadyExists, code)
+}
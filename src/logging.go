@@ -0,0 +1,181 @@
+// Request-correlated logging, in either catlogger's free-text format or JSON lines
+package main
+
+import "io"
+import "os"
+import "fmt"
+import "time"
+import "regexp"
+import "strings"
+import "context"
+import "net/http"
+import "encoding/json"
+import "encoding/base64"
+import "github.com/google/uuid"
+import "github.com/MikeTaylor/catlogger"
+
+// Destination for JSON log lines: a variable so tests can capture them
+var jsonLogOutput io.Writer = os.Stderr
+
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Applied to every log message in both formats
+var logRedactions = []redaction{
+	{regexp.MustCompile(`\\"pass\\":\\"[^"]*\\"`), `\"pass\":\"********\"`},
+}
+
+// Details of the HTTP request being serviced, carried in its context
+type requestInfo struct {
+	id       string
+	tenant   string
+	userId   string
+	endpoint string
+	start    time.Time
+}
+
+type requestInfoKey struct{}
+
+type logEntry struct {
+	Timestamp  string   `json:"timestamp"`
+	Level      string   `json:"level"`
+	Category   string   `json:"category"`
+	Message    string   `json:"message"`
+	Tenant     string   `json:"tenant,omitempty"`
+	UserId     string   `json:"userId,omitempty"`
+	RequestId  string   `json:"requestId,omitempty"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	DurationMs *float64 `json:"durationMs,omitempty"`
+	Sql        string   `json:"sql,omitempty"`
+}
+
+func makeLogger(cl loggingConfig) *catlogger.Logger {
+	logger := catlogger.MakeLogger(cl.Categories, cl.Prefix, cl.Timestamp)
+	for _, r := range logRedactions {
+		logger.AddTransformation(r.pattern, r.replacement)
+	}
+	return logger
+}
+
+// Returns a copy of the request whose context carries a requestInfo,
+// using the Okapi request ID if there is one and generating one if not
+func withRequestInfo(req *http.Request) *http.Request {
+	id := req.Header.Get("X-Okapi-Request-Id")
+	if id == "" {
+		id = uuid.NewString()
+	}
+	info := requestInfo{
+		id:       id,
+		tenant:   req.Header.Get("X-Okapi-Tenant"),
+		userId:   userIdFromToken(req.Header.Get("X-Okapi-Token")),
+		endpoint: endpointLabel(req.URL.Path),
+		start:    time.Now(),
+	}
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, &info))
+}
+
+func getRequestInfo(req *http.Request) *requestInfo {
+	if req == nil {
+		return nil
+	}
+	info, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+type tokenPayload struct {
+	Username string `json:"sub"`
+	UserId   string `json:"user_id"`
+}
+
+// FOLIO tokens are JWTs whose payload includes the username and
+// UUID. Okapi has already verified the token of any request that it
+// passes to us, so there is no need to verify the signature here.
+func parseToken(token string) tokenPayload {
+	var payload tokenPayload
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return payload
+	}
+	bytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return payload
+	}
+	err = json.Unmarshal(bytes, &payload)
+	if err != nil {
+		return tokenPayload{}
+	}
+	return payload
+}
+
+func userIdFromToken(token string) string {
+	return parseToken(token).UserId
+}
+
+func usernameFromToken(token string) string {
+	return parseToken(token).Username
+}
+
+func redact(s string) string {
+	for _, r := range logRedactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// Emits a log line in the configured format, if the category is
+// enabled. In text format, details of the request are omitted.
+func (server *ModReportingServer) logWithRequest(req *http.Request, duration *time.Duration, cat string, args ...string) {
+	if !server.config.Logging.isJSON() {
+		server.logger.Log(cat, args...)
+		return
+	}
+	if !server.logger.HasCategory(cat) {
+		return
+	}
+
+	entry := logEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     "info",
+		Category:  cat,
+	}
+	if cat == "error" {
+		entry.Level = "error"
+	}
+	if cat == "sql" && len(args) > 0 {
+		entry.Sql = redact(args[0])
+		args = args[1:]
+	}
+	entry.Message = redact(strings.Join(args, " "))
+
+	info := getRequestInfo(req)
+	if info != nil {
+		entry.Tenant = info.tenant
+		entry.UserId = info.userId
+		entry.RequestId = info.id
+		entry.Endpoint = info.endpoint
+	}
+	if duration != nil {
+		ms := float64(duration.Microseconds()) / 1000
+		entry.DurationMs = &ms
+	}
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		// Should never happen, as all the fields are strings or numbers
+		fmt.Fprintln(jsonLogOutput, `{"level":"error","category":"error","message":"could not encode log entry"}`)
+		return
+	}
+	fmt.Fprintln(jsonLogOutput, string(bytes))
+}
+
+// Logs the completion of a request, with its status and duration
+func (server *ModReportingServer) logRequestDone(req *http.Request, status int) {
+	info := getRequestInfo(req)
+	if info == nil {
+		return
+	}
+	duration := time.Since(info.start)
+	server.logWithRequest(req, &duration, "request", req.Method, req.URL.Path, fmt.Sprint(status), duration.String())
+}
@@ -0,0 +1,88 @@
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "encoding/json"
+import "encoding/base64"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_userIdFromToken(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"diku_admin","user_id":"b5a3c4d2-1e0f-4a9b-8c7d-6e5f4a3b2c1d","tenant":"diku"}`))
+	assert.Equal(t, "b5a3c4d2-1e0f-4a9b-8c7d-6e5f4a3b2c1d", userIdFromToken("eyJhbGciOiJIUzI1NiJ9."+payload+".c2lnbmF0dXJl"))
+	assert.Equal(t, "", userIdFromToken(""))
+	assert.Equal(t, "", userIdFromToken("dummyToken"))
+	assert.Equal(t, "", userIdFromToken("a.!!!.c"))
+	assert.Equal(t, "diku_admin", usernameFromToken("eyJhbGciOiJIUzI1NiJ9."+payload+".c2lnbmF0dXJl"))
+	assert.Equal(t, "", usernameFromToken("dummyToken"))
+}
+
+func Test_withRequestInfo(t *testing.T) {
+	t.Run("request ID from Okapi", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/config/dbinfo", nil)
+		req.Header.Add("X-Okapi-Request-Id", "123456/ldp")
+		req.Header.Add("X-Okapi-Tenant", "diku")
+		info := getRequestInfo(withRequestInfo(req))
+		assert.Equal(t, "123456/ldp", info.id)
+		assert.Equal(t, "diku", info.tenant)
+		assert.Equal(t, "/ldp/config/{key}", info.endpoint)
+	})
+
+	t.Run("generated request ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		info := getRequestInfo(withRequestInfo(req))
+		assert.Len(t, info.id, 36)
+	})
+
+	t.Run("no request info", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		assert.Nil(t, getRequestInfo(req))
+		assert.Nil(t, getRequestInfo(nil))
+	})
+}
+
+func Test_jsonLogging(t *testing.T) {
+	var sb strings.Builder
+	saved := jsonLogOutput
+	jsonLogOutput = &sb
+	defer func() { jsonLogOutput = saved }()
+
+	cfg := Must(readConfig("../etc/silent.json"))
+	cfg.Logging = loggingConfig{Categories: "sql,error,request", Format: "json"}
+	server := MakeModReportingServer(cfg, makeLogger(cfg.Logging), ".")
+
+	req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+	req.Header.Add("X-Okapi-Request-Id", "654321/ldp")
+	req.Header.Add("X-Okapi-Tenant", "diku")
+	req = withRequestInfo(req)
+
+	server.LogReq(req, "sql", `SELECT * FROM "folio_users"."users"`, "[]")
+	server.LogReq(req, "error", `could not write {\"user\":\"fiona\",\"pass\":\"pw\"}`)
+	server.LogReq(req, "path", "not logged because category is disabled")
+	time.Sleep(time.Millisecond)
+	server.logRequestDone(req, 200)
+
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	assert.Len(t, lines, 3)
+	entries := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		assert.Nil(t, json.Unmarshal([]byte(line), &entries[i]))
+		assert.Equal(t, "654321/ldp", entries[i]["requestId"])
+		assert.Equal(t, "diku", entries[i]["tenant"])
+		assert.Equal(t, "/ldp/db/query", entries[i]["endpoint"])
+	}
+
+	assert.Equal(t, "sql", entries[0]["category"])
+	assert.Equal(t, "info", entries[0]["level"])
+	assert.Equal(t, `SELECT * FROM "folio_users"."users"`, entries[0]["sql"])
+	assert.Equal(t, "[]", entries[0]["message"])
+
+	assert.Equal(t, "error", entries[1]["level"])
+	assert.Contains(t, entries[1]["message"], `\"pass\":\"********\"`)
+	assert.NotContains(t, entries[1]["message"], `pw`)
+
+	assert.Equal(t, "request", entries[2]["category"])
+	assert.Greater(t, entries[2]["durationMs"], float64(0))
+	assert.Nil(t, entries[0]["durationMs"])
+}
@@ -0,0 +1,147 @@
+// Mask personal data in query and report results
+package main
+
+import "fmt"
+import "regexp"
+import "strings"
+import "net/http"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+
+// The mod-settings key of the per-tenant masking rules
+const columnMaskingKey = "column-masking"
+
+// Callers with this permission see results unmasked
+const unmaskPermission = "ldp.unmask"
+
+const (
+	maskRedact  = "redact"
+	maskHash    = "hash"
+	maskPartial = "partial"
+)
+
+// A rule matches a column if each of the fields that it specifies
+// matches. Pattern is a case-insensitive column name in which *
+// matches any sequence of characters.
+type maskingRule struct {
+	Schema  string `json:"schema,omitempty"`
+	Table   string `json:"table,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Mode    string `json:"mode"` // redact, hash or partial
+}
+
+type columnMasker struct {
+	rules   []maskingRule
+	hashKey []byte // If nil, hashes are unkeyed
+}
+
+// Reads the tenant's masking rules from mod-settings, unless the
+// caller has the unmask permission
+func fetchColumnMasker(req *http.Request, session *ModReportingSession) (*columnMasker, error) {
+	if containsString(okapiPermissions(req), unmaskPermission) {
+		return &columnMasker{}, nil
+	}
+	values, err := fetchSettingsValues(req, session, columnMaskingKey)
+	if err != nil {
+		return nil, err
+	}
+	return makeColumnMasker(req, values[columnMaskingKey])
+}
+
+// Parses the rules stored under columnMaskingKey. If there are none,
+// or the caller has the unmask permission, nothing is masked.
+func makeColumnMasker(req *http.Request, value string) (*columnMasker, error) {
+	cm := &columnMasker{}
+	if value == "" || containsString(okapiPermissions(req), unmaskPermission) {
+		return cm, nil
+	}
+	err := json.Unmarshal([]byte(value), &cm.rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s' rules: %w", columnMaskingKey, err)
+	}
+
+	key, err := envOrFile("MOD_REPORTING_MASKING_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("could not read masking key: %w", err)
+	}
+	if key != "" {
+		cm.hashKey = []byte(key)
+	}
+	return cm, nil
+}
+
+// Identifies the masking applied, so that results masked differently
+// are cached separately. The key itself is not included.
+func (cm *columnMasker) fingerprint() string {
+	if len(cm.rules) == 0 {
+		return ""
+	}
+	bytes, _ := json.Marshal(cm.rules)
+	sum := sha256.Sum256(append(bytes, cm.hashKey...))
+	return hex.EncodeToString(sum[:])
+}
+
+func matchColumnPattern(pattern string, column string) bool {
+	re := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	return regexp.MustCompile(re).MatchString(column)
+}
+
+// Returns the masking mode for a column, or "" if it is not masked.
+// The first matching rule wins. Report results do not say which
+// table a column came from, so schema and table are then passed as
+// "", and rules are matched on the column name alone. JSON queries
+// may select only plain columns of their table (see makeColumns), so
+// each result column has the name of the source column it comes from.
+func (cm *columnMasker) modeFor(schema string, table string, column string) string {
+	for _, rule := range cm.rules {
+		if schema != "" && rule.Schema != "" && rule.Schema != schema {
+			continue
+		}
+		if table != "" && rule.Table != "" && rule.Table != table {
+			continue
+		}
+		if rule.Column != "" && rule.Column != column {
+			continue
+		}
+		if rule.Pattern != "" && !matchColumnPattern(rule.Pattern, column) {
+			continue
+		}
+		return rule.Mode
+	}
+	return ""
+}
+
+func (cm *columnMasker) mask(mode string, val any) any {
+	if val == nil {
+		return nil
+	}
+	s := fmt.Sprintf("%v", val)
+
+	switch mode {
+	case maskHash:
+		// The same value always hashes the same way, so masked
+		// columns can still be counted and joined on
+		if cm.hashKey == nil {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		mac := hmac.New(sha256.New, cm.hashKey)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	case maskPartial:
+		// Show the last four characters of values long enough that
+		// most of them remain hidden
+		runes := []rune(s)
+		shown := 0
+		if len(runes) > 8 {
+			shown = 4
+		}
+		return strings.Repeat("*", len(runes)-shown) + string(runes[len(runes)-shown:])
+	default:
+		// Unknown modes redact, to fail safe
+		return "********"
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func Test_modeFor(t *testing.T) {
+	cm := &columnMasker{rules: []maskingRule{
+		{Schema: "folio_users", Table: "users", Column: "barcode", Mode: maskPartial},
+		{Schema: "folio_users", Table: "users", Column: "username", Mode: maskHash},
+		{Pattern: "*email*", Mode: maskRedact},
+		{Column: "barcode", Mode: maskRedact},
+	}}
+
+	tests := []struct {
+		name     string
+		schema   string
+		table    string
+		column   string
+		expected string
+	}{
+		{name: "qualified column", schema: "folio_users", table: "users", column: "barcode", expected: maskPartial},
+		{name: "same column in another table", schema: "folio_inventory", table: "item", column: "barcode", expected: maskRedact},
+		{name: "pattern", schema: "folio_users", table: "users", column: "Primary_Email", expected: maskRedact},
+		{name: "unmasked column", schema: "folio_users", table: "users", column: "id", expected: ""},
+		{name: "report column matched by name", column: "username", expected: maskHash},
+		{name: "report column matched by first rule", column: "barcode", expected: maskPartial},
+		{name: "report column matched by pattern", column: "email", expected: maskRedact},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, cm.modeFor(test.schema, test.table, test.column))
+		})
+	}
+}
+
+func Test_mask(t *testing.T) {
+	cm := &columnMasker{}
+	assert.Equal(t, "********", cm.mask(maskRedact, "mike@example.com"))
+	assert.Equal(t, "********", cm.mask("nonsense", 42))
+	assert.Nil(t, cm.mask(maskRedact, nil))
+	assert.Equal(t, "********7890", cm.mask(maskPartial, "123456787890"))
+	assert.Equal(t, "*****", cm.mask(maskPartial, "12345"))
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", cm.mask(maskHash, "abc"))
+
+	cm.hashKey = []byte("secret")
+	keyed := cm.mask(maskHash, "abc")
+	assert.Len(t, keyed, 64)
+	assert.NotEqual(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", keyed)
+	assert.Equal(t, keyed, cm.mask(maskHash, "abc"))
+}
+
+func Test_maskedQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.RawQuery, "column-masking") {
+			_, _ = w.Write([]byte(`{
+			  "items": [{
+			    "id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d440",
+			    "scope": "ui-ldp.admin",
+			    "key": "column-masking",
+			    "value": [{ "pattern": "email", "mode": "partial" }]
+			  }],
+			  "resultInfo": { "totalRecords": 1 }
+			}`))
+		} else {
+			_, _ = w.Write([]byte(`{ "items": [], "resultInfo": { "totalRecords": 0 } }`))
+		}
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name        string
+		permissions string
+		expected    string
+	}{
+		{
+			name:     "masked",
+			expected: `[{"name":"mike","email":"************.com"},{"name":"fiona","email":"*************.com"}]`,
+		},
+		{
+			name:        "unmasked with permission",
+			permissions: `["ldp.unmask"]`,
+			expected:    `[{"name":"mike","email":"mike@example.com"},{"name":"fiona","email":"fiona@example.com"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			assert.Nil(t, establishMockForQuery(mock))
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			body := `{ "tables": [{ "schema": "folio_users", "tableName": "users" }] }`
+			req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(body))
+			if test.permissions != "" {
+				req.Header.Set("X-Okapi-Permissions", test.permissions)
+			}
+			w := httptest.NewRecorder()
+			assert.Nil(t, handleQuery(w, req, session))
+			assert.JSONEq(t, test.expected, w.Body.String())
+		})
+	}
+}
+
+// Masking is decided by the name of the column in the results, so
+// JSON queries must not be able to rename a masked column
+func Test_maskedQueryColumns(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.RawQuery, "column-masking") {
+			_, _ = w.Write([]byte(`{
+			  "items": [{ "key": "column-masking", "value": [{ "pattern": "*user*", "mode": "redact" }] }],
+			  "resultInfo": { "totalRecords": 1 }
+			}`))
+		} else {
+			_, _ = w.Write([]byte(`{ "items": [], "resultInfo": { "totalRecords": 0 } }`))
+		}
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name     string
+		columns  string
+		expected string
+	}{
+		{
+			name:     "source column",
+			columns:  `"id", "user"`,
+			expected: `[{"id":"123","user":"********"}]`,
+		},
+		{
+			name:    "alias",
+			columns: `"user AS contact"`,
+		},
+		{
+			name:    "quoted alias",
+			columns: `"\"user\" \"contact\""`,
+		},
+		{
+			name:    "expression",
+			columns: `"lower(\"user\")"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			mock.ExpectQuery(`SELECT "id", "user" FROM "folio_users"."users"`).
+				WillReturnRows(pgxmock.NewRows([]string{"id", "user"}).AddRow("123", "mike"))
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			body := `{ "tables": [{ "schema": "folio_users", "tableName": "users", "showColumns": [` + test.columns + `] }] }`
+			req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			err := handleQuery(w, req, session)
+			if test.expected == "" {
+				status, code := classifyError(err)
+				assert.Equal(t, 400, status)
+				assert.Equal(t, errInvalidParameter, code)
+				assert.NotContains(t, w.Body.String(), "mike")
+			} else {
+				assert.Nil(t, err)
+				assert.JSONEq(t, test.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+// Filtering or sorting on a masked column would reveal its values
+func Test_maskedQueryFilters(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.RawQuery, "column-masking") {
+			_, _ = w.Write([]byte(`{
+			  "items": [{ "key": "column-masking", "value": [{ "column": "user", "mode": "redact" }] }],
+			  "resultInfo": { "totalRecords": 1 }
+			}`))
+		} else {
+			_, _ = w.Write([]byte(`{ "items": [], "resultInfo": { "totalRecords": 0 } }`))
+		}
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name     string
+		table    string
+		errorstr string
+	}{
+		{
+			name:     "LIKE filter on masked column",
+			table:    `"columnFilters": [{ "key": "user", "op": "LIKE", "value": "abc%" }]`,
+			errorstr: `cannot filter on masked column "user"`,
+		},
+		{
+			name:     "equality filter on masked column",
+			table:    `"columnFilters": [{ "key": "user", "value": "mike" }]`,
+			errorstr: `cannot filter on masked column "user"`,
+		},
+		{
+			name:     "sort by masked column",
+			table:    `"orderBy": [{ "key": "user", "direction": "asc" }]`,
+			errorstr: `cannot sort by masked column "user"`,
+		},
+		{
+			name:  "filter on unmasked column",
+			table: `"columnFilters": [{ "key": "creation_date", "value": "2024-01-01" }]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+			if test.errorstr == "" {
+				assert.Nil(t, establishMockForColumns(mock))
+				mock.ExpectQuery(`SELECT \* FROM "folio_users"."users" WHERE "creation_date" = \$1`).
+					WithArgs("2024-01-01").
+					WillReturnRows(pgxmock.NewRows([]string{"id", "user"}).AddRow("123", "mike"))
+			}
+
+			body := `{ "tables": [{ "schema": "folio_users", "tableName": "users", ` + test.table + ` }] }`
+			req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			err := handleQuery(w, req, session)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.JSONEq(t, `[{"id":"123","user":"********"}]`, w.Body.String())
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+				status, code := classifyError(err)
+				assert.Equal(t, 403, status)
+				assert.Equal(t, errAccessDenied, code)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,361 @@
+// Operational metrics, served in Prometheus text format at /admin/metrics
+package main
+
+import "io"
+import "fmt"
+import "sort"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+import "errors"
+import "net/http"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgxpool"
+
+// Latency buckets, in seconds. Reports can legitimately run for
+// minutes, so these extend a long way beyond the usual web defaults.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// A family of counters distinguished by the values of their labels
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]float64
+	labels     map[string][]string
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+		labels:     map[string][]string{},
+	}
+}
+
+func (cv *counterVec) add(val float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	cv.values[key] += val
+	cv.labels[key] = labelValues
+}
+
+func (cv *counterVec) inc(labelValues ...string) {
+	cv.add(1, labelValues...)
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	writeHeader(w, cv.name, cv.help, "counter")
+	for _, key := range sortedKeys(cv.values) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, formatLabels(cv.labelNames, cv.labels[key], "", ""), formatValue(cv.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // One per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+// A family of histograms distinguished by the values of their labels
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*histogramSeries{},
+	}
+}
+
+func (hv *histogramVec) observe(val float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+	hs := hv.series[key]
+	if hs == nil {
+		hs = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(hv.buckets))}
+		hv.series[key] = hs
+	}
+	for i, upper := range hv.buckets {
+		if val <= upper {
+			hs.counts[i]++
+			break
+		}
+	}
+	hs.count++
+	hs.sum += val
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+	writeHeader(w, hv.name, hv.help, "histogram")
+	for _, key := range sortedKeys(hv.series) {
+		hs := hv.series[key]
+		var cumulative uint64
+		for i, upper := range hv.buckets {
+			cumulative += hs.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labelNames, hs.labelValues, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labelNames, hs.labelValues, "le", "+Inf"), hs.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, formatLabels(hv.labelNames, hs.labelValues, "", ""), formatValue(hs.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, formatLabels(hv.labelNames, hs.labelValues, "", ""), hs.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// Renders a label set such as {endpoint="/ldp/db/query",status="200"},
+// optionally with one extra label (used for histogram buckets' "le")
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func formatValue(val float64) string {
+	return fmt.Sprintf("%g", val)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metrics struct {
+	requests            *counterVec
+	requestDuration     *histogramVec
+	reportDuration      *histogramVec
+	rowsReturned        *counterVec
+	timeouts            *counterVec
+	schemaCache         *counterVec
+	reportFetchFailures *counterVec
+	resultCache         *counterVec
+}
+
+// Report URLs come from the caller, so labelling metrics with them
+// would let anyone create any number of series. Instead, the label
+// is the whitelist regexp that the URL matches, or "other".
+func reportRepoLabel(whitelist []string, url string) string {
+	for _, s := range whitelist {
+		re, err := regexp.Compile(s)
+		if err == nil && re.MatchString(url) {
+			return s
+		}
+	}
+	return "other"
+}
+
+func makeMetrics() *metrics {
+	return &metrics{
+		requests: newCounterVec("mod_reporting_http_requests_total",
+			"Number of HTTP requests handled, by endpoint, method and status.",
+			"endpoint", "method", "status"),
+		requestDuration: newHistogramVec("mod_reporting_http_request_duration_seconds",
+			"Time taken to handle HTTP requests, by endpoint and status.",
+			durationBuckets, "endpoint", "status"),
+		reportDuration: newHistogramVec("mod_reporting_report_duration_seconds",
+			"Time taken to run reports, by the whitelist pattern that the report URL matched.",
+			durationBuckets, "repo"),
+		rowsReturned: newCounterVec("mod_reporting_rows_returned_total",
+			"Number of rows returned from the reporting database, by endpoint.",
+			"endpoint"),
+		timeouts: newCounterVec("mod_reporting_query_timeouts_total",
+			"Number of queries cancelled by the Postgres statement timeout, by endpoint.",
+			"endpoint"),
+		schemaCache: newCounterVec("mod_reporting_schema_cache_lookups_total",
+			"Number of lookups in the table-columns cache, by result (hit or miss).",
+			"result"),
+		reportFetchFailures: newCounterVec("mod_reporting_report_fetch_failures_total",
+			"Number of failed attempts to fetch report SQL, by the whitelist pattern that the report URL matched.",
+			"repo"),
+		resultCache: newCounterVec("mod_reporting_result_cache_lookups_total",
+			"Number of lookups in the query-result cache, by result (hit, miss, stale or bypass).",
+			"result"),
+	}
+}
+
+// Called by runWithErrorHandling once the handler has completed
+func (m *metrics) observeRequest(endpoint string, method string, status int, elapsed time.Duration, err error) {
+	statusString := fmt.Sprint(status)
+	m.requests.inc(endpoint, method, statusString)
+	m.requestDuration.observe(elapsed.Seconds(), endpoint, statusString)
+	if isQueryTimeout(err) {
+		m.timeouts.inc(endpoint)
+	}
+}
+
+// Postgres reports SQLSTATE 57014 (query_canceled) when the statement timeout expires
+func isQueryTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014"
+}
+
+// Records what HTTP status a handler sent, so it can be used as a label
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Uses the route pattern rather than the path, so that endpoint
+// labels have bounded cardinality
+func endpointLabel(path string) string {
+	for _, r := range routes {
+		if matchPattern(r.pattern, path) {
+			return r.pattern
+		}
+	}
+	return "unknown"
+}
+
+type poolStats struct {
+	acquired int32
+	idle     int32
+	total    int32
+}
+
+func (server *ModReportingServer) writeMetrics(w io.Writer) {
+	m := server.metrics
+	m.requests.write(w)
+	m.requestDuration.write(w)
+	m.reportDuration.write(w)
+	m.rowsReturned.write(w)
+	m.timeouts.write(w)
+	m.schemaCache.write(w)
+	m.reportFetchFailures.write(w)
+	m.resultCache.write(w)
+
+	// Session-level gauges are sampled at scrape time
+	sessions := server.activeSessions()
+	sessionCount := len(sessions)
+	tenant2stats := map[string]*poolStats{}
+	host2stats := map[string]*poolStats{}
+	host2labels := map[string][]string{}
+	for _, session := range sessions {
+		for _, db := range session.openDbs() {
+			for _, hp := range db.hostPools() {
+				pool, ok := hp.dbConn.(*pgxpool.Pool)
+				if !ok {
+					continue
+				}
+				stat := pool.Stat()
+				labels := []string{session.tenant, db.name, hp.host, hp.role}
+				if db.name == "" {
+					labels[1] = "default"
+				}
+				key := strings.Join(labels, "\x00")
+				if tenant2stats[session.tenant] == nil {
+					tenant2stats[session.tenant] = &poolStats{}
+				}
+				if host2stats[key] == nil {
+					host2stats[key] = &poolStats{}
+					host2labels[key] = labels
+				}
+				for _, ps := range []*poolStats{tenant2stats[session.tenant], host2stats[key]} {
+					ps.acquired += stat.AcquiredConns()
+					ps.idle += stat.IdleConns()
+					ps.total += stat.TotalConns()
+				}
+			}
+		}
+	}
+
+	writeHeader(w, "mod_reporting_active_sessions", "Number of FOLIO sessions currently cached.", "gauge")
+	fmt.Fprintf(w, "mod_reporting_active_sessions %d\n", sessionCount)
+
+	tenants := sortedKeys(tenant2stats)
+	hosts := sortedKeys(host2stats)
+	gauges := []struct {
+		name  string
+		help  string
+		value func(ps *poolStats) int32
+	}{
+		{"mod_reporting_db_pool_acquired_connections", "Number of reporting-database connections currently in use",
+			func(ps *poolStats) int32 { return ps.acquired }},
+		{"mod_reporting_db_pool_idle_connections", "Number of idle reporting-database connections",
+			func(ps *poolStats) int32 { return ps.idle }},
+		{"mod_reporting_db_pool_total_connections", "Total number of reporting-database connections",
+			func(ps *poolStats) int32 { return ps.total }},
+	}
+	for _, g := range gauges {
+		writeHeader(w, g.name, g.help+", by tenant.", "gauge")
+		for _, tenant := range tenants {
+			fmt.Fprintf(w, "%s{tenant=\"%s\"} %d\n", g.name, escapeLabelValue(tenant), g.value(tenant2stats[tenant]))
+		}
+	}
+	for _, g := range gauges {
+		name := strings.Replace(g.name, "_db_pool_", "_db_host_pool_", 1)
+		writeHeader(w, name, g.help+", by tenant, database, host and role.", "gauge")
+		for _, key := range hosts {
+			labels := formatLabels([]string{"tenant", "database", "host", "role"}, host2labels[key], "", "")
+			fmt.Fprintf(w, "%s%s %d\n", name, labels, g.value(host2stats[key]))
+		}
+	}
+
+	qs := server.limiter.status()
+	writeHeader(w, "mod_reporting_queries_running", "Number of queries and reports currently running, by tenant.", "gauge")
+	for _, ts := range qs.Tenants {
+		fmt.Fprintf(w, "mod_reporting_queries_running{tenant=\"%s\"} %d\n", escapeLabelValue(ts.Tenant), ts.Running)
+	}
+	writeHeader(w, "mod_reporting_queries_queued", "Number of queries and reports waiting for a concurrency slot, by tenant.", "gauge")
+	for _, ts := range qs.Tenants {
+		fmt.Fprintf(w, "mod_reporting_queries_queued{tenant=\"%s\"} %d\n", escapeLabelValue(ts.Tenant), ts.Queued)
+	}
+
+	if server.resultCache != nil {
+		entries, size := server.resultCache.stats()
+		writeHeader(w, "mod_reporting_result_cache_entries", "Number of results in the query-result cache.", "gauge")
+		fmt.Fprintf(w, "mod_reporting_result_cache_entries %d\n", entries)
+		writeHeader(w, "mod_reporting_result_cache_bytes", "Size of the results in the query-result cache.", "gauge")
+		fmt.Fprintf(w, "mod_reporting_result_cache_bytes %d\n", size)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	server.writeMetrics(w)
+}
@@ -0,0 +1,117 @@
+package main
+
+import "time"
+import "errors"
+import "context"
+import "strings"
+import "testing"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgxpool"
+import "github.com/stretchr/testify/assert"
+
+func Test_counterVec(t *testing.T) {
+	cv := newCounterVec("test_total", "A test counter.", "endpoint", "status")
+	cv.inc("/b", "200")
+	cv.inc("/a", "500")
+	cv.add(2, "/b", "200")
+
+	var sb strings.Builder
+	cv.write(&sb)
+	assert.Equal(t, `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{endpoint="/a",status="500"} 1
+test_total{endpoint="/b",status="200"} 3
+`, sb.String())
+}
+
+func Test_histogramVec(t *testing.T) {
+	hv := newHistogramVec("test_seconds", "A test histogram.", []float64{1, 10}, "url")
+	hv.observe(0.5, `http://x/"quoted".sql`)
+	hv.observe(5, `http://x/"quoted".sql`)
+	hv.observe(50, `http://x/"quoted".sql`)
+
+	var sb strings.Builder
+	hv.write(&sb)
+	assert.Equal(t, `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{url="http://x/\"quoted\".sql",le="1"} 1
+test_seconds_bucket{url="http://x/\"quoted\".sql",le="10"} 2
+test_seconds_bucket{url="http://x/\"quoted\".sql",le="+Inf"} 3
+test_seconds_sum{url="http://x/\"quoted\".sql"} 55.5
+test_seconds_count{url="http://x/\"quoted\".sql"} 3
+`, sb.String())
+}
+
+func Test_observeRequest(t *testing.T) {
+	m := makeMetrics()
+	timeout := &pgconn.PgError{Code: "57014", Message: "canceling statement due to statement timeout"}
+	m.observeRequest("/ldp/db/reports", "POST", 500, 2*time.Second, errors.Join(errors.New("could not execute SQL from report"), timeout))
+	m.observeRequest("/ldp/db/reports", "POST", 200, time.Second, nil)
+
+	var sb strings.Builder
+	m.requests.write(&sb)
+	m.timeouts.write(&sb)
+	assert.Contains(t, sb.String(), `mod_reporting_http_requests_total{endpoint="/ldp/db/reports",method="POST",status="500"} 1`)
+	assert.Contains(t, sb.String(), `mod_reporting_http_requests_total{endpoint="/ldp/db/reports",method="POST",status="200"} 1`)
+	assert.Contains(t, sb.String(), `mod_reporting_query_timeouts_total{endpoint="/ldp/db/reports"} 1`)
+}
+
+func Test_endpointLabel(t *testing.T) {
+	assert.Equal(t, "/ldp/db/query", endpointLabel("/ldp/db/query"))
+	assert.Equal(t, "/ldp/config", endpointLabel("/ldp/config"))
+	assert.Equal(t, "/ldp/config/{key}", endpointLabel("/ldp/config/dbinfo"))
+}
+
+func Test_reportRepoLabel(t *testing.T) {
+	whitelist := []string{`^https://gitlab\.com/MikeTaylor/metadb-queries/`, `^https://raw\.githubusercontent\.com/folio-org/`}
+	assert.Equal(t, whitelist[0], reportRepoLabel(whitelist, "https://gitlab.com/MikeTaylor/metadb-queries/-/raw/main/loans.sql"))
+	assert.Equal(t, whitelist[1], reportRepoLabel(whitelist, "https://raw.githubusercontent.com/folio-org/folio-analytics/main/x.sql"))
+	assert.Equal(t, "other", reportRepoLabel(whitelist, "https://example.com/a-new-url-every-time-1234.sql"))
+	assert.Equal(t, "other", reportRepoLabel(nil, "https://gitlab.com/MikeTaylor/metadb-queries/-/raw/main/loans.sql"))
+}
+
+func Test_hostPoolMetrics(t *testing.T) {
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, "http://localhost:9130", "t1", "dummyToken"))
+	server.sessions[session.key()] = session
+
+	// Pools connect lazily, so these never touch the network
+	primary := Must(pgxpool.New(context.Background(), "postgres://u:p@pg1:5432/metadb"))
+	replica := Must(pgxpool.New(context.Background(), "postgres://u:p@pg2:5432/metadb"))
+	defer primary.Close()
+	defer replica.Close()
+	session.dbs["ldp"] = &reportingDb{name: "ldp", dbConn: primary, hosts: []*hostPool{
+		{host: "pg1:5432", role: rolePrimary, dbConn: primary},
+		{host: "pg2:5432", role: roleReplica, dbConn: replica},
+	}}
+
+	var sb strings.Builder
+	server.writeMetrics(&sb)
+	assert.Contains(t, sb.String(), `mod_reporting_db_pool_total_connections{tenant="t1"} 0`)
+	assert.Contains(t, sb.String(), `mod_reporting_db_host_pool_total_connections{tenant="t1",database="ldp",host="pg1:5432",role="primary"} 0`)
+	assert.Contains(t, sb.String(), `mod_reporting_db_host_pool_idle_connections{tenant="t1",database="ldp",host="pg2:5432",role="replica"} 0`)
+}
+
+// A scrape that waits for a session's databases must not hold up
+// other requests, which all need the sessions mutex
+func Test_writeMetricsDoesNotBlockSessions(t *testing.T) {
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, "http://localhost:9130", "t1", "dummyToken"))
+	server.sessions[session.key()] = session
+
+	session.dbsMutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		server.writeMetrics(&strings.Builder{})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond) // Long enough to reach openDbs
+
+	locked := server.sessionsMutex.TryLock()
+	assert.True(t, locked, "sessions mutex is held while waiting for databases")
+	if locked {
+		server.sessionsMutex.Unlock()
+	}
+	session.dbsMutex.Unlock()
+	<-done
+}
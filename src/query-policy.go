@@ -0,0 +1,35 @@
+// The per-tenant policies that apply to JSON queries
+package main
+
+import "net/http"
+
+// The table-access policy, masking rules and cost limits that govern
+// a JSON query. They are read from mod-settings together, so that a
+// query costs one round trip to mod-settings rather than three.
+type queryPolicy struct {
+	access *tableAccess
+	masker *columnMasker
+	limits *queryCostLimits // nil if the tenant has set none
+}
+
+func fetchQueryPolicy(req *http.Request, session *ModReportingSession) (*queryPolicy, error) {
+	values, err := fetchSettingsValues(req, session, tableAccessKey, columnMaskingKey, queryCostLimitsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy queryPolicy
+	policy.access, err = makeTableAccess(req, values[tableAccessKey])
+	if err != nil {
+		return nil, err
+	}
+	policy.masker, err = makeColumnMasker(req, values[columnMaskingKey])
+	if err != nil {
+		return nil, err
+	}
+	policy.limits, err = makeQueryCostLimits(values[queryCostLimitsKey])
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
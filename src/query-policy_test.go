@@ -0,0 +1,47 @@
+package main
+
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_fetchQueryPolicy(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		assert.Equal(t, `scope=="ui-ldp.admin" and (key=="table-access" or key=="column-masking" or key=="query-cost-limits") sortby key`,
+			req.URL.Query().Get("query"))
+		_, _ = w.Write([]byte(`{
+		  "items": [
+		    { "key": "column-masking", "value": [{ "column": "email", "mode": "hash" }] },
+		    { "key": "query-cost-limits", "value": { "maxRows": 10000 } },
+		    { "key": "table-access", "value": [{ "schema": "folio_users", "permission": "ldp.access.personal-data" }] }
+		  ],
+		  "resultInfo": { "totalRecords": 3 }
+		}`))
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	t.Run("all policies in one request", func(t *testing.T) {
+		requests = 0
+		req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(""))
+		policy, err := fetchQueryPolicy(req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, requests)
+		assert.Equal(t, "ldp.access.personal-data", policy.access.requiredPermission("folio_users", "users"))
+		assert.Equal(t, maskHash, policy.masker.modeFor("folio_users", "users", "email"))
+		assert.Equal(t, float64(10000), policy.limits.MaxRows)
+	})
+
+	t.Run("unmask permission", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(""))
+		req.Header.Set("X-Okapi-Permissions", `["ldp.unmask"]`)
+		policy, err := fetchQueryPolicy(req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, "", policy.masker.modeFor("folio_users", "users", "email"))
+		assert.NotNil(t, policy.limits)
+	})
+}
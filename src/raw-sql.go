@@ -0,0 +1,231 @@
+// Ad-hoc read-only SQL, for analysts who need more than the JSON query builder
+package main
+
+import "fmt"
+import "io"
+import "regexp"
+import "strings"
+import "context"
+import "net/http"
+import "encoding/json"
+import "github.com/jackc/pgx/v5"
+
+type sqlRequest struct {
+	Sql    string `json:"sql"`
+	Params []any  `json:"params"`
+	Limit  int    `json:"limit"` // May lower, but not raise, the configured row cap
+}
+
+// The name of the cursor through which results are fetched
+const sqlCursor = "mod_reporting_sql"
+
+// Stops after a fixed number of rows, noting whether there were more
+type cappedRows struct {
+	pgx.Rows
+	remaining int
+	truncated bool
+}
+
+func (cr *cappedRows) Next() bool {
+	if cr.remaining <= 0 {
+		cr.truncated = cr.Rows.Next()
+		return false
+	}
+	cr.remaining--
+	return cr.Rows.Next()
+}
+
+// Returns the index just past the quoted identifier or string literal
+// starting at sql[start]. In a literal written E'...', backslash
+// escapes the next character.
+func skipQuoted(sql string, start int, escapes bool) int {
+	quote := sql[start]
+	for i := start + 1; i < len(sql); i++ {
+		if escapes && sql[i] == '\\' {
+			i++
+		} else if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+			} else {
+				return i + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// Block comments nest in Postgres
+func skipBlockComment(sql string, start int) int {
+	depth := 0
+	for i := start; i < len(sql)-1; i++ {
+		if sql[i] == '/' && sql[i+1] == '*' {
+			depth++
+			i++
+		} else if sql[i] == '*' && sql[i+1] == '/' {
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+var dollarQuoteRegexp = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Returns the statement without any trailing semicolon, failing if
+// there is more than one statement or none. Semicolons in literals,
+// quoted identifiers and comments are not statement separators.
+func singleStatement(sql string) (string, error) {
+	end := -1 // The first separating semicolon, once found
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		next := i + 1
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			next = strings.IndexByte(sql[i:], '\n')
+			if next < 0 {
+				next = len(sql)
+			} else {
+				next += i + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			next = skipBlockComment(sql, i)
+		case c == ';':
+			if end < 0 {
+				end = i
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+		case end >= 0:
+			return "", newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "only a single SQL statement may be run")
+		case c == '\'' || c == '"':
+			next = skipQuoted(sql, i, c == '\'' && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e'))
+		case c == '$' && (i == 0 || !isIdentifierChar(sql[i-1])):
+			tag := dollarQuoteRegexp.FindString(sql[i:])
+			if tag != "" {
+				closing := strings.Index(sql[i+len(tag):], tag)
+				if closing < 0 {
+					next = len(sql)
+				} else {
+					next = i + len(tag) + closing + len(tag)
+				}
+			}
+		}
+		i = next
+	}
+
+	if end < 0 {
+		end = len(sql)
+	}
+	statement := strings.TrimSpace(sql[:end])
+	if statement == "" {
+		return "", newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "no SQL statement given")
+	}
+	return statement, nil
+}
+
+// POST /ldp/db/sql runs the caller's SQL in a read-only transaction,
+// returning results in the same form as a JSON query. Table-access
+// rules cannot be applied to arbitrary SQL, and masking is easily
+// evaded by renaming columns, so only the database's own grants
+// restrict what may be read. Where the tenant has rules that would
+// restrict the caller, SQL is refused unless it runs as a role.
+// Results are fetched through a cursor, so that the database stops
+// after one row more than the cap, and are buffered before sending.
+func handleSql(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/sql")
+	defer func() { audit.finish(err) }()
+
+	db, err := session.findRequestedDb(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	audit.setDatabase(db.name)
+
+	bytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("could not read HTTP request body: %w", err)
+	}
+	var body sqlRequest
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		return newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
+	}
+	sql, err := singleStatement(body.Sql)
+	if err != nil {
+		return err
+	}
+	audit.setSql(sql, true)
+	audit.setParams(body.Params)
+
+	masker, err := fetchColumnMasker(req, session)
+	if err != nil {
+		return err
+	}
+	access, err := fetchTableAccess(req, session)
+	if err != nil {
+		return err
+	}
+	role := session.requestRole(req)
+	if role == "" && (access.restricts() || len(masker.rules) > 0) {
+		return newHTTPErrorf(http.StatusForbidden, errAccessDenied,
+			"ad-hoc SQL cannot honour this tenant's table-access or masking rules, and no database role is configured for this user")
+	}
+	maxRows := session.server.config.Sql.MaxRows
+	if body.Limit > 0 && body.Limit < maxRows {
+		maxRows = body.Limit
+	}
+	session.LogReq(req, "sql", sql, fmt.Sprintf("%v", body.Params))
+
+	tx, err := db.queryDbConn().Begin(req.Context())
+	if err != nil {
+		return fmt.Errorf("could not open transaction: %w", err)
+	}
+	defer func() {
+		// Explicitly discard return value so golangci-lint understands the intent
+		_ = tx.Rollback(context.Background())
+	}()
+
+	_, err = tx.Exec(req.Context(), "SET TRANSACTION READ ONLY")
+	if err != nil {
+		return fmt.Errorf("could not make transaction read-only: %w", err)
+	}
+	if role != "" {
+		session.LogReq(req, "db", "running as role", role)
+		err = setLocalRole(req.Context(), tx, session.server.config.Roles.Mode, role)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(req.Context(), fmt.Sprintf("SET LOCAL statement_timeout TO %d", session.server.config.QueryTimeout*1000))
+	if err != nil {
+		return fmt.Errorf("could not set statement timeout: %w", err)
+	}
+
+	// Only queries can be run through a cursor
+	_, err = tx.Exec(req.Context(), "DECLARE "+sqlCursor+" NO SCROLL CURSOR FOR "+sql, body.Params...)
+	if err != nil {
+		return fmt.Errorf("could not execute SQL: %w", err)
+	}
+	rows, err := tx.Query(req.Context(), fmt.Sprintf("FETCH FORWARD %d FROM %s", maxRows+1, sqlCursor))
+	if err != nil {
+		return fmt.Errorf("could not execute SQL: %w", err)
+	}
+	capped := &cappedRows{Rows: rows, remaining: maxRows}
+	result, err := collectAndFixRows(capped, masker, "", "")
+	if err != nil {
+		return err
+	}
+	session.server.metrics.rowsReturned.add(float64(len(result)), "/ldp/db/sql")
+	audit.entry.RowCount = len(result)
+
+	if capped.truncated {
+		w.Header().Set("X-Result-Truncated", "true")
+	}
+	return sendJSON(w, result, "SQL result")
+}
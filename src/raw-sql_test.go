@@ -0,0 +1,191 @@
+package main
+
+import "fmt"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+func Test_singleStatement(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string // "" if an error is expected
+	}{
+		{name: "simple", sql: "SELECT 1", expected: "SELECT 1"},
+		{name: "trailing semicolon and comment", sql: "  SELECT 1 ;\n-- done\n ", expected: "SELECT 1"},
+		{name: "two statements", sql: "SELECT 1; SELECT 2"},
+		{name: "semicolon in literal", sql: "SELECT 'a;b'", expected: "SELECT 'a;b'"},
+		{name: "doubled quote in literal", sql: "SELECT 'it''s;'; ", expected: "SELECT 'it''s;'"},
+		{name: "escaped quote in E literal", sql: `SELECT E'\';' AS x`, expected: `SELECT E'\';' AS x`},
+		{name: "backslash in standard literal", sql: `SELECT '\'; DROP TABLE x`},
+		{name: "semicolon in identifier", sql: `SELECT 1 AS "a;b"`, expected: `SELECT 1 AS "a;b"`},
+		{name: "semicolon in line comment", sql: "SELECT 1 -- one; two\nFROM t", expected: "SELECT 1 -- one; two\nFROM t"},
+		{name: "semicolon in nested block comment", sql: "SELECT /* a /* b; */ c; */ 1", expected: "SELECT /* a /* b; */ c; */ 1"},
+		{name: "dollar quotes", sql: "SELECT $x$a;$$b$x$", expected: "SELECT $x$a;$$b$x$"},
+		{name: "parameter is not a dollar quote", sql: "SELECT $1; SELECT $2"},
+		{name: "block comment after semicolon", sql: "SELECT 1; /* and */", expected: "SELECT 1"},
+		{name: "literal after semicolon", sql: "SELECT 1;'x'"},
+		{name: "empty", sql: " ; "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statement, err := singleStatement(test.sql)
+			if test.expected != "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, statement)
+			} else {
+				status, code := classifyError(err)
+				assert.Equal(t, 422, status)
+				assert.Equal(t, errInvalidQuery, code)
+			}
+		})
+	}
+}
+
+func Test_handleSql(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name      string
+		body      string
+		fetch     int // How many rows are fetched from the cursor, if the SQL runs
+		expected  string
+		truncated string
+		errorstr  string
+	}{
+		{
+			name:     "all rows",
+			body:     `{ "sql": "SELECT name FROM folio_users.users WHERE active = $1;", "params": [ "true" ] }`,
+			fetch:    10001,
+			expected: `[{"name":"mike"},{"name":"fiona"},{"name":"jack"}]`,
+		},
+		{
+			name:      "capped",
+			body:      `{ "sql": "SELECT name FROM folio_users.users WHERE active = $1", "params": [ "true" ], "limit": 2 }`,
+			fetch:     3,
+			expected:  `[{"name":"mike"},{"name":"fiona"}]`,
+			truncated: "true",
+		},
+		{
+			name:     "cap not raised",
+			body:     `{ "sql": "SELECT name FROM folio_users.users WHERE active = $1", "params": [ "true" ], "limit": 2000000 }`,
+			fetch:    10001,
+			expected: `[{"name":"mike"},{"name":"fiona"},{"name":"jack"}]`,
+		},
+		{
+			name:     "several statements",
+			body:     `{ "sql": "SELECT 1; DELETE FROM folio_users.users" }`,
+			errorstr: "only a single SQL statement may be run",
+		},
+		{
+			name:     "bad JSON",
+			body:     `{ "sql": `,
+			errorstr: "could not deserialize JSON from body",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			if test.fetch > 0 {
+				mock.ExpectBegin()
+				mock.ExpectExec("SET TRANSACTION READ ONLY").WillReturnResult(pgxmock.NewResult("SET", 0))
+				mock.ExpectExec("SET LOCAL statement_timeout TO 60000").WillReturnResult(pgxmock.NewResult("SET", 0))
+				mock.ExpectExec(`^DECLARE mod_reporting_sql NO SCROLL CURSOR FOR SELECT name FROM folio_users.users WHERE active = \$1$`).
+					WithArgs("true").WillReturnResult(pgxmock.NewResult("DECLARE CURSOR", 0))
+				rows := pgxmock.NewRows([]string{"name"})
+				for i, name := range []string{"mike", "fiona", "jack"} {
+					if i < test.fetch {
+						rows.AddRow(name)
+					}
+				}
+				mock.ExpectQuery(fmt.Sprintf("^FETCH FORWARD %d FROM mod_reporting_sql$", test.fetch)).WillReturnRows(rows)
+				mock.ExpectRollback()
+			}
+			useMockDb(session, "", mock, true)
+
+			req := httptest.NewRequest("POST", "/ldp/db/sql", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			err := handleSql(w, req, session)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, w.Body.String())
+				assert.Equal(t, test.truncated, w.Header().Get("X-Result-Truncated"))
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_handleSqlNeedsRole(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.RawQuery, "table-access") {
+			_, _ = w.Write([]byte(`{
+			  "items": [{ "key": "table-access", "value": [{ "schema": "folio_users", "permission": "ldp.access.personal-data" }] }],
+			  "resultInfo": { "totalRecords": 1 }
+			}`))
+		} else {
+			_, _ = w.Write([]byte(`{ "items": [], "resultInfo": { "totalRecords": 0 } }`))
+		}
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+	body := `{ "sql": "SELECT 1 AS n" }`
+
+	t.Run("restricted caller without role", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		useMockDb(session, "", mock, true)
+		req := httptest.NewRequest("POST", "/ldp/db/sql", strings.NewReader(body))
+		req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+		err := handleSql(httptest.NewRecorder(), req, session)
+		status, code := classifyError(err)
+		assert.Equal(t, 403, status)
+		assert.Equal(t, errAccessDenied, code)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	expectRun := func(mock pgxmock.PgxPoolIface, role bool) {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET TRANSACTION READ ONLY").WillReturnResult(pgxmock.NewResult("SET", 0))
+		if role {
+			mock.ExpectExec(`SET LOCAL ROLE "reporting_mike"`).WillReturnResult(pgxmock.NewResult("SET", 0))
+		}
+		mock.ExpectExec("SET LOCAL statement_timeout").WillReturnResult(pgxmock.NewResult("SET", 0))
+		mock.ExpectExec("DECLARE mod_reporting_sql").WillReturnResult(pgxmock.NewResult("DECLARE CURSOR", 0))
+		mock.ExpectQuery("FETCH FORWARD").WillReturnRows(pgxmock.NewRows([]string{"n"}).AddRow(1))
+		mock.ExpectRollback()
+	}
+
+	t.Run("unrestricted caller without role", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		expectRun(mock, false)
+		useMockDb(session, "", mock, true)
+		req := httptest.NewRequest("POST", "/ldp/db/sql", strings.NewReader(body))
+		req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+		req.Header.Set("X-Okapi-Permissions", `["ldp.access.personal-data"]`)
+		assert.Nil(t, handleSql(httptest.NewRecorder(), req, session))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("restricted caller with role", func(t *testing.T) {
+		server.config.Roles = rolesConfig{Users: map[string]string{"mike": "reporting_mike"}}
+		defer func() { server.config.Roles = rolesConfig{} }()
+		mock := Must(pgxmock.NewPool())
+		expectRun(mock, true)
+		useMockDb(session, "", mock, true)
+		req := httptest.NewRequest("POST", "/ldp/db/sql", strings.NewReader(body))
+		req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+		assert.Nil(t, handleSql(httptest.NewRecorder(), req, session))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
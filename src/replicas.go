@@ -0,0 +1,216 @@
+// Route read queries to replica hosts, failing over to the primary
+package main
+
+import "fmt"
+import "sync"
+import "time"
+import "errors"
+import "strings"
+import "context"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+
+// How long to avoid a replica after a connection to it fails, and how
+// long to wait for it to answer a ping before using it again
+const replicaRetryInterval = 30 * time.Second
+const replicaPingTimeout = 2 * time.Second
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+// One of the hosts listed in a 'dbinfo' value
+type dbHost struct {
+	Host string `json:"host"` // host:port
+	Role string `json:"role"` // "primary" or "replica"
+}
+
+// The connection pool for a single host, or for several primary
+// hosts among which pgx chooses the one that accepts writes
+type hostPool struct {
+	host      string
+	role      string
+	dbConn    PgxIface
+	downUntil time.Time // Guarded by the replicaRouter's mutex
+}
+
+// A PgxIface that sends work to the first healthy replica, or to the
+// primary if none is available. A replica that cannot be reached is
+// avoided for replicaRetryInterval, then pinged before it is used again.
+type replicaRouter struct {
+	primary  *hostPool
+	replicas []*hostPool
+	log      func(cat string, args ...string)
+	mutex    sync.Mutex
+}
+
+// Returns the part of a 'dbinfo' URL that names the host and port
+func urlHost(dbUrl string) string {
+	dbUrl = strings.Replace(dbUrl, "jdbc:postgresql://", "", 1)
+	dbUrl = strings.Replace(dbUrl, "postgres://", "", 1)
+	i := strings.IndexAny(dbUrl, "/?")
+	if i < 0 {
+		return dbUrl
+	}
+	return dbUrl[:i]
+}
+
+// Replaces the host and port of a 'dbinfo' URL, and optionally adds
+// target_session_attrs so that pgx chooses among several hosts
+func hostUrl(dbUrl string, host string, targetSessionAttrs string) string {
+	dbUrl = strings.Replace(dbUrl, "jdbc:postgresql://", "", 1)
+	dbUrl = strings.Replace(dbUrl, "postgres://", "", 1)
+	rest := ""
+	i := strings.IndexAny(dbUrl, "/?")
+	if i >= 0 {
+		rest = dbUrl[i:]
+	}
+
+	newUrl := host + rest
+	if targetSessionAttrs != "" {
+		separator := "?"
+		if strings.Contains(rest, "?") {
+			separator = "&"
+		}
+		newUrl += separator + "target_session_attrs=" + targetSessionAttrs
+	}
+	return newUrl
+}
+
+// Returns the URL of the primary and the replica hosts. If there are
+// several primaries, they are combined into a single multi-host URL,
+// and pgx connects to whichever of them accepts writes.
+func splitHosts(dbUrl string, hosts []dbHost) (string, []string, error) {
+	primaries := []string{}
+	replicas := []string{}
+	for _, h := range hosts {
+		switch h.Role {
+		case rolePrimary:
+			primaries = append(primaries, h.Host)
+		case roleReplica:
+			replicas = append(replicas, h.Host)
+		default:
+			return "", nil, fmt.Errorf("host '%s' has role '%s': must be '%s' or '%s'", h.Host, h.Role, rolePrimary, roleReplica)
+		}
+	}
+	if len(primaries) == 0 {
+		return "", nil, errors.New("no host has the role 'primary'")
+	}
+
+	attrs := ""
+	if len(primaries) > 1 {
+		attrs = "read-write"
+	}
+	return hostUrl(dbUrl, strings.Join(primaries, ","), attrs), replicas, nil
+}
+
+// Connection failures, as opposed to errors in the SQL, are worth
+// retrying on another host
+func isConnectionError(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) || pgconn.SafeToRetry(err) {
+		return true
+	}
+	_, code := classifyError(err)
+	return code == errDatabaseUnavailable
+}
+
+func (rr *replicaRouter) markDown(hp *hostPool, err error) {
+	rr.mutex.Lock()
+	hp.downUntil = time.Now().Add(replicaRetryInterval)
+	rr.mutex.Unlock()
+	rr.log("db", fmt.Sprintf("replica %s is unavailable, using next host: %s", hp.host, err))
+}
+
+// Returns the hosts to try in order: healthy replicas, then the primary
+func (rr *replicaRouter) candidates(ctx context.Context) []*hostPool {
+	list := []*hostPool{}
+	for _, hp := range rr.replicas {
+		rr.mutex.Lock()
+		downUntil := hp.downUntil
+		rr.mutex.Unlock()
+		if time.Now().Before(downUntil) {
+			continue
+		}
+
+		if !downUntil.IsZero() {
+			// Check that the replica is back before sending it real work
+			pingCtx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+			err := hp.dbConn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				rr.markDown(hp, err)
+				continue
+			}
+			rr.mutex.Lock()
+			hp.downUntil = time.Time{}
+			rr.mutex.Unlock()
+			rr.log("db", "replica "+hp.host+" is available again")
+		}
+		list = append(list, hp)
+	}
+	return append(list, rr.primary)
+}
+
+// Runs op on each candidate host in turn until it succeeds or fails
+// for some reason other than a connection problem
+func (rr *replicaRouter) try(ctx context.Context, op func(dbConn PgxIface) error) error {
+	var err error
+	for _, hp := range rr.candidates(ctx) {
+		err = op(hp.dbConn)
+		if err == nil || hp == rr.primary || !isConnectionError(err) {
+			return err
+		}
+		rr.markDown(hp, err)
+	}
+	return err
+}
+
+func (rr *replicaRouter) Begin(ctx context.Context) (pgx.Tx, error) {
+	var tx pgx.Tx
+	err := rr.try(ctx, func(dbConn PgxIface) error {
+		var err error
+		tx, err = dbConn.Begin(ctx)
+		return err
+	})
+	return tx, err
+}
+
+func (rr *replicaRouter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := rr.try(ctx, func(dbConn PgxIface) error {
+		var err error
+		rows, err = dbConn.Query(ctx, sql, args...)
+		return err
+	})
+	return rows, err
+}
+
+// The error is not known until the row is scanned, so there is no failover
+func (rr *replicaRouter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return rr.candidates(ctx)[0].dbConn.QueryRow(ctx, sql, args...)
+}
+
+func (rr *replicaRouter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := rr.try(ctx, func(dbConn PgxIface) error {
+		var err error
+		tag, err = dbConn.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+func (rr *replicaRouter) Ping(ctx context.Context) error {
+	return rr.try(ctx, func(dbConn PgxIface) error {
+		return dbConn.Ping(ctx)
+	})
+}
+
+func (rr *replicaRouter) Close() {
+	for _, hp := range rr.replicas {
+		hp.dbConn.Close()
+	}
+	rr.primary.dbConn.Close()
+}
@@ -0,0 +1,159 @@
+package main
+
+import "time"
+import "context"
+import "testing"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func Test_hostUrl(t *testing.T) {
+	assert.Equal(t, "pg1:5432", urlHost("jdbc:postgresql://pg1:5432/metadb"))
+	assert.Equal(t, "pg1", urlHost("pg1"))
+	assert.Equal(t, "pg2:5433/metadb", hostUrl("postgres://pg1:5432/metadb", "pg2:5433", ""))
+	assert.Equal(t, "a,b/metadb?target_session_attrs=read-write", hostUrl("pg1/metadb", "a,b", "read-write"))
+	assert.Equal(t, "a,b/metadb?sslmode=require&target_session_attrs=read-write", hostUrl("pg1/metadb?sslmode=require", "a,b", "read-write"))
+}
+
+func Test_splitHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []dbHost
+		primary  string
+		replicas []string
+		errorstr string
+	}{
+		{name: "one primary", hosts: []dbHost{{"pg1:5432", "primary"}}, primary: "pg1:5432/metadb", replicas: []string{}},
+		{name: "primary and replicas",
+			hosts:    []dbHost{{"pg2:5432", "replica"}, {"pg1:5432", "primary"}, {"pg3:5432", "replica"}},
+			primary:  "pg1:5432/metadb",
+			replicas: []string{"pg2:5432", "pg3:5432"}},
+		{name: "several primaries",
+			hosts:    []dbHost{{"pg1:5432", "primary"}, {"pg2:5432", "primary"}},
+			primary:  "pg1:5432,pg2:5432/metadb?target_session_attrs=read-write",
+			replicas: []string{}},
+		{name: "no primary", hosts: []dbHost{{"pg2:5432", "replica"}}, errorstr: "no host has the role 'primary'"},
+		{name: "bad role", hosts: []dbHost{{"pg1:5432", "leader"}}, errorstr: "must be 'primary' or 'replica'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary, replicas, err := splitHosts("postgres://ignored:5432/metadb", test.hosts)
+			if test.errorstr != "" {
+				assert.ErrorContains(t, err, test.errorstr)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, test.primary, primary)
+				assert.Equal(t, test.replicas, replicas)
+			}
+		})
+	}
+}
+
+func Test_replicaRouter(t *testing.T) {
+	primary := Must(pgxmock.NewPool())
+	replica := Must(pgxmock.NewPool())
+	replicaPool := &hostPool{host: "pg2:5432", role: roleReplica, dbConn: replica}
+	rr := &replicaRouter{
+		primary:  &hostPool{host: "pg1:5432", role: rolePrimary, dbConn: primary},
+		replicas: []*hostPool{replicaPool},
+		log:      func(cat string, args ...string) {},
+	}
+	servedBy := func(mock pgxmock.PgxPoolIface, host string) {
+		mock.ExpectQuery("SELECT host").WillReturnRows(pgxmock.NewRows([]string{"host"}).AddRow(host))
+	}
+	query := func() string {
+		rows, err := rr.Query(context.Background(), "SELECT host")
+		assert.Nil(t, err)
+		hosts, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		assert.Nil(t, err)
+		return hosts[0]
+	}
+
+	t.Run("replica is used when available", func(t *testing.T) {
+		servedBy(replica, "replica")
+		assert.Equal(t, "replica", query())
+	})
+
+	t.Run("failover to primary", func(t *testing.T) {
+		replica.ExpectQuery("SELECT host").WillReturnError(&pgconn.PgError{Code: "08006", Message: "connection failure"})
+		servedBy(primary, "primary")
+		assert.Equal(t, "primary", query())
+		assert.True(t, replicaPool.downUntil.After(time.Now()))
+
+		// The replica is not tried again until the retry interval has passed
+		servedBy(primary, "primary")
+		assert.Equal(t, "primary", query())
+	})
+
+	t.Run("replica still down when rechecked", func(t *testing.T) {
+		replicaPool.downUntil = time.Now().Add(-time.Second)
+		replica.ExpectPing().WillReturnError(&pgconn.PgError{Code: "57P03", Message: "the database system is starting up"})
+		servedBy(primary, "primary")
+		assert.Equal(t, "primary", query())
+	})
+
+	t.Run("replica back when rechecked", func(t *testing.T) {
+		replicaPool.downUntil = time.Now().Add(-time.Second)
+		replica.ExpectPing()
+		servedBy(replica, "replica")
+		assert.Equal(t, "replica", query())
+		assert.True(t, replicaPool.downUntil.IsZero())
+	})
+
+	t.Run("SQL errors are not retried", func(t *testing.T) {
+		replica.ExpectQuery("SELECT host").WillReturnError(&pgconn.PgError{Code: "42601", Message: "syntax error"})
+		_, err := rr.Query(context.Background(), "SELECT host")
+		assert.ErrorContains(t, err, "syntax error")
+		assert.True(t, replicaPool.downUntil.IsZero())
+	})
+
+	assert.Nil(t, primary.ExpectationsWereMet())
+	assert.Nil(t, replica.ExpectationsWereMet())
+}
+
+func Test_makeDbConnWithReplicas(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	realOpen := openReportingDb
+	defer func() { openReportingDb = realOpen }()
+	opened := map[string]pgxmock.PgxPoolIface{}
+	openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+		mock := Must(pgxmock.NewPool())
+		opened[dbUrl] = mock
+		if len(opened) == 1 {
+			mock.ExpectQuery("SELECT 1 FROM pg_class").WillReturnError(pgx.ErrNoRows)
+		}
+		return mock, nil
+	}
+
+	db, err := session.findDbConn("replicated", "")
+	assert.Nil(t, err)
+	assert.Len(t, opened, 2)
+	primary := opened["pg1:5432,pg2:5432/metadb?target_session_attrs=read-write"]
+	replica := opened["pg3:5432/metadb"]
+	assert.NotNil(t, primary)
+	assert.NotNil(t, replica)
+	assert.True(t, db.isMDB)
+
+	assert.Equal(t, primary, db.dbConn, "metadata should be pinned to the primary by default")
+	assert.Equal(t, primary, db.primaryDbConn())
+	router, ok := db.queryDbConn().(*replicaRouter)
+	assert.True(t, ok)
+	assert.Equal(t, replica, router.replicas[0].dbConn)
+	hosts := []string{}
+	for _, hp := range db.hostPools() {
+		hosts = append(hosts, hp.role+" "+hp.host)
+	}
+	assert.Equal(t, []string{"primary pg1:5432,pg2:5432", "replica pg3:5432"}, hosts)
+
+	primary.ExpectClose()
+	replica.ExpectClose()
+	session.closeDbConn()
+	assert.Nil(t, primary.ExpectationsWereMet())
+	assert.Nil(t, replica.ExpectationsWereMet())
+}
@@ -12,11 +12,11 @@ import "encoding/json"
 import "github.com/jackc/pgx/v5"
 
 // Determine whether this is a MetaDB database, as opposed to LDP Classic
-func isMetaDB(dbConn PgxIface) (bool, error) {
+func isMetaDB(ctx context.Context, dbConn PgxIface) (bool, error) {
 	var val int
 	magicQuery := "SELECT 1 FROM pg_class c JOIN pg_namespace n ON c.relnamespace=n.oid " +
 		"WHERE n.nspname='dbsystem' AND c.relname='main';"
-	err := dbConn.QueryRow(context.Background(), magicQuery).Scan(&val)
+	err := dbConn.QueryRow(ctx, magicQuery).Scan(&val)
 	if err != nil && strings.Contains(err.Error(), "no rows") {
 		// Weirdly, metadb.base_table does not exist on MetaDB
 		return true, nil
@@ -41,19 +41,23 @@ type dbColumn struct {
 }
 
 func handleTables(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
-	tables, err := fetchTables(dbConn, session.isMDB)
+	tables, err := fetchTables(req.Context(), db.dbConn, db.isMDB)
 	if err != nil {
 		return fmt.Errorf("could not fetch tables from reporting DB: %w", err)
 	}
+	access, err := fetchTableAccess(req, session)
+	if err != nil {
+		return err
+	}
 
-	return sendJSON(w, tables, "tables")
+	return sendJSON(w, access.filter(tables), "tables")
 }
 
-func fetchTables(dbConn PgxIface, isMetaDB bool) ([]dbTable, error) {
+func fetchTables(ctx context.Context, dbConn PgxIface, isMetaDB bool) ([]dbTable, error) {
 	var query string
 	if isMetaDB {
 		query = `SELECT schema_name, table_name FROM metadb.base_table
@@ -67,7 +71,7 @@ func fetchTables(dbConn PgxIface, isMetaDB bool) ([]dbTable, error) {
 		query = "SELECT table_name, table_schema as schema_name FROM information_schema.tables WHERE table_schema IN ('local', 'public', 'folio_reporting')"
 	}
 
-	rows, err := dbConn.Query(context.Background(), query)
+	rows, err := dbConn.Query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
 	}
@@ -84,10 +88,22 @@ func handleColumns(w http.ResponseWriter, req *http.Request, session *ModReporti
 	schema := v.Get("schema")
 	table := v.Get("table")
 	if schema == "" || table == "" {
-		return fmt.Errorf("must specify both schema and table")
+		return newHTTPErrorf(http.StatusBadRequest, errMissingParameter, "must specify both schema and table")
+	}
+	access, err := fetchTableAccess(req, session)
+	if err != nil {
+		return err
+	}
+	err = access.check(schema, table)
+	if err != nil {
+		return err
 	}
 
-	columns, err := getColumnsByParams(session, schema, table, req.Header.Get("X-Okapi-Token"))
+	dbName, err := requestedDbName(req)
+	if err != nil {
+		return err
+	}
+	columns, err := getColumnsByParams(req.Context(), session, dbName, schema, table, req.Header.Get("X-Okapi-Token"))
 	if err != nil {
 		return err
 	}
@@ -95,19 +111,22 @@ func handleColumns(w http.ResponseWriter, req *http.Request, session *ModReporti
 	return sendJSON(w, columns, "columns")
 }
 
-// Given a session, schema name and table name, returns the set of
-// columns, either from cache or from the database. In the later case,
-// the token is used, if needed, to find the information FOLIO has
-// about the reporting database.
-func getColumnsByParams(session *ModReportingSession, schema string, table string, token string) ([]dbColumn, error) {
-	key := session.key() + ":" + schema + ":" + table
+// Given a session, database name, schema name and table name,
+// returns the set of columns, either from cache or from the
+// database. In the later case, the token is used, if needed, to find
+// the information FOLIO has about the reporting database.
+func getColumnsByParams(ctx context.Context, session *ModReportingSession, dbName string, schema string, table string, token string) ([]dbColumn, error) {
+	key := session.key() + ":" + dbName + ":" + schema + ":" + table
 	columns := session2columns[key]
-	if columns == nil {
-		dbConn, err := session.findDbConn(token)
+	if columns != nil {
+		session.server.metrics.schemaCache.inc("hit")
+	} else {
+		session.server.metrics.schemaCache.inc("miss")
+		db, err := session.findDbConn(dbName, token)
 		if err != nil {
 			return nil, fmt.Errorf("could not find reporting DB: %w", err)
 		}
-		columns, err = fetchColumns(dbConn, schema, table)
+		columns, err = fetchColumns(ctx, db.dbConn, schema, table)
 		if err != nil {
 			return nil, fmt.Errorf("could not fetch columns from reporting DB: %w", err)
 		}
@@ -118,12 +137,12 @@ func getColumnsByParams(session *ModReportingSession, schema string, table strin
 	return columns, nil
 }
 
-func fetchColumns(dbConn PgxIface, schema string, table string) ([]dbColumn, error) {
+func fetchColumns(ctx context.Context, dbConn PgxIface, schema string, table string) ([]dbColumn, error) {
 	// This seems to work for both MetaDB and LDP Classic
 	cols := "column_name, data_type, ordinal_position, table_schema, table_name"
 	query := "SELECT " + cols + " FROM information_schema.columns " +
 		"WHERE table_schema = $1 AND table_name = $2 AND column_name != $3"
-	rows, err := dbConn.Query(context.Background(), query, schema, table, "data")
+	rows, err := dbConn.Query(ctx, query, schema, table, "data")
 	if err != nil {
 		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
 	}
@@ -163,56 +182,109 @@ type jsonQuery struct {
 	Tables []queryTable `json:"tables"`
 }
 
-func handleQuery(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+func handleQuery(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/query")
+	defer func() { audit.finish(err) }()
+
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
+	audit.setDatabase(db.name)
 
-	bytes, err := io.ReadAll(req.Body)
+	policy, err := fetchQueryPolicy(req, session)
 	if err != nil {
-		return fmt.Errorf("could not read HTTP request body: %w", err)
+		return err
 	}
-	var query jsonQuery
-	dec := json.NewDecoder(bytesLib.NewReader(bytes))
-	dec.UseNumber()
-	err = dec.Decode(&query)
+	query, sql, params, err := session.prepareQuery(req, db, audit, policy)
 	if err != nil {
-		return fmt.Errorf("could not deserialize JSON from body: %w", err)
+		return err
 	}
 
-	sql, params, err := makeSql(query, session, req.Header.Get("X-Okapi-Token"))
+	schema, table := query.Tables[0].Schema, query.Tables[0].Table
+	lookup, sent := session.lookupCachedResult(w, req, db, audit, schema, table,
+		"query", session.requestRole(req), policy.masker.fingerprint(), sql, params)
+	if sent {
+		return nil
+	}
+	err = session.guardQueryCost(req, db, policy.limits, sql, params)
 	if err != nil {
-		return fmt.Errorf("could not generate SQL from JSON query: %w", err)
+		return err
 	}
-
-	session.Log("sql", sql, fmt.Sprintf("%v", params))
-	rows, err := dbConn.Query(context.Background(), sql, params...)
+	rows, done, err := session.queryAsUser(req, db.queryDbConn(), sql, params...)
 	if err != nil {
 		return fmt.Errorf("could not execute SQL from JSON query: %w", err)
 	}
+	defer done()
 
-	result, err := collectAndFixRows(rows)
+	result, err := collectAndFixRows(rows, policy.masker, schema, table)
 	if err != nil {
 		return err
 	}
+	session.server.metrics.rowsReturned.add(float64(len(result)), "/ldp/db/query")
+	audit.entry.RowCount = len(result)
+
+	body, err := encodeJSON(result, "query result")
+	if err != nil {
+		return err
+	}
+	lookup.store(body, len(result))
+	writeJSON(w, body)
+	return nil
+}
+
+// Reads a JSON query from the request body and generates its SQL,
+// checking that the policy lets the caller read the table and does not
+// hide the columns on which it filters or sorts
+func (session *ModReportingSession) prepareQuery(req *http.Request, db *reportingDb, audit *auditRecord, policy *queryPolicy) (jsonQuery, string, []any, error) {
+	var query jsonQuery
+	bytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return query, "", nil, fmt.Errorf("could not read HTTP request body: %w", err)
+	}
+	dec := json.NewDecoder(bytesLib.NewReader(bytes))
+	dec.UseNumber()
+	err = dec.Decode(&query)
+	if err != nil {
+		return query, "", nil, newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
+	}
 
-	return sendJSON(w, result, "query result")
+	sql, params, err := makeSql(req.Context(), query, session, db.name, policy.access, policy.masker, req.Header.Get("X-Okapi-Token"))
+	if err != nil {
+		return query, "", nil, fmt.Errorf("could not generate SQL from JSON query: %w", err)
+	}
+
+	session.LogReq(req, "sql", sql, fmt.Sprintf("%v", params))
+	audit.setSql(sql, true)
+	audit.setParams(params)
+	return query, sql, params, nil
 }
 
-func makeSql(query jsonQuery, session *ModReportingSession, token string) (string, []any, error) {
+func makeSql(ctx context.Context, query jsonQuery, session *ModReportingSession, dbName string, access *tableAccess, masker *columnMasker, token string) (string, []any, error) {
 	if len(query.Tables) != 1 {
-		return "", nil, fmt.Errorf("query must have exactly one table")
+		return "", nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "query must have exactly one table")
 	}
 	qt := query.Tables[0]
+	err := access.check(qt.Schema, qt.Table)
+	if err != nil {
+		return "", nil, err
+	}
+	err = checkUnmaskedKeys(qt, masker)
+	if err != nil {
+		return "", nil, err
+	}
 
-	sql := "SELECT " + makeColumns(qt.Columns) + ` FROM "` + qt.Schema + `"."` + qt.Table + `"`
-
-	columns, err := getColumnsByParams(session, qt.Schema, qt.Table, token)
+	columns, err := getColumnsByParams(ctx, session, dbName, qt.Schema, qt.Table, token)
 	if err != nil {
 		return "", nil, fmt.Errorf("could not obtain columns for %s.%s: %w", qt.Schema, qt.Table, err)
 	}
 
+	columnString, err := makeColumns(qt.Columns, columns)
+	if err != nil {
+		return "", nil, err
+	}
+	sql := "SELECT " + columnString + " FROM " + pgx.Identifier{qt.Schema, qt.Table}.Sanitize()
+
 	filterString, params, err := makeCond(qt.Filters, columns)
 	if err != nil {
 		return "", nil, fmt.Errorf("could not construct condition: %w", err)
@@ -220,7 +292,10 @@ func makeSql(query jsonQuery, session *ModReportingSession, token string) (strin
 	if filterString != "" {
 		sql += " WHERE " + filterString
 	}
-	orderString := makeOrder(qt.Order)
+	orderString, err := makeOrder(qt.Order, columns)
+	if err != nil {
+		return "", nil, err
+	}
 	if orderString != "" {
 		sql += " ORDER BY " + orderString
 	}
@@ -234,57 +309,92 @@ func makeSql(query jsonQuery, session *ModReportingSession, token string) (strin
 	return sql, params, nil
 }
 
-func makeColumns(cols []string) string {
+// Masking applies only to result values, so filtering or sorting on a
+// masked column would let the caller discover the values by probing
+// them, as with "LIKE 'a%'", or by their order. Such queries are refused.
+func checkUnmaskedKeys(qt queryTable, masker *columnMasker) error {
+	for _, filter := range qt.Filters {
+		if filter.Key != "" && masker.modeFor(qt.Schema, qt.Table, filter.Key) != "" {
+			return newHTTPErrorf(http.StatusForbidden, errAccessDenied, "cannot filter on masked column %q", filter.Key)
+		}
+	}
+	for _, order := range qt.Order {
+		if order.Key != "" && masker.modeFor(qt.Schema, qt.Table, order.Key) != "" {
+			return newHTTPErrorf(http.StatusForbidden, errAccessDenied, "cannot sort by masked column %q", order.Key)
+		}
+	}
+	return nil
+}
+
+// Operators that may be used in filters, and directions in which
+// results may be sorted. Anything else is refused, since it would be
+// pasted into the SQL.
+var filterOperators = []string{"=", "<>", "!=", "<", "<=", ">", ">=", "LIKE", "ILIKE", "NOT LIKE", "NOT ILIKE"}
+var orderDirections = []string{"asc", "desc"}
+
+// Returns the column of the table with the specified name, or nil if
+// there is none. Only columns found in this way may appear in the
+// generated SQL, so that a JSON query cannot smuggle in expressions
+// that read other tables.
+func findColumn(columns []dbColumn, name string) *dbColumn {
+	for i := range columns {
+		if columns[i].ColumnName == name {
+			return &columns[i]
+		}
+	}
+	return nil
+}
+
+func makeColumns(cols []string, columns []dbColumn) (string, error) {
 	if len(cols) == 0 {
-		return "*"
+		return "*", nil
 	}
 
 	s := ""
 	for i, col := range cols {
-		s += col
+		if findColumn(columns, col) == nil {
+			return "", newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "cannot show %q: not a column of the table", col)
+		}
+		s += pgx.Identifier{col}.Sanitize()
 		if i < len(cols)-1 {
 			s += ", "
 		}
 	}
 
-	return s
+	return s, nil
 }
 
 func makeCond(filters []queryFilter, columns []dbColumn) (string, []any, error) {
 	params := make([]any, 0)
 
 	s := ""
-	for i, filter := range filters {
+	for _, filter := range filters {
 		if filter.Key == "" {
 			continue
 		}
-		if s != "" {
-			s += " AND "
-		}
-		s += filter.Key
-		if filter.Op == "" {
-			s += " = "
-		} else {
-			s += " " + filter.Op + " "
-		}
-		s += fmt.Sprintf("$%d", i+1)
 
-		var column dbColumn
-		for _, col := range columns {
-			if col.ColumnName == filter.Key {
-				column = col
-			}
+		column := findColumn(columns, filter.Key)
+		if column == nil {
+			return "", nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "filter on invalid column %s", filter.Key)
 		}
-		if column == (dbColumn{}) {
-			return "", nil, fmt.Errorf("filter on invalid column %s", filter.Key)
+		op := "="
+		if filter.Op != "" {
+			op = strings.ToUpper(filter.Op)
+			if !containsString(filterOperators, op) {
+				return "", nil, newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "invalid operator %q for field %s", filter.Op, filter.Key)
+			}
 		}
 
-		err := validateValue(filter.Value, column)
+		err := validateValue(filter.Value, *column)
 		if err != nil {
-			return "", nil, fmt.Errorf("invalid value for field %s (%v): %w", filter.Key, filter.Value, err)
+			return "", nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "invalid value for field %s (%v): %w", filter.Key, filter.Value, err)
 		}
 
+		if s != "" {
+			s += " AND "
+		}
 		params = append(params, filter.Value)
+		s += fmt.Sprintf("%s %s $%d", pgx.Identifier{filter.Key}.Sanitize(), op, len(params))
 	}
 
 	return s, params, nil
@@ -303,17 +413,26 @@ func validateValue(value string, column dbColumn) error {
 	return nil
 }
 
-func makeOrder(orders []queryOrder) string {
+func makeOrder(orders []queryOrder, columns []dbColumn) (string, error) {
 	s := ""
 	for _, order := range orders {
 		if order.Key == "" {
 			continue
 		}
+		if findColumn(columns, order.Key) == nil {
+			return "", newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "cannot sort by %q: not a column of the table", order.Key)
+		}
 		if s != "" {
 			s += ", "
 		}
-		s += order.Key
-		s += " " + order.Direction
+		s += pgx.Identifier{order.Key}.Sanitize()
+		if order.Direction != "" {
+			direction := strings.ToLower(order.Direction)
+			if !containsString(orderDirections, direction) {
+				return "", newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "invalid sort direction %q for field %s", order.Direction, order.Key)
+			}
+			s += " " + direction
+		}
 		// Historically, ui-ldp sends "start" or "end"
 		// But we also want to support PostgreSQL's own "FIRST" and "LAST"
 		if strings.EqualFold(order.Nulls, "first") ||
@@ -324,7 +443,7 @@ func makeOrder(orders []queryOrder) string {
 		}
 	}
 
-	return s
+	return s, nil
 }
 
 type reportQuery struct {
@@ -338,100 +457,182 @@ type reportResponse struct {
 	Records      []OrderedMap `json:"records"`
 }
 
-func handleReport(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+func handleReport(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/reports")
+	defer func() { audit.finish(err) }()
+
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
+	audit.setDatabase(db.name)
+
+	report, err := session.prepareReport(req, db, audit)
+	if err != nil {
+		return err
+	}
+	masker, err := fetchColumnMasker(req, session)
+	if err != nil {
+		return err
+	}
+
+	// Report SQL may read any table, so any update makes cached results stale
+	lookup, sent := session.lookupCachedResult(w, req, db, audit, "", "",
+		"report", session.requestRole(req), masker.fingerprint(), report.sql, report.cmd, report.params)
+	if sent {
+		return nil
+	}
+
+	start := time.Now()
+	tx, err := session.beginReport(req, db, report.sql)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Explicitly discard return value so golangci-lint understands the intent
+		_ = tx.Rollback(context.Background())
+	}()
+
+	rows, err := tx.Query(req.Context(), report.cmd, report.params...)
+	if err != nil {
+		return fmt.Errorf("could not execute SQL from report: %w", err)
+	}
+
+	result, err := collectAndFixRows(rows, masker, "", "")
+	if err != nil {
+		return err
+	}
+	session.server.metrics.reportDuration.observe(time.Since(start).Seconds(),
+		reportRepoLabel(session.server.config.ReportUrlWhitelist, report.query.Url))
+	session.server.metrics.rowsReturned.add(float64(len(result)), "/ldp/db/reports")
+	audit.entry.RowCount = len(result)
+
+	count := len(result) // This is redundant, but it's in the old API so we retain it here
+	response := reportResponse{
+		TotalRecords: count,
+		Records:      result,
+	}
+
+	body, err := encodeJSON(response, "report result")
+	if err != nil {
+		return err
+	}
+	lookup.store(body, len(result))
+	writeJSON(w, body)
+	return nil
+}
+
+type preparedReport struct {
+	query  reportQuery
+	sql    string // The report's own SQL, which defines a function
+	cmd    string // The call of that function
+	params []any
+}
 
+// Reads a report request from the body, fetches the report's SQL
+// and constructs the call of the function it defines
+func (session *ModReportingSession) prepareReport(req *http.Request, db *reportingDb, audit *auditRecord) (*preparedReport, error) {
 	bytes, err := io.ReadAll(req.Body)
 	if err != nil {
-		return fmt.Errorf("could not read HTTP request body: %w", err)
+		return nil, fmt.Errorf("could not read HTTP request body: %w", err)
 	}
 	var query reportQuery
 	dec := json.NewDecoder(bytesLib.NewReader(bytes))
 	dec.UseNumber()
 	err = dec.Decode(&query)
 	if err != nil {
-		return fmt.Errorf("could not deserialize JSON from body: %w", err)
+		return nil, newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
 	}
 	limit64, _ := query.Limit.Int64()
 	limit := int(limit64)
+	audit.entry.ReportUrl = query.Url
+	audit.setParams(query.Params)
 
 	err = validateUrl(session, query.Url)
 	if err != nil {
-		return fmt.Errorf("query may not be loaded from %s: %w", query.Url, err)
+		return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errReportUrlRejected, "query may not be loaded from %s: %w", query.Url, err)
 	}
 
+	repo := reportRepoLabel(session.server.config.ReportUrlWhitelist, query.Url)
 	resp, err := http.Get(query.Url)
 	if err != nil {
-		return fmt.Errorf("could not fetch report from %s: %w", query.Url, err)
+		session.server.metrics.reportFetchFailures.inc(repo)
+		return nil, fmt.Errorf("could not fetch report from %s: %w", query.Url, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("could not fetch report from %s: %s", query.Url, resp.Status)
+		session.server.metrics.reportFetchFailures.inc(repo)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, newHTTPErrorf(http.StatusNotFound, errReportNotFound, "could not fetch report from %s: %s", query.Url, resp.Status)
+		}
+		return nil, fmt.Errorf("could not fetch report from %s: %s", query.Url, resp.Status)
 	}
 
 	bytes, err = io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("could not read report: %w", err)
+		session.server.metrics.reportFetchFailures.inc(repo)
+		return nil, fmt.Errorf("could not read report: %w", err)
 	}
 	sql := string(bytes)
+	audit.setSql(sql, false)
 
-	if session.isMDB && strings.HasPrefix(sql, "--ldp:function") {
-		return fmt.Errorf("cannot run LDP Classic report in MetaDB")
-	} else if !session.isMDB && strings.HasPrefix(sql, "--metadb:function") {
-		return fmt.Errorf("cannot run MetaDB report in LDP Classic")
+	if db.isMDB && strings.HasPrefix(sql, "--ldp:function") {
+		return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errWrongDatabaseType, "cannot run LDP Classic report in MetaDB")
+	} else if !db.isMDB && strings.HasPrefix(sql, "--metadb:function") {
+		return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errWrongDatabaseType, "cannot run MetaDB report in LDP Classic")
 	}
 
-	if !session.isMDB {
+	if !db.isMDB {
 		// LDP Classic needs this, for some reason
 		sql = "SET search_path = local, public;\n" + sql
 	}
 
 	cmd, params, err := makeFunctionCall(sql, query.Params, limit)
 	if err != nil {
-		return fmt.Errorf("could not construct SQL function call: %w", err)
+		return nil, fmt.Errorf("could not construct SQL function call: %w", err)
 	}
-	session.Log("sql", cmd, fmt.Sprintf("%v", params))
+	session.LogReq(req, "sql", cmd, fmt.Sprintf("%v", params))
+	return &preparedReport{query: query, sql: sql, cmd: cmd, params: params}, nil
+}
 
-	tx, err := dbConn.Begin(context.Background())
+// Opens a transaction on the primary in which the report's function
+// is registered, ready to be called. The caller must roll it back.
+func (session *ModReportingSession) beginReport(req *http.Request, db *reportingDb, sql string) (pgx.Tx, error) {
+	tx, err := db.primaryDbConn().Begin(req.Context())
 	if err != nil {
-		return fmt.Errorf("could not open transaction: %w", err)
+		return nil, fmt.Errorf("could not open transaction: %w", err)
 	}
-	defer func() {
-		// Explicitly discard return value so golangci-lint understands the intent
-		_ = tx.Rollback(context.Background())
-	}()
-
-	_, err = tx.Exec(context.Background(), sql)
+	err = session.setUpReport(req, tx, sql)
 	if err != nil {
-		return fmt.Errorf("could not register SQL function: %w", err)
+		_ = tx.Rollback(context.Background())
+		return nil, err
 	}
+	return tx, nil
+}
 
-	setLimitString := fmt.Sprintf("SET statement_timeout TO %d", session.server.config.QueryTimeout*1000)
-	_, err = tx.Exec(context.Background(), setLimitString)
+func (session *ModReportingSession) setUpReport(req *http.Request, tx pgx.Tx, sql string) error {
+	_, err := tx.Exec(req.Context(), sql)
 	if err != nil {
-		return fmt.Errorf("could not set statement timeout: %w", err)
+		return fmt.Errorf("could not register SQL function: %w", err)
 	}
 
-	rows, err := tx.Query(context.Background(), cmd, params...)
-	if err != nil {
-		return fmt.Errorf("could not execute SQL from report: %w", err)
+	// The function is registered as the 'dbinfo' user, but runs as the
+	// requesting user's role, so that role's grants apply to the data
+	role := session.requestRole(req)
+	if role != "" {
+		session.LogReq(req, "db", "running as role", role)
+		err = setLocalRole(req.Context(), tx, session.server.config.Roles.Mode, role)
+		if err != nil {
+			return err
+		}
 	}
 
-	result, err := collectAndFixRows(rows)
+	setLimitString := fmt.Sprintf("SET statement_timeout TO %d", session.server.config.QueryTimeout*1000)
+	_, err = tx.Exec(req.Context(), setLimitString)
 	if err != nil {
-		return err
-	}
-
-	count := len(result) // This is redundant, but it's in the old API so we retain it here
-	response := reportResponse{
-		TotalRecords: count,
-		Records:      result,
+		return fmt.Errorf("could not set statement timeout: %w", err)
 	}
-
-	return sendJSON(w, response, "report result")
+	return nil
 }
 
 type dbLogEntry struct {
@@ -441,16 +642,16 @@ type dbLogEntry struct {
 }
 
 func handleLogs(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
 
-	if !session.isMDB {
-		return &HTTPError{http.StatusNotImplemented, "Implemented only for MetaDB, not LDP"}
+	if !db.isMDB {
+		return newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "Implemented only for MetaDB, not LDP")
 	}
 
-	rows, err := dbConn.Query(context.Background(), "SELECT log_time, error_severity, message FROM metadb.log")
+	rows, err := db.dbConn.Query(req.Context(), "SELECT log_time, error_severity, message FROM metadb.log")
 	if err != nil {
 		return fmt.Errorf("could not fetch logs from reporting DB: %w", err)
 	}
@@ -474,16 +675,16 @@ type dbVersionForJson struct {
 }
 
 func handleVersion(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
 
-	if !session.isMDB {
-		return &HTTPError{http.StatusNotImplemented, "Implemented only for MetaDB, not LDP"}
+	if !db.isMDB {
+		return newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "Implemented only for MetaDB, not LDP")
 	}
 
-	rows, err := dbConn.Query(context.Background(), "SELECT mdbversion()")
+	rows, err := db.dbConn.Query(req.Context(), "SELECT mdbversion()")
 	if err != nil {
 		return fmt.Errorf("could not fetch version from reporting DB: %w", err)
 	}
@@ -508,16 +709,16 @@ type dbUpdate struct {
 }
 
 func handleUpdates(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
 
-	if !session.isMDB {
-		return &HTTPError{http.StatusNotImplemented, "Implemented only for MetaDB, not LDP"}
+	if !db.isMDB {
+		return newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "Implemented only for MetaDB, not LDP")
 	}
 
-	rows, err := dbConn.Query(context.Background(), "SELECT schema_name, table_name, last_update, elapsed_real_time FROM metadb.table_update ORDER BY elapsed_real_time DESC")
+	rows, err := db.dbConn.Query(req.Context(), "SELECT schema_name, table_name, last_update, elapsed_real_time FROM metadb.table_update ORDER BY elapsed_real_time DESC")
 	if err != nil {
 		return fmt.Errorf("could not fetch updates from reporting DB: %w", err)
 	}
@@ -540,16 +741,16 @@ type dbProcesses struct {
 }
 
 func handleProcesses(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, err := session.findRequestedDb(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
 
-	if !session.isMDB {
-		return &HTTPError{http.StatusNotImplemented, "Implemented only for MetaDB, not LDP"}
+	if !db.isMDB {
+		return newHTTPErrorf(http.StatusNotImplemented, errNotImplemented, "Implemented only for MetaDB, not LDP")
 	}
 
-	rows, err := dbConn.Query(context.Background(), "SELECT dbname, username, state, realtime, query FROM ps() ORDER BY realtime DESC")
+	rows, err := db.dbConn.Query(req.Context(), "SELECT dbname, username, state, realtime, query FROM ps() ORDER BY realtime DESC")
 	if err != nil {
 		return fmt.Errorf("could not fetch processes from reporting DB: %w", err)
 	}
@@ -593,7 +794,7 @@ func makeFunctionCall(sql string, params map[string]string, limit int) (string,
 	re := regexp.MustCompile(`--.+:function\s+(.+)`)
 	m := re.FindStringSubmatch(sql)
 	if m == nil {
-		return "", nil, fmt.Errorf("could not extract SQL function name")
+		return "", nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidReport, "could not extract SQL function name")
 	}
 
 	s := make([]string, 0, len(params))
@@ -612,7 +813,10 @@ func makeFunctionCall(sql string, params map[string]string, limit int) (string,
 	return cmd, orderedParams, nil
 }
 
-func collectAndFixRows(rows pgx.Rows) ([]OrderedMap, error) {
+// Masks columns of the named table as the masker requires. For
+// report results, whose source tables are unknown, schema and table
+// are both "".
+func collectAndFixRows(rows pgx.Rows, masker *columnMasker, schema string, table string) ([]OrderedMap, error) {
 	records, err := pgx.CollectRows(rows, pgx.RowToMap)
 	// fmt.Printf("rows: %+v\n", rows.FieldDescriptions())
 	if err != nil {
@@ -620,8 +824,13 @@ func collectAndFixRows(rows pgx.Rows) ([]OrderedMap, error) {
 	}
 	fd := rows.FieldDescriptions()
 	fieldOrder := make([]string, len(fd))
+	masks := map[string]string{}
 	for i, entry := range fd {
 		fieldOrder[i] = entry.Name
+		mode := masker.modeFor(schema, table, entry.Name)
+		if mode != "" {
+			masks[entry.Name] = mode
+		}
 	}
 
 	// Fix up types and translate into ordered maps
@@ -635,6 +844,10 @@ func collectAndFixRows(rows pgx.Rows) ([]OrderedMap, error) {
 			default:
 				// Nothing to do
 			}
+			mode, ok := masks[key]
+			if ok {
+				rec[key] = masker.mask(mode, rec[key])
+			}
 		}
 
 		result[i] = MapToOrderedMap(rec, fieldOrder)
@@ -644,14 +857,26 @@ func collectAndFixRows(rows pgx.Rows) ([]OrderedMap, error) {
 }
 
 func sendJSON(w http.ResponseWriter, data any, caption string) error {
+	bytes, err := encodeJSON(data, caption)
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, bytes)
+	return nil
+}
+
+func encodeJSON(data any, caption string) ([]byte, error) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("could not encode JSON for %s: %w", caption, err)
+		return nil, fmt.Errorf("could not encode JSON for %s: %w", caption, err)
 	}
+	return bytes, nil
+}
 
+func writeJSON(w http.ResponseWriter, bytes []byte) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// If w.write fails there is no way to report this to the client: see MODREP-37.
 	_, _ = w.Write(bytes)
-	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import "io"
+import "context"
 import "strings"
 import "fmt"
 import "testing"
@@ -31,8 +32,8 @@ func Test_makeSql(t *testing.T) {
 		{
 			name: "query with columns",
 			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
-				 "showColumns": ["id", "username"] }] }`,
-			expected:     `SELECT id, username FROM "folio_users"."users"`,
+				 "showColumns": ["id", "user"] }] }`,
+			expected:     `SELECT "id", "user" FROM "folio_users"."users"`,
 			expectedArgs: []string{},
 		},
 		{
@@ -48,7 +49,7 @@ func Test_makeSql(t *testing.T) {
 				"columnFilters": [
 					{ "key": "id", "value": "` + uuid + `" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" WHERE id = $1`,
+			expected:     `SELECT * FROM "folio_users"."users" WHERE "id" = $1`,
 			expectedArgs: []string{uuid},
 		},
 		{
@@ -74,7 +75,7 @@ func Test_makeSql(t *testing.T) {
 					{ "key": "id", "op": "<>", "value": "` + uuid + `" },
 					{ "key": "creation_date", "op": ">", "value": "1968-03-12" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" WHERE id <> $1 AND creation_date > $2`,
+			expected:     `SELECT * FROM "folio_users"."users" WHERE "id" <> $1 AND "creation_date" > $2`,
 			expectedArgs: []string{uuid, "1968-03-12"},
 		},
 		{
@@ -84,7 +85,7 @@ func Test_makeSql(t *testing.T) {
 					{},
 					{ "key": "user", "op": "LIKE", "value": "mi%" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" WHERE user LIKE $2`,
+			expected:     `SELECT * FROM "folio_users"."users" WHERE "user" LIKE $1`,
 			expectedArgs: []string{"mi%"},
 		},
 		{
@@ -94,7 +95,7 @@ func Test_makeSql(t *testing.T) {
 					{ "key": "user", "direction": "asc", "nulls": "start" },
 					{ "key": "id", "direction": "desc", "nulls": "end" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" ORDER BY user asc NULLS FIRST, id desc NULLS LAST`,
+			expected:     `SELECT * FROM "folio_users"."users" ORDER BY "user" asc NULLS FIRST, "id" desc NULLS LAST`,
 			expectedArgs: []string{},
 		},
 		{
@@ -104,7 +105,7 @@ func Test_makeSql(t *testing.T) {
 					{ "direction": "asc", "nulls": "start" },
 					{ "key": "id", "direction": "desc", "nulls": "end" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" ORDER BY id desc NULLS LAST`,
+			expected:     `SELECT * FROM "folio_users"."users" ORDER BY "id" desc NULLS LAST`,
 			expectedArgs: []string{},
 		},
 		{
@@ -114,9 +115,54 @@ func Test_makeSql(t *testing.T) {
 					{ "key": "user", "direction": "asc", "nulls": "start" },
 					{ "direction": "desc", "nulls": "end" }
 				] }] }`,
-			expected:     `SELECT * FROM "folio_users"."users" ORDER BY user asc NULLS FIRST`,
+			expected:     `SELECT * FROM "folio_users"."users" ORDER BY "user" asc NULLS FIRST`,
 			expectedArgs: []string{},
 		},
+		{
+			name: "query showing an expression",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"showColumns": ["id", "(SELECT email FROM folio_users.users LIMIT 1) AS contact"] }] }`,
+			errorstr: "not a column of the table",
+		},
+		{
+			name: "query showing an alias",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"showColumns": ["user AS name"] }] }`,
+			errorstr: "not a column of the table",
+		},
+		{
+			name: "query with invalid operator",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"columnFilters": [
+					{ "key": "user", "op": "= '' OR true OR user =", "value": "x" }
+				] }] }`,
+			errorstr: "invalid operator",
+		},
+		{
+			name: "query with lower-case operator",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"columnFilters": [
+					{ "key": "user", "op": "not ilike", "value": "mi%" }
+				] }] }`,
+			expected:     `SELECT * FROM "folio_users"."users" WHERE "user" NOT ILIKE $1`,
+			expectedArgs: []string{"mi%"},
+		},
+		{
+			name: "query ordered by non-column",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"orderBy": [
+					{ "key": "(SELECT 1)", "direction": "asc" }
+				] }] }`,
+			errorstr: "cannot sort by",
+		},
+		{
+			name: "query with invalid direction",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users",
+				"orderBy": [
+					{ "key": "user", "direction": "asc, (SELECT 1)" }
+				] }] }`,
+			errorstr: "invalid sort direction",
+		},
 		{
 			name:         "query with limit",
 			sendData:     `{ "tables": [{ "schema": "folio_users", "tableName": "users", "limit": 99 }] }`,
@@ -131,8 +177,8 @@ func Test_makeSql(t *testing.T) {
 		},
 		{
 			name:         "make me one with everything",
-			sendData:     `{ "tables": [{"limit": 11,"schema": "folio_users","orderBy": [{"direction": "asc","nulls": "end","key": "creation_date"},{"direction": "asc","nulls": "start","key": "__id"}],"showColumns": ["id","creation_date","hrid","title","source"],"columnFilters": [{"key": "creation_date","op": ">=","value": "2022-06-09T19:01:33.757+00:00"},{"key": "id","op": "<>","value": "` + uuid + `"}],"tableName": "users"}]}`,
-			expected:     `SELECT id, creation_date, hrid, title, source FROM "folio_users"."users" WHERE creation_date >= $1 AND id <> $2 ORDER BY creation_date asc NULLS LAST, __id asc NULLS FIRST LIMIT 11`,
+			sendData:     `{ "tables": [{"limit": 11,"schema": "folio_users","orderBy": [{"direction": "asc","nulls": "end","key": "creation_date"},{"direction": "desc","nulls": "start","key": "id"}],"showColumns": ["id","creation_date","user"],"columnFilters": [{"key": "creation_date","op": ">=","value": "2022-06-09T19:01:33.757+00:00"},{"key": "id","op": "<>","value": "` + uuid + `"}],"tableName": "users"}]}`,
+			expected:     `SELECT "id", "creation_date", "user" FROM "folio_users"."users" WHERE "creation_date" >= $1 AND "id" <> $2 ORDER BY "creation_date" asc NULLS LAST, "id" desc NULLS FIRST LIMIT 11`,
 			expectedArgs: []string{"2022-06-09T19:01:33.757+00:00", uuid},
 		},
 	}
@@ -148,7 +194,7 @@ func Test_makeSql(t *testing.T) {
 		log:          false,
 	}))
 	assert.Nil(t, err)
-	session.dbConn = mockPostgres
+	useMockDb(session, "", mockPostgres, false)
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -160,7 +206,7 @@ func Test_makeSql(t *testing.T) {
 			err = establishMockForColumns(mockPostgres)
 			assert.Nil(t, err)
 
-			sql, params, err := makeSql(jq, session, "")
+			sql, params, err := makeSql(context.Background(), jq, session, "", &tableAccess{}, &columnMasker{}, "")
 			if test.errorstr == "" {
 				assert.Nil(t, err)
 				assert.Equal(t, test.expected, sql)
@@ -516,10 +562,9 @@ func Test_reportingHandlers(t *testing.T) {
 			}
 
 			if test.useBadSession {
-				session.dbConn = nil
+				delete(session.dbs, "")
 			} else {
-				session.dbConn = mock
-				session.isMDB = true // Mock expectations are as for MetaDB
+				useMockDb(session, "", mock, true) // Mock expectations are as for MetaDB
 			}
 
 			w := httptest.NewRecorder()
@@ -0,0 +1,189 @@
+// Cache of JSON-query and report results, invalidated when MetaDB updates the tables
+package main
+
+import "fmt"
+import "sync"
+import "time"
+import "strings"
+import "context"
+import "net/http"
+import "container/list"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+
+type cachedResult struct {
+	key      string
+	body     []byte // The JSON response
+	rowCount int
+	version  string // When the data was last updated, or "" if unknown
+	expires  time.Time
+	element  *list.Element
+}
+
+// An LRU cache of encoded responses, limited by their total size
+type resultCache struct {
+	ttl      time.Duration
+	maxBytes int
+	mutex    sync.Mutex
+	size     int
+	entries  map[string]*cachedResult
+	lru      *list.List // Most recently used at the front
+}
+
+// Returns nil if the cache is disabled
+func makeResultCache(cfg cacheConfig) *resultCache {
+	if cfg.MaxMemory <= 0 {
+		return nil
+	}
+	return &resultCache{
+		ttl:      time.Duration(cfg.Ttl) * time.Second,
+		maxBytes: cfg.MaxMemory * 1024 * 1024,
+		entries:  map[string]*cachedResult{},
+		lru:      list.New(),
+	}
+}
+
+// Makes a fixed-length key from everything that determines a result
+func resultCacheKey(parts ...any) string {
+	bytes, _ := json.Marshal(parts)
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// Must be called with the mutex held
+func (rc *resultCache) remove(entry *cachedResult) {
+	rc.lru.Remove(entry.element)
+	delete(rc.entries, entry.key)
+	rc.size -= len(entry.body)
+}
+
+// Returns the entry for the key if it has not expired and was made
+// from data of the same version, or nil and the reason there is none:
+// "miss", or "stale" if the entry was out of date and has been removed
+func (rc *resultCache) get(key string, version string) (*cachedResult, string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	entry := rc.entries[key]
+	if entry == nil {
+		return nil, "miss"
+	}
+	if time.Now().After(entry.expires) || entry.version != version {
+		rc.remove(entry)
+		return nil, "stale"
+	}
+	rc.lru.MoveToFront(entry.element)
+	return entry, "hit"
+}
+
+// Results larger than the whole cache are not stored
+func (rc *resultCache) put(key string, body []byte, rowCount int, version string) {
+	if len(body) > rc.maxBytes {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	old := rc.entries[key]
+	if old != nil {
+		rc.remove(old)
+	}
+
+	entry := &cachedResult{key: key, body: body, rowCount: rowCount, version: version, expires: time.Now().Add(rc.ttl)}
+	entry.element = rc.lru.PushFront(entry)
+	rc.entries[key] = entry
+	rc.size += len(body)
+	for rc.size > rc.maxBytes {
+		rc.remove(rc.lru.Back().Value.(*cachedResult))
+	}
+}
+
+func (rc *resultCache) stats() (int, int) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.entries), rc.size
+}
+
+// Returns when MetaDB last updated the table or, if the table is not
+// known (as for reports), any table. On LDP Classic, which does not
+// record this, returns "" so that only the TTL applies.
+func dataVersion(ctx context.Context, db *reportingDb, schema string, table string) (string, error) {
+	if !db.isMDB {
+		return "", nil
+	}
+	sql := "SELECT max(last_update)::text FROM metadb.table_update"
+	params := []any{}
+	if table != "" {
+		sql += " WHERE schema_name = $1 AND table_name = $2"
+		params = append(params, schema, table)
+	}
+
+	var version *string
+	err := db.queryDbConn().QueryRow(ctx, sql, params...).Scan(&version)
+	if err != nil {
+		return "", fmt.Errorf("could not check when data was last updated: %w", err)
+	}
+	if version == nil {
+		return "", nil
+	}
+	return *version, nil
+}
+
+// The result cache's part in handling a request. Lookup returns true
+// if it has sent a cached response; otherwise, once the result has
+// been generated, store should be called.
+type cacheLookup struct {
+	cache   *resultCache
+	key     string
+	version string
+}
+
+func wantsNoCache(req *http.Request) bool {
+	for _, directive := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the result of a query on the named table or, for a
+// report, on any table. If there is a fresh one, sends it and
+// records its row count in the audit entry.
+func (session *ModReportingSession) lookupCachedResult(w http.ResponseWriter, req *http.Request, db *reportingDb, audit *auditRecord,
+	schema string, table string, keyParts ...any) (*cacheLookup, bool) {
+	cache := session.server.resultCache
+	if cache == nil {
+		return &cacheLookup{}, false
+	}
+
+	// If the data's freshness cannot be checked, the query is run as usual
+	version, err := dataVersion(req.Context(), db, schema, table)
+	if err != nil {
+		session.LogReq(req, "error", "result cache:", err.Error())
+		return &cacheLookup{}, false
+	}
+	lookup := &cacheLookup{cache: cache, key: resultCacheKey(append([]any{session.folioSession.GetTenant(), db.name}, keyParts...)...), version: version}
+
+	if wantsNoCache(req) {
+		session.server.metrics.resultCache.inc("bypass")
+		w.Header().Set("X-Cache", "BYPASS")
+		return lookup, false
+	}
+	entry, outcome := cache.get(lookup.key, version)
+	session.server.metrics.resultCache.inc(outcome)
+	if entry == nil {
+		w.Header().Set("X-Cache", "MISS")
+		return lookup, false
+	}
+
+	audit.entry.RowCount = entry.rowCount
+	w.Header().Set("X-Cache", "HIT")
+	writeJSON(w, entry.body)
+	return lookup, true
+}
+
+func (lookup *cacheLookup) store(body []byte, rowCount int) {
+	if lookup.cache != nil {
+		lookup.cache.put(lookup.key, body, rowCount, lookup.version)
+	}
+}
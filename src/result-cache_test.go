@@ -0,0 +1,129 @@
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+func Test_resultCache(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
+		assert.Nil(t, makeResultCache(cacheConfig{Ttl: 300}))
+	})
+
+	t.Run("hit, stale and expired", func(t *testing.T) {
+		rc := makeResultCache(cacheConfig{Ttl: 300, MaxMemory: 1})
+		entry, outcome := rc.get("k", "v1")
+		assert.Nil(t, entry)
+		assert.Equal(t, "miss", outcome)
+
+		rc.put("k", []byte("[1]"), 1, "v1")
+		entry, outcome = rc.get("k", "v1")
+		assert.Equal(t, "hit", outcome)
+		assert.Equal(t, "[1]", string(entry.body))
+		assert.Equal(t, 1, entry.rowCount)
+
+		_, outcome = rc.get("k", "v2")
+		assert.Equal(t, "stale", outcome)
+		_, outcome = rc.get("k", "v2")
+		assert.Equal(t, "miss", outcome)
+
+		rc.put("k", []byte("[1]"), 1, "v2")
+		rc.entries["k"].expires = time.Now().Add(-time.Second)
+		_, outcome = rc.get("k", "v2")
+		assert.Equal(t, "stale", outcome)
+		entries, size := rc.stats()
+		assert.Equal(t, 0, entries)
+		assert.Equal(t, 0, size)
+	})
+
+	t.Run("least recently used are evicted", func(t *testing.T) {
+		rc := makeResultCache(cacheConfig{Ttl: 300, MaxMemory: 1})
+		rc.maxBytes = 10
+		rc.put("a", []byte("aaaa"), 1, "")
+		rc.put("b", []byte("bbbb"), 1, "")
+		_, _ = rc.get("a", "")
+		rc.put("c", []byte("cccc"), 1, "")
+		_, outcome := rc.get("b", "")
+		assert.Equal(t, "miss", outcome)
+		_, outcome = rc.get("a", "")
+		assert.Equal(t, "hit", outcome)
+
+		rc.put("d", []byte("too large to cache"), 1, "")
+		_, outcome = rc.get("d", "")
+		assert.Equal(t, "miss", outcome)
+		entries, size := rc.stats()
+		assert.Equal(t, 2, entries)
+		assert.Equal(t, 8, size)
+	})
+
+	t.Run("key covers every part", func(t *testing.T) {
+		assert.Equal(t, resultCacheKey("diku", "SELECT 1", []any{"x"}), resultCacheKey("diku", "SELECT 1", []any{"x"}))
+		assert.NotEqual(t, resultCacheKey("diku", "SELECT 1", []any{"x"}), resultCacheKey("diku", "SELECT 1", []any{"y"}))
+		assert.NotEqual(t, resultCacheKey("diku", "SELECT 1"), resultCacheKey("other", "SELECT 1"))
+	})
+}
+
+func Test_wantsNoCache(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":                    false,
+		"max-age=0":           false,
+		"no-cache":            true,
+		"max-age=0, No-Cache": true,
+	} {
+		req := httptest.NewRequest("POST", "/ldp/db/reports", nil)
+		req.Header.Set("Cache-Control", value)
+		assert.Equal(t, expected, wantsNoCache(req), value)
+	}
+}
+
+func Test_cachedReport(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	server.resultCache = makeResultCache(cacheConfig{Ttl: 300, MaxMemory: 1})
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+
+	tests := []struct {
+		name        string
+		version     string
+		noCache     bool
+		runs        bool
+		expectedHdr string
+	}{
+		{name: "first run", version: "2026-10-01 12:00:00+00", runs: true, expectedHdr: "MISS"},
+		{name: "repeated", version: "2026-10-01 12:00:00+00", expectedHdr: "HIT"},
+		{name: "data updated", version: "2026-10-02 12:00:00+00", runs: true, expectedHdr: "MISS"},
+		{name: "bypassed", version: "2026-10-02 12:00:00+00", noCache: true, runs: true, expectedHdr: "BYPASS"},
+		{name: "repeated after update", version: "2026-10-02 12:00:00+00", expectedHdr: "HIT"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			mock.ExpectQuery(`SELECT max\(last_update\)::text FROM metadb.table_update`).
+				WillReturnRows(pgxmock.NewRows([]string{"max"}).AddRow(&test.version))
+			if test.runs {
+				mock.ExpectBegin()
+				mock.ExpectExec("--metadb:function count_loans").WillReturnResult(pgxmock.NewResult("CREATE FUNCTION", 1))
+				mock.ExpectExec(`SET statement_timeout TO 60000`).WillReturnResult(pgxmock.NewResult("SET", 1))
+				mock.ExpectQuery(`SELECT \* FROM count_loans\(\)`).WillReturnRows(pgxmock.NewRows([]string{"num"}).AddRow(29))
+				mock.ExpectRollback()
+			}
+			useMockDb(session, "", mock, true)
+
+			body := strings.NewReader(`{ "url": "` + ts.URL + `/reports/loans.sql" }`)
+			req := httptest.NewRequest("POST", "/ldp/db/reports", body)
+			if test.noCache {
+				req.Header.Set("Cache-Control", "no-cache")
+			}
+			w := httptest.NewRecorder()
+			assert.Nil(t, handleReport(w, req, session))
+			assert.Equal(t, `{"totalRecords":1,"records":[{"num":29}]}`, strings.TrimSpace(w.Body.String()))
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, test.expectedHdr, w.Header().Get("X-Cache"))
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Run queries and reports under a Postgres role mapped from the FOLIO user
+package main
+
+import "fmt"
+import "context"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+
+const (
+	roleModeRole                 = "role"
+	roleModeSessionAuthorization = "session-authorization"
+)
+
+// Returns the Postgres role for the user, or "" if queries should run
+// as the user named in 'dbinfo'
+func (rc rolesConfig) roleFor(tenant string, username string) string {
+	if username != "" {
+		role, ok := rc.Users[tenant+":"+username]
+		if ok {
+			return role
+		}
+		role, ok = rc.Users[username]
+		if ok {
+			return role
+		}
+	}
+	return rc.DefaultRole
+}
+
+// Returns the Postgres role for the user who made the request
+func (session *ModReportingSession) requestRole(req *http.Request) string {
+	username := usernameFromToken(req.Header.Get("X-Okapi-Token"))
+	return session.server.config.Roles.roleFor(session.tenant, username)
+}
+
+// Switches to the role for the rest of the transaction. SET LOCAL
+// lasts only until the transaction ends, so the role is reset before
+// the connection is returned to the pool, even if the query fails.
+func setLocalRole(ctx context.Context, tx pgx.Tx, mode string, role string) error {
+	cmd := "SET LOCAL ROLE "
+	if mode == roleModeSessionAuthorization {
+		cmd = "SET LOCAL SESSION AUTHORIZATION "
+	}
+	_, err := tx.Exec(ctx, cmd+pgx.Identifier{role}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("could not switch to role '%s': %w", role, err)
+	}
+	return nil
+}
+
+// Runs the query as the requesting user's role, if there is one. The
+// returned function must be called once the rows have been read.
+func (session *ModReportingSession) queryAsUser(req *http.Request, dbConn PgxIface, sql string, params ...any) (pgx.Rows, func(), error) {
+	role := session.requestRole(req)
+	if role == "" {
+		rows, err := dbConn.Query(req.Context(), sql, params...)
+		return rows, func() {}, err
+	}
+
+	tx, err := dbConn.Begin(req.Context())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open transaction: %w", err)
+	}
+	done := func() {
+		// Explicitly discard return value so golangci-lint understands the intent
+		_ = tx.Rollback(context.Background())
+	}
+
+	session.LogReq(req, "db", "running as role", role)
+	err = setLocalRole(req.Context(), tx, session.server.config.Roles.Mode, role)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	rows, err := tx.Query(req.Context(), sql, params...)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return rows, done, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import "os"
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "encoding/base64"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func makeTokenFor(username string) string {
+	return makeTokenForUser(username, "123")
+}
+
+func makeTokenForUser(username string, userId string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + username + `","user_id":"` + userId + `","tenant":"diku"}`))
+	return "eyJhbGciOiJIUzI1NiJ9." + payload + ".c2lnbmF0dXJl"
+}
+
+func Test_roleFor(t *testing.T) {
+	rc := rolesConfig{
+		Users: map[string]string{
+			"mike":       "reporting_mike",
+			"fs09:mike":  "fs09_mike",
+			"diku_admin": "reporting_admin",
+		},
+		DefaultRole: "reporting_reader",
+	}
+	assert.Equal(t, "reporting_mike", rc.roleFor("diku", "mike"))
+	assert.Equal(t, "fs09_mike", rc.roleFor("fs09", "mike"))
+	assert.Equal(t, "reporting_admin", rc.roleFor("fs09", "diku_admin"))
+	assert.Equal(t, "reporting_reader", rc.roleFor("diku", "fiona"))
+	assert.Equal(t, "reporting_reader", rc.roleFor("diku", ""))
+	assert.Equal(t, "", rolesConfig{}.roleFor("diku", "mike"))
+}
+
+func Test_readConfigRoles(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(content string) string {
+		path := dir + "/config.json"
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	t.Run("default role from environment", func(t *testing.T) {
+		t.Setenv("MOD_REPORTING_DEFAULT_ROLE", "reporting_reader")
+		cfg, err := readConfig(writeConfig(`{ "roles": { "users": { "mike": "reporting_mike" }, "defaultRole": "nobody" } }`))
+		assert.Nil(t, err)
+		assert.Equal(t, "reporting_reader", cfg.Roles.DefaultRole)
+		assert.Equal(t, "reporting_mike", cfg.Roles.Users["mike"])
+	})
+
+	t.Run("bad mode", func(t *testing.T) {
+		_, err := readConfig(writeConfig(`{ "roles": { "mode": "sudo" } }`))
+		assert.ErrorContains(t, err, "roles.mode must be 'role' or 'session-authorization', not 'sudo'")
+	})
+}
+
+func Test_queryAsUser(t *testing.T) {
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, "http://localhost:9130", "diku", "dummyToken"))
+	req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+	req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+
+	t.Run("no role configured", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		mock.ExpectQuery("SELECT 1").WillReturnRows(pgxmock.NewRows([]string{"n"}).AddRow(1))
+		rows, done, err := session.queryAsUser(req, mock, "SELECT 1")
+		assert.Nil(t, err)
+		rows.Close()
+		done()
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	for _, mode := range []string{"", roleModeSessionAuthorization} {
+		t.Run("mode '"+mode+"'", func(t *testing.T) {
+			server.config.Roles = rolesConfig{Mode: mode, Users: map[string]string{"mike": `mike"s role`}}
+			defer func() { server.config.Roles = rolesConfig{} }()
+			cmd := `SET LOCAL ROLE "mike""s role"`
+			if mode == roleModeSessionAuthorization {
+				cmd = `SET LOCAL SESSION AUTHORIZATION "mike""s role"`
+			}
+
+			mock := Must(pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual)))
+			mock.ExpectBegin()
+			mock.ExpectExec(cmd).WillReturnResult(pgxmock.NewResult("SET", 0))
+			mock.ExpectQuery("SELECT 1").WillReturnRows(pgxmock.NewRows([]string{"n"}).AddRow(1))
+			mock.ExpectRollback()
+			rows, done, err := session.queryAsUser(req, mock, "SELECT 1")
+			assert.Nil(t, err)
+			rows.Close()
+			done()
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_reportAsUser(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	server.config.Roles = rolesConfig{DefaultRole: "reporting_reader"}
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+
+	mock := Must(pgxmock.NewPool())
+	mock.ExpectBegin()
+	mock.ExpectExec("--metadb:function count_loans").WillReturnResult(pgxmock.NewResult("CREATE FUNCTION", 1))
+	mock.ExpectExec(`SET LOCAL ROLE "reporting_reader"`).WillReturnResult(pgxmock.NewResult("SET", 0))
+	mock.ExpectExec(`SET statement_timeout TO 60000`).WillReturnResult(pgxmock.NewResult("SET", 1))
+	mock.ExpectQuery(`SELECT \* FROM count_loans\(\)`).WillReturnRows(pgxmock.NewRows([]string{"num"}).AddRow(29))
+	mock.ExpectRollback()
+	useMockDb(session, "", mock, true)
+
+	body := strings.NewReader(`{ "url": "` + ts.URL + `/reports/loans.sql" }`)
+	req := httptest.NewRequest("POST", "/ldp/db/reports", body)
+	req.Header.Set("X-Okapi-Token", makeTokenFor("fiona"))
+	w := httptest.NewRecorder()
+	assert.Nil(t, handleReport(w, req, session))
+	assert.Equal(t, `{"totalRecords":1,"records":[{"num":29}]}`, strings.TrimSpace(w.Body.String()))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// A role is a security boundary only if JSON queries cannot undo it,
+// e.g. with set_config('role', ...) in their list of columns
+func Test_queryCannotResetRole(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	server.config.Roles = rolesConfig{DefaultRole: "reporting_reader"}
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+
+	for _, column := range []string{
+		`set_config('role', 'postgres', true)`,
+		`id, set_config('role', 'postgres', true) AS x`,
+		`(SELECT set_config('role', current_user, true))`,
+	} {
+		t.Run(column, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			body := strings.NewReader(`{ "tables": [{ "schema": "folio_users", "tableName": "users", "showColumns": ["` + column + `"] }] }`)
+			req := httptest.NewRequest("POST", "/ldp/db/query", body)
+			req.Header.Set("X-Okapi-Token", makeTokenFor("mike"))
+			w := httptest.NewRecorder()
+			status, code := classifyError(handleQuery(w, req, session))
+			assert.Equal(t, 400, status)
+			assert.Equal(t, errInvalidParameter, code)
+			// No transaction was begun, so no SQL was run
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
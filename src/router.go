@@ -0,0 +1,201 @@
+// Declarative routing of requests to handlers, with 405 and OPTIONS/CORS support
+package main
+
+import "fmt"
+import "sort"
+import "strings"
+import "strconv"
+import "net/http"
+
+type route struct {
+	method  string
+	pattern string // Segments in braces, such as {key}, match any single segment
+	// FOLIO permission required, as declared in the module descriptor.
+	// Okapi enforces this: it is listed here for reference and so
+	// that tests can check the descriptor is consistent.
+	permission string
+	// Whether the handler runs queries that count towards the
+	// concurrency limits
+	limited bool
+	// Exactly one of these is set: handler for endpoints that need a
+	// FOLIO session, and serverHandler for those that do not
+	handler       handlerFn
+	serverHandler func(w http.ResponseWriter, req *http.Request, server *ModReportingServer)
+}
+
+var routes = []route{
+	{method: "GET", pattern: "/", serverHandler: handleHome},
+	{method: "GET", pattern: "/admin/health", serverHandler: handleHealth},
+	{method: "GET", pattern: "/admin/ready", serverHandler: handleReady},
+	{method: "GET", pattern: "/admin/metrics", serverHandler: handleMetrics},
+	{method: "GET", pattern: "/admin/queue", serverHandler: handleQueue},
+	{method: "GET", pattern: "/ldp/config", permission: "ldp.config.read", handler: handleConfig},
+	{method: "POST", pattern: "/ldp/config", permission: "ldp.config.edit", handler: handleConfig},
+	{method: "GET", pattern: "/ldp/config/{key}", permission: "ldp.config.read", handler: handleConfigKey},
+	{method: "PUT", pattern: "/ldp/config/{key}", permission: "ldp.config.edit", handler: handleConfigKey},
+	{method: "DELETE", pattern: "/ldp/config/{key}", permission: "ldp.config.edit", handler: handleConfigKey},
+	{method: "POST", pattern: "/ldp/config/dbinfo/test", permission: "ldp.config.edit", handler: handleDbinfoTest},
+	{method: "POST", pattern: "/ldp/config/dbinfo/encrypt", permission: "ldp.config.edit", handler: handleEncryptDbinfo},
+	{method: "GET", pattern: "/ldp/config-schemas", permission: "ldp.config.read", serverHandler: handleConfigSchemas},
+	{method: "GET", pattern: "/ldp/config-schemas/{key}", permission: "ldp.config.read", serverHandler: handleConfigSchemas},
+	{method: "GET", pattern: "/ldp/db/tables", permission: "ldp.tables.get", handler: handleTables},
+	{method: "GET", pattern: "/ldp/db/columns", permission: "ldp.columns.get", handler: handleColumns},
+	{method: "POST", pattern: "/ldp/db/query", permission: "ldp.query.post", limited: true, handler: handleQuery},
+	{method: "POST", pattern: "/ldp/db/reports", permission: "ldp.reports.post", limited: true, handler: handleReport},
+	{method: "POST", pattern: "/ldp/db/query/explain", permission: "ldp.query.post", handler: handleQueryExplain},
+	{method: "POST", pattern: "/ldp/db/query/sql", permission: "ldp.query.post", handler: handleQuerySql},
+	{method: "POST", pattern: "/ldp/db/reports/explain", permission: "ldp.reports.post", handler: handleReportExplain},
+	{method: "POST", pattern: "/ldp/db/sql", permission: "ldp.sql.execute", limited: true, handler: handleSql},
+	{method: "GET", pattern: "/ldp/db/saved-queries", permission: "ldp.saved-queries.read", handler: handleSavedQueries},
+	{method: "POST", pattern: "/ldp/db/saved-queries", permission: "ldp.saved-queries.edit", handler: handleSavedQueries},
+	{method: "GET", pattern: "/ldp/db/saved-queries/{id}", permission: "ldp.saved-queries.read", handler: handleSavedQuery},
+	{method: "PUT", pattern: "/ldp/db/saved-queries/{id}", permission: "ldp.saved-queries.edit", handler: handleSavedQuery},
+	{method: "DELETE", pattern: "/ldp/db/saved-queries/{id}", permission: "ldp.saved-queries.edit", handler: handleSavedQuery},
+	{method: "POST", pattern: "/ldp/db/saved-queries/{id}/run", permission: "ldp.saved-queries.read", limited: true, handler: handleSavedQueryRun},
+	{method: "GET", pattern: "/ldp/db/databases", permission: "ldp.databases.get", handler: handleDatabases},
+	{method: "GET", pattern: "/ldp/audit", permission: "ldp.audit.read", handler: handleAudit},
+	{method: "GET", pattern: "/ldp/db/log", permission: "ldp.log.get", handler: handleLogs},
+	{method: "GET", pattern: "/ldp/db/version", permission: "ldp.version.read", handler: handleVersion},
+	{method: "GET", pattern: "/ldp/db/updates", permission: "ldp.updates.read", handler: handleUpdates},
+	{method: "GET", pattern: "/ldp/db/processes", permission: "ldp.processes.read", handler: handleProcesses},
+}
+
+func matchPattern(pattern string, path string) bool {
+	if pattern == "/" || path == "/" {
+		return pattern == path
+	}
+
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, ps := range patternSegments {
+		if strings.HasPrefix(ps, "{") && strings.HasSuffix(ps, "}") {
+			if pathSegments[i] == "" {
+				return false
+			}
+		} else if ps != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the route for the path and method, if there is one, and
+// the list of methods supported for the path
+func findRoute(path string, method string) (*route, []string) {
+	var found *route
+	methods := []string{}
+	for i := range routes {
+		r := &routes[i]
+		if !matchPattern(r.pattern, path) {
+			continue
+		}
+		methods = append(methods, r.method)
+		if r.method == method || (method == "HEAD" && r.method == "GET") {
+			found = r
+		}
+	}
+
+	if len(methods) > 0 {
+		if containsString(methods, "GET") {
+			methods = append(methods, "HEAD")
+		}
+		methods = append(methods, "OPTIONS")
+		sort.Strings(methods)
+	}
+	return found, methods
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets CORS headers if the request's origin is allowed by the configuration
+func setCorsHeaders(w http.ResponseWriter, req *http.Request, cfg corsConfig, methods []string) {
+	origin := req.Header.Get("Origin")
+	if origin == "" || len(cfg.AllowedOrigins) == 0 {
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if containsString(cfg.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else if containsString(cfg.AllowedOrigins, origin) {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		return
+	}
+
+	if req.Method == "OPTIONS" {
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		if cfg.MaxAge != 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+		}
+	}
+}
+
+func handler(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	req = withRequestInfo(req)
+	path := req.URL.Path
+	server.LogReq(req, "path", path)
+
+	r, methods := findRoute(path, req.Method)
+	setCorsHeaders(w, req, server.config.Cors, methods)
+
+	if len(methods) == 0 {
+		sendError(w, req, newHTTPErrorf(http.StatusNotFound, errNotFound, "no such endpoint: %s", path))
+		return
+	} else if req.Method == "OPTIONS" {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if r == nil {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		sendError(w, req, newHTTPErrorf(http.StatusMethodNotAllowed, errMethodNotAllowed,
+			"method %s not allowed for %s: use %s", req.Method, path, strings.Join(methods, ", ")))
+		return
+	}
+
+	if r.handler != nil {
+		runWithErrorHandling(w, req, server, r.handler, r.limited)
+	} else {
+		r.serverHandler(w, req, server)
+	}
+}
+
+func handleHome(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, `
+This is <a href="https://github.com/folio-org/mod-reporting">mod-reporting</a>. Try:
+<ul>
+  <li><a href="/admin/health">Health check</a></li>
+  <li><a href="/admin/ready">Readiness check</a></li>
+  <li><a href="/admin/metrics">Metrics</a></li>
+  <li><a href="/admin/queue">Query queue</a></li>
+  <li><a href="/htdocs/">Static area</a></li>
+  <li><a href="/ldp/config">Legacy configuration WSAPI</a></li>
+  <li><a href="/ldp/config/dbinfo">Legacy configuration 'dbinfo'</a></li>
+  <li><a href="/ldp/config-schemas">Schemas for configuration values</a></li>
+  <li><a href="/ldp/db/tables">List tables from reporting database</a></li>
+  <li><a href="/ldp/db/columns?schema=folio_users&table=users">List columns for "users" table</a></li>
+  <li><a href="/ldp/db/databases">List reporting databases</a></li>
+  <li><a href="/ldp/audit">Audit log</a></li>
+  <li><a href="/ldp/db/log">Logs</a></li>
+  <li><a href="/ldp/db/version">Version</a></li>
+  <li><a href="/ldp/db/updates">Updates</a></li>
+  <li><a href="/ldp/db/processes">Processes</a></li>
+</ul>`)
+}
+
+func handleHealth(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
+	fmt.Fprintln(w, "Behold! I live!!")
+}
@@ -0,0 +1,133 @@
+package main
+
+import "os"
+import "strings"
+import "testing"
+import "encoding/json"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+func Test_matchPattern(t *testing.T) {
+	assert.True(t, matchPattern("/", "/"))
+	assert.False(t, matchPattern("/", "/foo"))
+	assert.True(t, matchPattern("/ldp/db/query", "/ldp/db/query"))
+	assert.True(t, matchPattern("/ldp/db/query", "/ldp/db/query/"))
+	assert.False(t, matchPattern("/ldp/db/query", "/ldp/db/query/x"))
+	assert.True(t, matchPattern("/ldp/config/{key}", "/ldp/config/dbinfo"))
+	assert.False(t, matchPattern("/ldp/config/{key}", "/ldp/config/"))
+	assert.False(t, matchPattern("/ldp/config/{key}", "/ldp/config"))
+}
+
+func Test_findRoute(t *testing.T) {
+	r, methods := findRoute("/ldp/db/query", "POST")
+	assert.Equal(t, "/ldp/db/query", r.pattern)
+	assert.Equal(t, []string{"OPTIONS", "POST"}, methods)
+
+	r, methods = findRoute("/ldp/db/query", "GET")
+	assert.Nil(t, r)
+	assert.Equal(t, []string{"OPTIONS", "POST"}, methods)
+
+	r, methods = findRoute("/ldp/config/dbinfo", "HEAD")
+	assert.Equal(t, "GET", r.method)
+	assert.Equal(t, []string{"DELETE", "GET", "HEAD", "OPTIONS", "PUT"}, methods)
+
+	r, methods = findRoute("/no/such/path", "GET")
+	assert.Nil(t, r)
+	assert.Empty(t, methods)
+}
+
+func Test_handlerDispatch(t *testing.T) {
+	cfg := Must(readConfig("../etc/silent.json"))
+	cfg.Cors.AllowedOrigins = []string{"http://localhost:3000"}
+	cfg.Cors.MaxAge = 600
+	server := MakeModReportingServer(cfg, makeLogger(cfg.Logging), ".")
+
+	t.Run("method not allowed", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/ldp/db/tables", nil)
+		w := httptest.NewRecorder()
+		handler(w, req, server)
+		assert.Equal(t, 405, w.Code)
+		assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+		assert.Contains(t, w.Body.String(), `"code":"method-not-allowed"`)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/nothing", nil)
+		w := httptest.NewRecorder()
+		handler(w, req, server)
+		assert.Equal(t, 404, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"not-found"`)
+	})
+
+	t.Run("CORS preflight from allowed origin", func(t *testing.T) {
+		req := httptest.NewRequest("OPTIONS", "/ldp/db/query", nil)
+		req.Header.Add("Origin", "http://localhost:3000")
+		w := httptest.NewRecorder()
+		handler(w, req, server)
+		assert.Equal(t, 204, w.Code)
+		assert.Equal(t, "OPTIONS, POST", w.Header().Get("Allow"))
+		assert.Equal(t, "http://localhost:3000", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "OPTIONS, POST", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "X-Okapi-Token")
+		assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("CORS preflight from other origin", func(t *testing.T) {
+		req := httptest.NewRequest("OPTIONS", "/ldp/db/query", nil)
+		req.Header.Add("Origin", "http://evil.example.com")
+		w := httptest.NewRecorder()
+		handler(w, req, server)
+		assert.Equal(t, 204, w.Code)
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("CORS header on simple request", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/admin/health", nil)
+		req.Header.Add("Origin", "http://localhost:3000")
+		w := httptest.NewRecorder()
+		handler(w, req, server)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "http://localhost:3000", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Methods"))
+	})
+}
+
+// Every route that needs a permission must be declared with that
+// permission in the module descriptor
+func Test_routesMatchDescriptor(t *testing.T) {
+	type mdHandler struct {
+		Methods             []string `json:"methods"`
+		PathPattern         string   `json:"pathPattern"`
+		PermissionsRequired []string `json:"permissionsRequired"`
+	}
+	var md struct {
+		Provides []struct {
+			Handlers []mdHandler `json:"handlers"`
+		} `json:"provides"`
+	}
+	bytes := Must(os.ReadFile("../descriptors/ModuleDescriptor-template.json"))
+	assert.Nil(t, json.Unmarshal(bytes, &md))
+
+	// Okapi path patterns use {id} for a segment and * for any suffix
+	mdMatch := func(pattern string, routePattern string) bool {
+		if strings.HasSuffix(pattern, "*") {
+			return strings.HasPrefix(routePattern, strings.TrimSuffix(pattern, "*"))
+		}
+		// Strip the braces so the route pattern can be matched as a path
+		return matchPattern(pattern, strings.NewReplacer("{", "", "}", "").Replace(routePattern))
+	}
+
+	for _, r := range routes {
+		if r.permission == "" {
+			continue
+		}
+		found := false
+		for _, h := range md.Provides[0].Handlers {
+			if containsString(h.Methods, r.method) && mdMatch(h.PathPattern, r.pattern) &&
+				containsString(h.PermissionsRequired, r.permission) {
+				found = true
+			}
+		}
+		assert.True(t, found, "no descriptor handler for %s %s with permission %s", r.method, r.pattern, r.permission)
+	}
+}
@@ -0,0 +1,316 @@
+// Saved JSON queries and reports, kept in mod-settings so that they can be shared and run by ID
+package main
+
+import "io"
+import "fmt"
+import "sort"
+import "strings"
+import "net/http"
+import "encoding/json"
+import bytesLib "bytes"
+import "github.com/google/uuid"
+import "github.com/indexdata/foliogo"
+
+// Each saved query is a mod-settings record whose key is this prefix followed by its ID
+const savedQueryKeyPrefix = "saved-query."
+
+const (
+	sharingPrivate = "private" // Only the owner can see and run it: the default
+	sharingTenant  = "tenant"  // Everyone in the tenant can see and run it
+)
+
+// Exactly one of JsonQuery and ReportUrl is set. Params and Limit
+// apply to reports; for JSON queries, they are in the query itself.
+type savedQuery struct {
+	Id            string            `json:"id"`
+	Name          string            `json:"name"`
+	Description   string            `json:"description,omitempty"`
+	Owner         string            `json:"owner"` // The user ID of whoever created it
+	OwnerUsername string            `json:"ownerUsername,omitempty"`
+	Sharing       string            `json:"sharing"`
+	JsonQuery     json.RawMessage   `json:"jsonQuery,omitempty"`
+	ReportUrl     string            `json:"reportUrl,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+	Limit         int               `json:"limit,omitempty"`
+}
+
+// Values that replace those saved when a query is run. For a JSON
+// query, each parameter replaces the value of the filters on the
+// column of that name.
+type savedQueryOverrides struct {
+	Params map[string]string `json:"params"`
+	Limit  int               `json:"limit"`
+}
+
+func (sq *savedQuery) visibleTo(userId string) bool {
+	return sq.Sharing == sharingTenant || sq.Owner == userId
+}
+
+func savedQueryItemToSavedQuery(item settingsItemGeneral) (*savedQuery, error) {
+	value, err := rawSettingsValue(item)
+	if err != nil {
+		return nil, err
+	}
+	var sq savedQuery
+	err = json.Unmarshal([]byte(value), &sq)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse saved query '%s': %w", item.Key, err)
+	}
+	return &sq, nil
+}
+
+// Returns the saved query and its mod-settings record, failing with
+// 404 if there is none that the caller can see
+func fetchSavedQuery(req *http.Request, session *ModReportingSession, id string) (*savedQuery, *settingsItemGeneral, error) {
+	notFound := newHTTPErrorf(http.StatusNotFound, errNotFound, "no saved query with ID '%s'", id)
+	_, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil, notFound
+	}
+	item, err := fetchSettingsItem(req, session, savedQueryKeyPrefix+id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if item == nil {
+		return nil, nil, notFound
+	}
+	sq, err := savedQueryItemToSavedQuery(*item)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sq.visibleTo(userIdFromToken(req.Header.Get("X-Okapi-Token"))) {
+		return nil, nil, notFound
+	}
+	return sq, item, nil
+}
+
+// Reads a saved query from the request body and checks that it is
+// complete. Its ID and owner are set by the caller.
+func readSavedQuery(req *http.Request, session *ModReportingSession) (*savedQuery, error) {
+	bytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read HTTP request body: %w", err)
+	}
+	var sq savedQuery
+	err = json.Unmarshal(bytes, &sq)
+	if err != nil {
+		return nil, newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
+	}
+
+	if sq.Name == "" {
+		return nil, newHTTPErrorf(http.StatusBadRequest, errMissingParameter, "saved query must have a name")
+	}
+	if sq.Sharing == "" {
+		sq.Sharing = sharingPrivate
+	} else if sq.Sharing != sharingPrivate && sq.Sharing != sharingTenant {
+		return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "sharing must be '%s' or '%s', not '%s'", sharingPrivate, sharingTenant, sq.Sharing)
+	}
+
+	if (len(sq.JsonQuery) == 0) == (sq.ReportUrl == "") {
+		return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "saved query must have exactly one of jsonQuery and reportUrl")
+	}
+	if len(sq.JsonQuery) != 0 {
+		var query jsonQuery
+		dec := json.NewDecoder(bytesLib.NewReader(sq.JsonQuery))
+		dec.UseNumber()
+		err = dec.Decode(&query)
+		if err != nil || len(query.Tables) == 0 {
+			return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "jsonQuery must be a JSON query with at least one table")
+		}
+	} else {
+		err = validateUrl(session, sq.ReportUrl)
+		if err != nil {
+			return nil, newHTTPErrorf(http.StatusUnprocessableEntity, errReportUrlRejected, "query may not be loaded from %s: %w", sq.ReportUrl, err)
+		}
+	}
+	return &sq, nil
+}
+
+func storeSavedQuery(req *http.Request, session *ModReportingSession, sq *savedQuery, existing *settingsItemGeneral) error {
+	bytes, err := json.Marshal(sq)
+	if err != nil {
+		return fmt.Errorf("could not serialize saved query: %w", err)
+	}
+	_, err = storeConfigValue(req, session, savedQueryKeyPrefix+sq.Id, string(bytes), existing, req.Header.Get("If-Match") != "")
+	return err
+}
+
+// GET /ldp/db/saved-queries lists the queries the caller can see, in
+// order of name; POST creates one owned by the caller
+func handleSavedQueries(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	token := req.Header.Get("X-Okapi-Token")
+	if req.Method == "POST" {
+		sq, err := readSavedQuery(req, session)
+		if err != nil {
+			return err
+		}
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("could not generate v4 UUID: %w", err)
+		}
+		sq.Id = id.String()
+		sq.Owner = userIdFromToken(token)
+		sq.OwnerUsername = usernameFromToken(token)
+		err = storeSavedQuery(req, session, sq, nil)
+		if err != nil {
+			return err
+		}
+		bytes, err := encodeJSON(sq, "saved query")
+		if err != nil {
+			return err
+		}
+		// Headers must be set before WriteHeader, so writeJSON cannot be used
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/ldp/db/saved-queries/"+sq.Id)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes)
+		return nil
+	}
+
+	items, err := fetchSettingsItems(req, session, settingsQuery(savedQueryKeyPrefix+"*"), 0, -1)
+	if err != nil {
+		return err
+	}
+	userId := userIdFromToken(token)
+	list := []*savedQuery{}
+	for _, item := range items {
+		sq, err := savedQueryItemToSavedQuery(item)
+		if err != nil {
+			return err
+		}
+		if sq.visibleTo(userId) {
+			list = append(list, sq)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return sendJSON(w, list, "saved queries")
+}
+
+// GET, PUT and DELETE /ldp/db/saved-queries/{id}. Only the owner may
+// modify or delete a saved query, even one shared with the tenant.
+func handleSavedQuery(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	id := strings.TrimPrefix(req.URL.Path, "/ldp/db/saved-queries/")
+	sq, item, err := fetchSavedQuery(req, session, id)
+	if err != nil {
+		return err
+	}
+	if req.Method == "GET" {
+		w.Header().Set("ETag", versionETag(item.Version))
+		return sendJSON(w, sq, "saved query")
+	}
+
+	if sq.Owner != userIdFromToken(req.Header.Get("X-Okapi-Token")) {
+		return newHTTPErrorf(http.StatusForbidden, errAccessDenied, "only the owner of saved query '%s' may change it", id)
+	}
+	err = checkIfMatch(req, item.Key, item)
+	if err != nil {
+		return err
+	}
+
+	if req.Method == "DELETE" {
+		_, err = fetchWithToken(req, session.folioSession, "settings/entries/"+item.Id, foliogo.RequestParams{
+			Method: "DELETE",
+		})
+		if err != nil {
+			return newHTTPErrorf(http.StatusServiceUnavailable, errSettingsUnavailable, "could not delete from mod-settings: %w", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	// Assume PUT
+	replacement, err := readSavedQuery(req, session)
+	if err != nil {
+		return err
+	}
+	replacement.Id = sq.Id
+	replacement.Owner = sq.Owner
+	replacement.OwnerUsername = sq.OwnerUsername
+	err = storeSavedQuery(req, session, replacement, item)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, replacement, "saved query")
+}
+
+// Makes the body of a request to /ldp/db/query or /ldp/db/reports
+// that runs the saved query with the overrides applied
+func (sq *savedQuery) requestBody(overrides savedQueryOverrides) ([]byte, error) {
+	if sq.ReportUrl != "" {
+		query := reportQuery{Url: sq.ReportUrl, Params: map[string]string{}}
+		for key, value := range sq.Params {
+			query.Params[key] = value
+		}
+		for key, value := range overrides.Params {
+			query.Params[key] = value
+		}
+		limit := sq.Limit
+		if overrides.Limit != 0 {
+			limit = overrides.Limit
+		}
+		query.Limit = json.Number(fmt.Sprint(limit))
+		return json.Marshal(query)
+	}
+
+	var query jsonQuery
+	dec := json.NewDecoder(bytesLib.NewReader(sq.JsonQuery))
+	dec.UseNumber()
+	err := dec.Decode(&query)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse saved JSON query: %w", err)
+	}
+	for _, table := range query.Tables {
+		for i, filter := range table.Filters {
+			value, ok := overrides.Params[filter.Key]
+			if ok {
+				table.Filters[i].Value = value
+			}
+		}
+	}
+	if overrides.Limit != 0 && len(query.Tables) > 0 {
+		query.Tables[0].Limit = json.Number(fmt.Sprint(overrides.Limit))
+	}
+	return json.Marshal(query)
+}
+
+// POST /ldp/db/saved-queries/{id}/run runs a saved query exactly as
+// /ldp/db/query or /ldp/db/reports would, so the caller needs the
+// permission for that endpoint too
+func handleSavedQueryRun(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/ldp/db/saved-queries/"), "/run")
+	sq, _, err := fetchSavedQuery(req, session, id)
+	if err != nil {
+		return err
+	}
+
+	var overrides savedQueryOverrides
+	bytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("could not read HTTP request body: %w", err)
+	}
+	if len(bytesLib.TrimSpace(bytes)) != 0 {
+		err = json.Unmarshal(bytes, &overrides)
+		if err != nil {
+			return newHTTPErrorf(http.StatusBadRequest, errInvalidJson, "could not deserialize JSON from body: %w", err)
+		}
+	}
+
+	path, permission, handler := "/ldp/db/query", "ldp.query.post", handleQuery
+	if sq.ReportUrl != "" {
+		path, permission, handler = "/ldp/db/reports", "ldp.reports.post", handleReport
+	}
+	if !containsString(okapiPermissions(req), permission) {
+		httpErr := newHTTPErrorf(http.StatusForbidden, errAccessDenied, "running saved query '%s' requires permission '%s'", id, permission)
+		httpErr.details = map[string]interface{}{"permission": permission}
+		return httpErr
+	}
+
+	body, err := sq.requestBody(overrides)
+	if err != nil {
+		return err
+	}
+	subReq := req.Clone(req.Context())
+	subReq.URL.Path = path
+	subReq.Body = io.NopCloser(bytesLib.NewReader(body))
+	return handler(w, subReq, session)
+}
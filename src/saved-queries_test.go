@@ -0,0 +1,237 @@
+package main
+
+import "io"
+import "sync"
+import "regexp"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+// A minimal mod-settings that keeps entries in memory, and serves
+// reports as MakeMockHTTPServer does
+func makeMemorySettingsServer() *httptest.Server {
+	var mutex sync.Mutex
+	entries := map[string]map[string]interface{}{}
+	keyRegexp := regexp.MustCompile(`(and|or|not|\() ?key=="([^"]*)"`)
+	reports := MakeMockHTTPServer()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(req.URL.Path, "/reports/") {
+			reports.Config.Handler.ServeHTTP(w, req)
+			return
+		}
+
+		id := strings.TrimPrefix(req.URL.Path, "/settings/entries/")
+		switch {
+		case req.Method == "GET":
+			items := []map[string]interface{}{}
+			included, excluded := []string{}, []string{}
+			for _, m := range keyRegexp.FindAllStringSubmatch(req.URL.Query().Get("query"), -1) {
+				if m[1] == "not" {
+					excluded = append(excluded, m[2])
+				} else {
+					included = append(included, m[2])
+				}
+			}
+			matches := func(key string, patterns []string) bool {
+				for _, p := range patterns {
+					if key == p || (strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*"))) {
+						return true
+					}
+				}
+				return false
+			}
+			for _, entry := range entries {
+				key := entry["key"].(string)
+				if (len(included) == 0 || matches(key, included)) && !matches(key, excluded) {
+					items = append(items, entry)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "resultInfo": map[string]int{"totalRecords": len(items)}})
+		case req.Method == "DELETE":
+			delete(entries, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			var entry map[string]interface{}
+			_ = json.Unmarshal(Must(io.ReadAll(req.Body)), &entry)
+			version := 1
+			if old := entries[entry["id"].(string)]; old != nil {
+				version = old["_version"].(int) + 1
+			}
+			entry["_version"] = version
+			entries[entry["id"].(string)] = entry
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func Test_savedQueryRequestBody(t *testing.T) {
+	jq := &savedQuery{JsonQuery: json.RawMessage(`{"tables":[{"schema":"folio_users","tableName":"users",` +
+		`"columnFilters":[{"key":"user","value":"mike"},{"key":"id","op":"=","value":"x"}],"limit":10}]}`)}
+	body := Must(jq.requestBody(savedQueryOverrides{Params: map[string]string{"user": "fiona"}}))
+	assert.Equal(t, `{"tables":[{"schema":"folio_users","tableName":"users",`+
+		`"columnFilters":[{"key":"user","op":"","value":"fiona"},{"key":"id","op":"=","value":"x"}],`+
+		`"showColumns":null,"orderBy":null,"limit":10}]}`, string(body))
+	body = Must(jq.requestBody(savedQueryOverrides{Limit: 5}))
+	assert.Contains(t, string(body), `"value":"mike"`)
+	assert.Contains(t, string(body), `"limit":5`)
+
+	report := &savedQuery{ReportUrl: "https://example.com/loans.sql", Params: map[string]string{"start": "2026-01-01", "end": "2026-02-01"}, Limit: 100}
+	body = Must(report.requestBody(savedQueryOverrides{Params: map[string]string{"end": "2026-03-01"}}))
+	assert.Equal(t, `{"url":"https://example.com/loans.sql","params":{"end":"2026-03-01","start":"2026-01-01"},"limit":100}`, string(body))
+}
+
+func Test_savedQueries(t *testing.T) {
+	ts := makeMemorySettingsServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "diku", "dummyToken"))
+	mike := makeTokenForUser("mike", "11111111-1111-4111-8111-111111111111")
+	fiona := makeTokenForUser("fiona", "22222222-2222-4222-8222-222222222222")
+
+	call := func(f handlerFn, method string, path string, token string, body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Okapi-Token", token)
+		req.Header.Set("X-Okapi-Permissions", `["ldp.query.post"]`)
+		w := httptest.NewRecorder()
+		return w, f(w, req, session)
+	}
+	create := func(token string, body string) *savedQuery {
+		w, err := call(handleSavedQueries, "POST", "/ldp/db/saved-queries", token, body)
+		assert.Nil(t, err)
+		assert.Equal(t, 201, w.Code)
+		assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+		var sq savedQuery
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &sq))
+		assert.Equal(t, "/ldp/db/saved-queries/"+sq.Id, w.Header().Get("Location"))
+		return &sq
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		for body, errorstr := range map[string]string{
+			`{ "jsonQuery": {"tables":[]} }`:                      "saved query must have a name",
+			`{ "name": "x" }`:                                     "exactly one of jsonQuery and reportUrl",
+			`{ "name": "x", "reportUrl": "u", "jsonQuery": {} }`:  "exactly one of jsonQuery and reportUrl",
+			`{ "name": "x", "jsonQuery": {"tables":[]} }`:         "at least one table",
+			`{ "name": "x", "reportUrl": "u", "sharing": "all" }`: "sharing must be 'private' or 'tenant'",
+		} {
+			_, err := call(handleSavedQueries, "POST", "/ldp/db/saved-queries", mike, body)
+			assert.ErrorContains(t, err, errorstr)
+		}
+	})
+
+	users := create(mike, `{ "name": "Users named mike", "description": "By username",
+	  "jsonQuery": { "tables": [{ "schema": "folio_users", "tableName": "users", "columnFilters": [{ "key": "user", "value": "mike" }] }] } }`)
+	assert.Equal(t, "11111111-1111-4111-8111-111111111111", users.Owner)
+	assert.Equal(t, "mike", users.OwnerUsername)
+	assert.Equal(t, sharingPrivate, users.Sharing)
+	loans := create(mike, `{ "name": "all loans", "reportUrl": "`+ts.URL+`/reports/loans.sql", "sharing": "tenant" }`)
+
+	t.Run("listing shows only visible queries", func(t *testing.T) {
+		w := Must(call(handleSavedQueries, "GET", "/ldp/db/saved-queries", mike, ""))
+		var list []savedQuery
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, []string{"all loans", "Users named mike"}, []string{list[0].Name, list[1].Name})
+
+		w = Must(call(handleSavedQueries, "GET", "/ldp/db/saved-queries", fiona, ""))
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Len(t, list, 1)
+		assert.Equal(t, loans.Id, list[0].Id)
+	})
+
+	t.Run("private query is hidden from others", func(t *testing.T) {
+		_, err := call(handleSavedQuery, "GET", "/ldp/db/saved-queries/"+users.Id, fiona, "")
+		status, _ := classifyError(err)
+		assert.Equal(t, 404, status)
+		_, err = call(handleSavedQuery, "GET", "/ldp/db/saved-queries/not-a-uuid", mike, "")
+		status, _ = classifyError(err)
+		assert.Equal(t, 404, status)
+	})
+
+	t.Run("only the owner may modify", func(t *testing.T) {
+		_, err := call(handleSavedQuery, "PUT", "/ldp/db/saved-queries/"+loans.Id, fiona, `{ "name": "mine", "reportUrl": "u" }`)
+		status, code := classifyError(err)
+		assert.Equal(t, 403, status)
+		assert.Equal(t, errAccessDenied, code)
+
+		w := Must(call(handleSavedQuery, "GET", "/ldp/db/saved-queries/"+loans.Id, mike, ""))
+		assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+		w = Must(call(handleSavedQuery, "PUT", "/ldp/db/saved-queries/"+loans.Id, mike,
+			`{ "name": "All loans", "reportUrl": "`+ts.URL+`/reports/loans.sql", "params": { "end_date": "2023-03-18T00:00:00.000Z" }, "sharing": "tenant" }`))
+		assert.Contains(t, w.Body.String(), `"name":"All loans","owner":"11111111-1111-4111-8111-111111111111"`)
+	})
+
+	t.Run("run JSON query with overrides", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		assert.Nil(t, establishMockForColumns(mock))
+		mock.ExpectQuery(`SELECT \* FROM "folio_users"."users" WHERE "user" = \$1 LIMIT 1`).WithArgs("fiona").
+			WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("fiona"))
+		useMockDb(session, "", mock, true)
+		delete(session2columns, session.key()+"::folio_users:users")
+
+		w, err := call(handleSavedQueryRun, "POST", "/ldp/db/saved-queries/"+users.Id+"/run", mike,
+			`{ "params": { "user": "fiona" }, "limit": 1 }`)
+		assert.Nil(t, err)
+		assert.Equal(t, `[{"name":"fiona"}]`, w.Body.String())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("run report needs report permission", func(t *testing.T) {
+		_, err := call(handleSavedQueryRun, "POST", "/ldp/db/saved-queries/"+loans.Id+"/run", fiona, "")
+		status, code := classifyError(err)
+		assert.Equal(t, 403, status)
+		assert.Equal(t, errAccessDenied, code)
+		assert.Equal(t, map[string]interface{}{"permission": "ldp.reports.post"}, errorDetails(err))
+	})
+
+	t.Run("run report", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		assert.Nil(t, establishMockForReport(mock))
+		useMockDb(session, "", mock, true)
+
+		req := httptest.NewRequest("POST", "/ldp/db/saved-queries/"+loans.Id+"/run", nil)
+		req.Header.Set("X-Okapi-Token", fiona)
+		req.Header.Set("X-Okapi-Permissions", `["ldp.reports.post"]`)
+		w := httptest.NewRecorder()
+		assert.Nil(t, handleSavedQueryRun(w, req, session))
+		assert.Contains(t, w.Body.String(), `"totalRecords":2`)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("hidden from /ldp/config", func(t *testing.T) {
+		w := Must(call(handleConfig, "GET", "/ldp/config", fiona, ""))
+		assert.Equal(t, "[]", w.Body.String())
+		w = Must(call(handleConfig, "GET", "/ldp/config?key=saved-query.*", fiona, ""))
+		assert.Equal(t, "[]", w.Body.String())
+	})
+
+	t.Run("not writable through /ldp/config", func(t *testing.T) {
+		path := "/ldp/config/" + savedQueryKeyPrefix + users.Id
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			_, err := call(handleConfigKey, method, path, fiona, `{ "key": "x", "value": "{}" }`)
+			status, code := classifyError(err)
+			assert.Equal(t, 403, status, method)
+			assert.Equal(t, errAccessDenied, code, method)
+		}
+		_, err := call(handleConfig, "POST", "/ldp/config", fiona, `{ "key": "`+savedQueryKeyPrefix+`x", "value": "{}" }`)
+		status, _ := classifyError(err)
+		assert.Equal(t, 403, status)
+
+		w := Must(call(handleSavedQuery, "GET", "/ldp/db/saved-queries/"+users.Id, mike, ""))
+		assert.Contains(t, w.Body.String(), `"name":"Users named mike"`)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := Must(call(handleSavedQuery, "DELETE", "/ldp/db/saved-queries/"+users.Id, mike, ""))
+		assert.Equal(t, 204, w.Code)
+		_, err := call(handleSavedQuery, "GET", "/ldp/db/saved-queries/"+users.Id, mike, "")
+		status, _ := classifyError(err)
+		assert.Equal(t, 404, status)
+	})
+}
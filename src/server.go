@@ -1,31 +1,35 @@
 package main
 
 import "os"
+import "os/signal"
+import "syscall"
+import "context"
+import "errors"
+import "sync"
 import "fmt"
+import "net"
 import "net/http"
 import "time"
-import "strings"
 import "strconv"
-import "html"
 import "github.com/MikeTaylor/catlogger"
 
-type HTTPError struct {
-	status  int
-	message string
-}
-
-func (m *HTTPError) Error() string {
-	return m.message
-}
-
 type handlerFn func(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error
 
 type ModReportingServer struct {
-	config   *config
-	logger   *catlogger.Logger
-	root     string
-	server   http.Server
-	sessions map[string]*ModReportingSession
+	config        *config
+	logger        *catlogger.Logger
+	root          string
+	server        http.Server
+	sessions      map[string]*ModReportingSession
+	sessionsMutex sync.Mutex
+	metrics       *metrics
+	audit         auditStore // nil if auditing is not enabled
+	limiter       *concurrencyLimiter
+	resultCache   *resultCache // nil if caching is not enabled
+	// All request contexts derive from baseCtx, so that cancelling
+	// it aborts any Postgres queries still running at shutdown
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
 func MakeModReportingServer(cfg *config, logger *catlogger.Logger, root string) *ModReportingServer {
@@ -33,6 +37,7 @@ func MakeModReportingServer(cfg *config, logger *catlogger.Logger, root string)
 	tr.RegisterProtocol("file", http.NewFileTransport(http.Dir(root)))
 
 	mux := http.NewServeMux()
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	var server = ModReportingServer{
 		config: cfg,
 		logger: logger,
@@ -42,8 +47,14 @@ func MakeModReportingServer(cfg *config, logger *catlogger.Logger, root string)
 			ReadTimeout:  time.Duration(cfg.QueryTimeout+60) * time.Second,
 			WriteTimeout: time.Duration(cfg.QueryTimeout+60) * time.Second,
 			Handler:      mux,
+			BaseContext:  func(net.Listener) context.Context { return baseCtx },
 		},
-		sessions: map[string]*ModReportingSession{},
+		sessions:    map[string]*ModReportingSession{},
+		metrics:     makeMetrics(),
+		limiter:     makeConcurrencyLimiter(cfg.Concurrency),
+		resultCache: makeResultCache(cfg.Cache),
+		baseCtx:     baseCtx,
+		cancelBase:  cancelBase,
 	}
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { handler(w, r, &server) })
@@ -55,13 +66,22 @@ func MakeModReportingServer(cfg *config, logger *catlogger.Logger, root string)
 	return &server
 }
 
-// Intended only for ModReportingSession to pass the session logger though to foliogo
+// Intended only for ModReportingSession to pass the session logger though to foliogo.
+// In JSON logging mode, foliogo's free-text logging is suppressed.
 func (server *ModReportingServer) GetLogger() *catlogger.Logger {
+	if server.config.Logging.isJSON() {
+		return &catlogger.Logger{}
+	}
 	return server.logger
 }
 
 func (server *ModReportingServer) Log(cat string, args ...string) {
-	server.logger.Log(cat, args...)
+	server.logWithRequest(nil, nil, cat, args...)
+}
+
+// Like Log, but includes details of the request when logging JSON
+func (server *ModReportingServer) LogReq(req *http.Request, cat string, args ...string) {
+	server.logWithRequest(req, nil, cat, args...)
 }
 
 func (server *ModReportingServer) launch() error {
@@ -78,104 +98,142 @@ func (server *ModReportingServer) launch() error {
 	hostspec := cfg.Listen.Host + ":" + fmt.Sprint(port)
 	server.server.Addr = hostspec
 	server.Log("listen", "listening on", hostspec)
-	err := server.server.ListenAndServe()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.server.ListenAndServe()
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	var err error
+	select {
+	case err = <-errChan:
+		// The listener failed, e.g. because the port is in use
+	case sig := <-sigChan:
+		server.Log("listen", "received signal", sig.String())
+		err = server.shutdown()
+	}
+
 	server.Log("listen", "finished listening on", hostspec)
 	return err
 }
 
+// Stops accepting new connections and waits up to the configured
+// grace period for running handlers to finish. Any that are still
+// running after that have their Postgres queries cancelled. Finally,
+// all reporting-database and audit-database connection pools are closed.
+func (server *ModReportingServer) shutdown() error {
+	gracePeriod := time.Duration(server.config.ShutdownGracePeriod) * time.Second
+	server.Log("listen", fmt.Sprintf("shutting down: waiting up to %v for running requests", gracePeriod))
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	err := server.server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		server.Log("listen", "grace period expired: cancelling running queries")
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("could not shut down HTTP server: %w", err)
+	}
+	server.cancelBase()
+
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	for key, session := range server.sessions {
+		session.closeDbConn()
+		delete(server.sessions, key)
+	}
+	if server.audit != nil {
+		server.audit.close()
+	}
+
+	_ = server.server.Close()
+	server.Log("listen", "shutdown complete")
+	return err
+}
+
 // We maintain a map of tenant:url to session
 func (server *ModReportingServer) findSession(url string, tenant string, token string) (*ModReportingSession, error) {
 	key := sessionKey(url, tenant, token)
+	server.sessionsMutex.Lock()
 	session := server.sessions[key]
+	server.sessionsMutex.Unlock()
 	if session != nil {
 		return session, nil
 	}
 
+	// Creating a session may mean logging in to FOLIO, which can be
+	// slow, so it is done without holding the mutex that every
+	// request needs
 	session, err := NewModReportingSession(server, url, tenant, token)
 	if err != nil {
 		return nil, fmt.Errorf("could not create session for key '%s': %w", key, err)
 	}
 
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
+	existing := server.sessions[key]
+	if existing != nil {
+		// Another request created it in the meantime
+		return existing, nil
+	}
 	server.sessions[key] = session
 	return session, nil
 }
 
-func handler(w http.ResponseWriter, req *http.Request, server *ModReportingServer) {
-	path := req.URL.Path
-	server.Log("path", path)
-
-	if path == "/" {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintln(w, `
-This is <a href="https://github.com/folio-org/mod-reporting">mod-reporting</a>. Try:
-<ul>
-  <li><a href="/admin/health">Health check</a></li>
-  <li><a href="/htdocs/">Static area</a></li>
-  <li><a href="/ldp/config">Legacy configuration WSAPI</a></li>
-  <li><a href="/ldp/config/dbinfo">Legacy configuration 'dbinfo'</a></li>
-  <li><a href="/ldp/db/tables">List tables from reporting database</a></li>
-  <li><a href="/ldp/db/columns?schema=folio_users&table=users">List columns for "users" table</a></li>
-  <li><a href="/ldp/db/log">Logs</a></li>
-  <li><a href="/ldp/db/version">Version</a></li>
-  <li><a href="/ldp/db/updates">Updates</a></li>
-  <li><a href="/ldp/db/processes">Processes</a></li>
-</ul>`)
-		return
-	} else if path == "/admin/health" {
-		fmt.Fprintln(w, "Behold! I live!!")
-		return
-	}
+// Returns the current sessions. The sessions mutex is held only while
+// they are copied, so that callers which go on to examine each
+// session's databases do not hold up requests needing a session.
+func (server *ModReportingServer) activeSessions() []*ModReportingSession {
+	server.sessionsMutex.Lock()
+	defer server.sessionsMutex.Unlock()
 
-	if path == "/ldp/config" {
-		runWithErrorHandling(w, req, server, handleConfig)
-	} else if strings.HasPrefix(path, "/ldp/config/") {
-		runWithErrorHandling(w, req, server, handleConfigKey)
-	} else if path == "/ldp/db/tables" {
-		runWithErrorHandling(w, req, server, handleTables)
-	} else if path == "/ldp/db/columns" {
-		runWithErrorHandling(w, req, server, handleColumns)
-	} else if path == "/ldp/db/query" && req.Method == "POST" {
-		runWithErrorHandling(w, req, server, handleQuery)
-	} else if path == "/ldp/db/reports" && req.Method == "POST" {
-		runWithErrorHandling(w, req, server, handleReport)
-	} else if path == "/ldp/db/log" {
-		runWithErrorHandling(w, req, server, handleLogs)
-	} else if path == "/ldp/db/version" {
-		runWithErrorHandling(w, req, server, handleVersion)
-	} else if path == "/ldp/db/updates" {
-		runWithErrorHandling(w, req, server, handleUpdates)
-	} else if path == "/ldp/db/processes" {
-		runWithErrorHandling(w, req, server, handleProcesses)
-	} else {
-		// Unrecognized
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintln(w, "Not found")
+	sessions := make([]*ModReportingSession, 0, len(server.sessions))
+	for _, session := range server.sessions {
+		sessions = append(sessions, session)
 	}
+	return sessions
 }
 
-func runWithErrorHandling(w http.ResponseWriter, req *http.Request, server *ModReportingServer, f handlerFn) {
+// Handlers for limited routes run only once the concurrency limiter
+// has admitted them
+func runWithErrorHandling(w http.ResponseWriter, req *http.Request, server *ModReportingServer, f handlerFn, limited bool) {
+	start := time.Now()
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	var err error
+	defer func() {
+		server.metrics.observeRequest(endpointLabel(req.URL.Path), req.Method, sr.status, time.Since(start), err)
+		server.logRequestDone(req, sr.status)
+	}()
+
 	host := req.Header.Get("X-Okapi-Url")
 	tenant := req.Header.Get("X-Okapi-Tenant")
 	token := req.Header.Get("X-Okapi-Token")
 	session, err := server.findSession(host, tenant, token)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "could not make session: %s\n", html.EscapeString(err.Error()))
-		server.Log("error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
+		err = fmt.Errorf("could not make session: %w", err)
+		sendError(sr, req, err)
+		server.LogReq(req, "error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
 		return
 	}
 
-	err = f(w, req, session)
-	if err != nil {
-		var status int
-		switch e := err.(type) {
-		case *HTTPError:
-			status = e.status
-		default:
-			status = http.StatusInternalServerError
+	if limited {
+		var release func()
+		release, err = server.acquireSlot(sr, req, session)
+		if err != nil {
+			sendError(sr, req, err)
+			session.LogReq(req, "error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
+			return
 		}
-		w.WriteHeader(status)
-		fmt.Fprintln(w, html.EscapeString(err.Error()))
-		session.Log("error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
+		defer release()
+	}
+
+	err = f(sr, req, session)
+	if err != nil {
+		sendError(sr, req, err)
+		session.LogReq(req, "error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
 	}
 }
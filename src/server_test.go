@@ -6,6 +6,7 @@ import "strings"
 import "io"
 import "fmt"
 import "time"
+import "context"
 import "net/http"
 import "regexp"
 import "github.com/pashagolub/pgxmock/v3"
@@ -46,6 +47,16 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 			status:   200,
 			expected: "Behold!",
 		},
+		{
+			name: "readiness check",
+			path: "admin/ready",
+			establishMock: func(data interface{}) error {
+				data.(pgxmock.PgxPoolIface).ExpectPing()
+				return nil
+			},
+			status:   200,
+			expected: `"status":"up"`,
+		},
 		{
 			name:   "short bad path",
 			path:   "foo",
@@ -56,6 +67,11 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 			path:   "foo/bar/baz",
 			status: 404,
 		},
+		{
+			name:   "wrong method",
+			path:   "ldp/db/query",
+			status: 405,
+		},
 		{
 			name:     "get all config",
 			path:     "ldp/config",
@@ -77,11 +93,17 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 		},
 		{
 			name:     "rewrite existing config",
-			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"user\":\"abc456\"}"}`,
+			sendData: `{"key":"dbinfo","tenant":"diku","value":"{\"url\":\"dummyUrl\",\"user\":\"abc456\",\"pass\":\"pw\"}"}`,
 			path:     "ldp/config/dbinfo",
 			status:   200,
 			expected: "abc456",
 		},
+		{
+			name:     "JSON error for missing parameter",
+			path:     "ldp/db/columns?schema=folio_users",
+			status:   400,
+			expected: `^{"code":"missing-parameter","message":"must specify both schema and table","requestId":"[0-9a-f-]{36}"}$`,
+		},
 		{
 			name: "fetch tables",
 			path: "ldp/db/tables",
@@ -158,6 +180,12 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 			},
 			status:   200,
 			expected: `\[{"databaseName":"metadb_indexdata_test","userName":"folio_app","state":"active","realTime":"00:00:04","query":"select a.message, b.message from metadb.log as a, metadb.log as b;"}\]`,
+		}, {
+			// Must come after the other tests, so there is something to count
+			name:     "metrics",
+			path:     "admin/metrics",
+			status:   200,
+			expected: `(?s)mod_reporting_http_requests_total{endpoint="/ldp/db/query",method="POST",status="200"} 1\n.*mod_reporting_active_sessions 1\n`,
 		},
 	}
 
@@ -184,8 +212,7 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 				err = d.establishMock(mock)
 				assert.Nil(t, err)
 			}
-			session.dbConn = mock
-			session.isMDB = true // Mock expectations are as for MetaDB
+			useMockDb(session, "", mock, true) // Mock expectations are as for MetaDB
 
 			client := http.Client{}
 			resp, err := client.Do(req)
@@ -215,3 +242,25 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 		})
 	}
 }
+
+func Test_shutdown(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server, err := MakeConfiguredServer("../etc/silent.json", "..")
+	assert.Nil(t, err)
+	session, err := NewModReportingSession(server, ts.URL, "t1", "dummyToken")
+	assert.Nil(t, err)
+	server.sessions[session.key()] = session
+
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	mock.ExpectClose()
+	useMockDb(session, "", mock, false)
+
+	err = server.shutdown()
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "pool was not closed")
+	assert.Empty(t, session.dbs)
+	assert.Empty(t, server.sessions)
+	assert.ErrorIs(t, server.baseCtx.Err(), context.Canceled)
+}
@@ -2,7 +2,10 @@ package main
 
 import "context"
 import "strings"
+import "sync"
 import "fmt"
+import "regexp"
+import "net/http"
 import "github.com/indexdata/foliogo"
 import "github.com/jackc/pgx/v5"
 import "github.com/jackc/pgx/v5/pgxpool"
@@ -13,6 +16,7 @@ type PgxIface interface {
 	Query(context.Context, string, ...any) (pgx.Rows, error)
 	QueryRow(context.Context, string, ...any) pgx.Row
 	Exec(context.Context, string, ...any) (pgconn.CommandTag, error)
+	Ping(context.Context) error
 	Close()
 }
 
@@ -22,8 +26,48 @@ type ModReportingSession struct {
 	tenant       string
 	token        string
 	folioSession foliogo.Session
-	dbConn       PgxIface
-	isMDB        bool
+	dbs          map[string]*reportingDb // Keyed by database name, with "" for the default
+	dbsMutex     sync.Mutex
+}
+
+// The connection pools for one of the tenant's reporting databases.
+// The default database is described by the 'dbinfo' setting, and
+// others by settings such as 'dbinfo.metadb', whose name is "metadb".
+type reportingDb struct {
+	name      string
+	dbConn    PgxIface // Used by the metadata endpoints
+	queryConn PgxIface // Used for JSON queries, if different from dbConn
+	hosts     []*hostPool
+	isMDB     bool
+}
+
+// Returns the pool to use for JSON queries, which may be a replicaRouter
+func (db *reportingDb) queryDbConn() PgxIface {
+	if db.queryConn != nil {
+		return db.queryConn
+	}
+	return db.dbConn
+}
+
+// Returns the pool for the primary. Reports need this because they
+// register a function, which a hot-standby replica does not allow.
+func (db *reportingDb) primaryDbConn() PgxIface {
+	return db.hostPools()[0].dbConn
+}
+
+// Returns the pool for each host, or just dbConn if there is no
+// per-host information
+func (db *reportingDb) hostPools() []*hostPool {
+	if len(db.hosts) > 0 {
+		return db.hosts
+	}
+	return []*hostPool{{role: rolePrimary, dbConn: db.dbConn}}
+}
+
+func (db *reportingDb) close() {
+	for _, hp := range db.hostPools() {
+		hp.dbConn.Close()
+	}
 }
 
 /*
@@ -37,7 +81,7 @@ type ModReportingSession struct {
 
 func NewModReportingSession(server *ModReportingServer, url string, tenant string, token string) (*ModReportingSession, error) {
 	if url == "" && tenant != "" {
-		return nil, fmt.Errorf("no URL provided with tenant: responding to a request with no X-Okapi-Url header?")
+		return nil, newHTTPErrorf(http.StatusBadRequest, errMissingHeader, "no URL provided with tenant: responding to a request with no X-Okapi-Url header?")
 	}
 
 	session := ModReportingSession{
@@ -45,6 +89,7 @@ func NewModReportingSession(server *ModReportingServer, url string, tenant strin
 		url:    url,
 		tenant: tenant,
 		token:  token,
+		dbs:    map[string]*reportingDb{},
 	}
 
 	if url != "" {
@@ -53,7 +98,7 @@ func NewModReportingSession(server *ModReportingServer, url string, tenant strin
 		folioSession, err := service.ResumeSession(tenant)
 		session.folioSession = folioSession
 		if err != nil {
-			return nil, fmt.Errorf("could not resume existing FOLIO session: %w", err)
+			return nil, newHTTPErrorf(http.StatusServiceUnavailable, errFolioSessionFailed, "could not resume existing FOLIO session: %w", err)
 		}
 
 		return &session, nil
@@ -63,7 +108,7 @@ func NewModReportingSession(server *ModReportingServer, url string, tenant strin
 	// In this case, we use a FOLIO service specified in the environment
 	folioSession, err := foliogo.NewDefaultSession(server.GetLogger())
 	if err != nil {
-		return nil, fmt.Errorf("could not create new FOLIO session: %w", err)
+		return nil, newHTTPErrorf(http.StatusServiceUnavailable, errFolioSessionFailed, "could not create new FOLIO session: %w", err)
 	}
 
 	session.folioSession = folioSession
@@ -74,6 +119,10 @@ func (session *ModReportingSession) Log(cat string, args ...string) {
 	session.server.Log(cat, args...)
 }
 
+func (session *ModReportingSession) LogReq(req *http.Request, cat string, args ...string) {
+	session.server.LogReq(req, cat, args...)
+}
+
 // Returns a unique string opaquely identifying a session with the
 // specified url, tenant and token. This is suitable to be used as a
 // key in a lookup table.
@@ -85,41 +134,228 @@ func (session *ModReportingSession) key() string {
 	return sessionKey(session.url, session.tenant, session.token)
 }
 
-func (session *ModReportingSession) makeDbConn(token string) (PgxIface, bool, error) {
-	dbUrl, dbUser, dbPass, err := getDbInfo(session.folioSession, token)
-	if err != nil {
-		return nil, false, fmt.Errorf("cannot extract data from 'dbinfo': %w", err)
-	}
-	session.Log("db", "url="+dbUrl+", user="+dbUser)
-
+// Strips any scheme from the configured URL and adds the credentials
+func dbConnString(dbUrl string, dbUser string, dbPass string) string {
 	// For historical reasons, database connection configuration is often JDBCish
 	dbUrl = strings.Replace(dbUrl, "jdbc:postgresql://", "", 1)
 	dbUrl = strings.Replace(dbUrl, "postgres://", "", 1)
 	// We may need `?sslmode=require` on the end of the URL.
-	dbConn, err := pgxpool.New(context.Background(), "postgres://"+dbUser+":"+dbPass+"@"+dbUrl)
+	return "postgres://" + dbUser + ":" + dbPass + "@" + dbUrl
+}
+
+// Credentials that may be embedded in a database URL, whether or not
+// it has a scheme: the password of "user:pass@host", and a "password"
+// parameter
+var dbUrlPasswordRegexp = regexp.MustCompile(`^((?:[A-Za-z][A-Za-z0-9+.-]*:)*//)?([^/@:]*):[^/@]*@`)
+var dbUrlPasswordParamRegexp = regexp.MustCompile(`([?&]password=)[^&]*`)
+
+// Hides any password in a database URL, so that it can be shown
+func redactDbUrl(dbUrl string) string {
+	dbUrl = dbUrlPasswordRegexp.ReplaceAllString(dbUrl, "${1}${2}:********@")
+	return dbUrlPasswordParamRegexp.ReplaceAllString(dbUrl, "${1}********")
+}
+
+// Returns the current credentials for the reporting database
+type credentialsFunc func() (string, string, string, error)
+
+// A variable so that tests can substitute a mock connection pool. If
+// refresh is not nil, it is called before each new connection is
+// made, so that changed credentials are used without a restart.
+var openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+	poolConfig, err := pgxpool.ParseConfig(dbConnString(dbUrl, dbUser, dbPass))
 	if err != nil {
-		return nil, false, fmt.Errorf("cannot connect to DB: %w", err)
+		return nil, err
 	}
 
-	session.Log("db", "connected to DB", dbUrl)
-	isMDB, err := isMetaDB(dbConn)
+	if refresh != nil {
+		poolConfig.BeforeConnect = func(_ context.Context, cc *pgx.ConnConfig) error {
+			freshUrl, freshUser, freshPass, refreshErr := refresh()
+			if refreshErr != nil {
+				return fmt.Errorf("cannot refresh reporting-database credentials: %w", refreshErr)
+			}
+			fresh, parseErr := pgx.ParseConfig(dbConnString(freshUrl, freshUser, freshPass))
+			if parseErr != nil {
+				return fmt.Errorf("cannot parse refreshed reporting-database credentials: %w", parseErr)
+			}
+			cc.Host = fresh.Host
+			cc.Port = fresh.Port
+			cc.Database = fresh.Database
+			cc.User = fresh.User
+			cc.Password = fresh.Password
+			return nil
+		}
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
-		return nil, false, fmt.Errorf("cannot determine whether reporting DB is MetaDB: %w", err)
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Returns the config key whose value describes the named database
+func dbinfoKey(dbName string) string {
+	if dbName == "" {
+		return "dbinfo"
 	}
+	return "dbinfo." + dbName
+}
+
+// Returns true if the config key describes a reporting database
+func isDbinfoKey(key string) bool {
+	return key == "dbinfo" || strings.HasPrefix(key, "dbinfo.")
+}
 
-	session.Log("db", fmt.Sprintf("isMetaDB=%v", isMDB))
-	return dbConn, isMDB, nil
+var dbNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Returns the name of the reporting database that the request asks
+// for, using the "db" query parameter or the X-Reporting-Db header.
+// The default database may be named explicitly as "default".
+func requestedDbName(req *http.Request) (string, error) {
+	dbName := req.URL.Query().Get("db")
+	if dbName == "" {
+		dbName = req.Header.Get("X-Reporting-Db")
+	}
+	if dbName == "" || dbName == "default" {
+		return "", nil
+	}
+	if !dbNameRegexp.MatchString(dbName) {
+		return "", newHTTPErrorf(http.StatusBadRequest, errInvalidParameter, "invalid database name '%s'", dbName)
+	}
+	return dbName, nil
 }
 
-func (session *ModReportingSession) findDbConn(token string) (PgxIface, error) {
-	if session.dbConn == nil {
-		dbConn, isMDB, err := session.makeDbConn(token)
+func (session *ModReportingSession) makeDbConn(dbName string, token string) (*reportingDb, error) {
+	key := dbinfoKey(dbName)
+	dbCfg := session.server.config.Database
+	info, err := getDbInfo(session.folioSession, token, dbCfg, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract data from '%s': %w", key, err)
+	}
+	session.Log("db", "key="+key+", url="+info.Url+", user="+info.User)
+
+	// Credentials from files may be rotated, so we re-read them for
+	// each new connection. Those from mod-settings are read only once.
+	var refresh credentialsFunc
+	tenant := session.folioSession.GetTenant()
+	_, overridden, _ := overrideDbInfo(dbCfg, tenant)
+	if dbName == "" && overridden {
+		refresh = func() (string, string, string, error) {
+			creds, _, err := overrideDbInfo(dbCfg, tenant)
+			return creds.Url, creds.User, creds.Pass, err
+		}
+	}
+
+	primaryUrl, primaryHost := info.Url, urlHost(info.Url)
+	var replicaHosts []string
+	if len(info.Hosts) > 0 {
+		primaryUrl, replicaHosts, err = splitHosts(info.Url, info.Hosts)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("bad hosts in '%s': %w", key, err)
 		}
-		session.dbConn = dbConn
-		session.isMDB = isMDB
+		primaryHost = urlHost(primaryUrl)
+	}
+
+	dbConn, err := openReportingDb(context.Background(), primaryUrl, info.User, info.Pass, refresh)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to DB: %w", err)
+	}
+	session.Log("db", "connected to DB", primaryUrl)
+	db := &reportingDb{
+		name:   dbName,
+		dbConn: dbConn,
+		hosts:  []*hostPool{{host: primaryHost, role: rolePrimary, dbConn: dbConn}},
 	}
 
-	return session.dbConn, nil
+	if len(replicaHosts) > 0 {
+		router := &replicaRouter{primary: db.hosts[0], log: session.Log}
+		for _, host := range replicaHosts {
+			replicaUrl := hostUrl(info.Url, host, "")
+			replicaConn, err := openReportingDb(context.Background(), replicaUrl, info.User, info.Pass, nil)
+			if err != nil {
+				db.close()
+				return nil, fmt.Errorf("cannot connect to replica DB: %w", err)
+			}
+			session.Log("db", "connected to replica DB", replicaUrl)
+			hp := &hostPool{host: host, role: roleReplica, dbConn: replicaConn}
+			router.replicas = append(router.replicas, hp)
+			db.hosts = append(db.hosts, hp)
+		}
+		db.queryConn = router
+		if info.Metadata == roleReplica {
+			db.dbConn = router
+		}
+	}
+
+	db.isMDB, err = isMetaDB(context.Background(), dbConn)
+	if err != nil {
+		db.close()
+		return nil, fmt.Errorf("cannot determine whether reporting DB is MetaDB: %w", err)
+	}
+
+	session.Log("db", fmt.Sprintf("isMetaDB=%v", db.isMDB))
+	return db, nil
+}
+
+// Returns the named reporting database, connecting to it if this
+// session has not already done so. The connection is made without
+// holding dbsMutex, so that a slow database does not hold up requests
+// for the session's other databases; if another request connects to
+// the same database meanwhile, its connection is kept and ours closed.
+func (session *ModReportingSession) findDbConn(dbName string, token string) (*reportingDb, error) {
+	session.dbsMutex.Lock()
+	db := session.dbs[dbName]
+	session.dbsMutex.Unlock()
+	if db != nil {
+		return db, nil
+	}
+
+	db, err := session.makeDbConn(dbName, token)
+	if err != nil {
+		return nil, newHTTPError(http.StatusServiceUnavailable, errDatabaseUnavailable, err)
+	}
+
+	session.dbsMutex.Lock()
+	defer session.dbsMutex.Unlock()
+	if existing := session.dbs[dbName]; existing != nil {
+		db.close()
+		return existing, nil
+	}
+	session.dbs[dbName] = db
+	return db, nil
+}
+
+// Returns the reporting database that the request asks for
+func (session *ModReportingSession) findRequestedDb(req *http.Request) (*reportingDb, error) {
+	dbName, err := requestedDbName(req)
+	if err != nil {
+		return nil, err
+	}
+	return session.findDbConn(dbName, req.Header.Get("X-Okapi-Token"))
+}
+
+// Returns the session's open reporting databases, default first and
+// the others in order of name
+func (session *ModReportingSession) openDbs() []*reportingDb {
+	session.dbsMutex.Lock()
+	defer session.dbsMutex.Unlock()
+
+	dbs := make([]*reportingDb, 0, len(session.dbs))
+	for _, name := range sortedKeys(session.dbs) {
+		dbs = append(dbs, session.dbs[name])
+	}
+	return dbs
+}
+
+// Closes the session's reporting-database connection pools, if it
+// has any. This waits for any connections still in use to be released.
+func (session *ModReportingSession) closeDbConn() {
+	session.dbsMutex.Lock()
+	defer session.dbsMutex.Unlock()
+
+	for name, db := range session.dbs {
+		session.Log("db", "closing connection to DB", dbinfoKey(name))
+		db.close()
+		delete(session.dbs, name)
+	}
 }
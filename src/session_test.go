@@ -1,7 +1,11 @@
 package main
 
 import "os"
+import "errors"
+import "context"
 import "testing"
+import "github.com/jackc/pgx/v5"
+import "github.com/pashagolub/pgxmock/v3"
 import "github.com/stretchr/testify/assert"
 
 func Test_session(t *testing.T) {
@@ -62,9 +66,71 @@ func Test_session(t *testing.T) {
 	/*
 		t.Run("find reporting database connection", func(t *testing.T) {
 			session := makeGoodSession(t)
-			db, error := session.findDbConn("")
+			db, error := session.findDbConn("", "")
 			assert.Nil(t, error)
 			assert.NotNil(t, db) // That's all we can ask about this opaque object
 		})
 	*/
 }
+
+// Connecting to a slow database must not hold up requests for the
+// session's other databases, which all need dbsMutex
+func Test_findDbConnDoesNotHoldDbsMutex(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	realOpen := openReportingDb
+	defer func() { openReportingDb = realOpen }()
+
+	t.Run("lock is not held while connecting", func(t *testing.T) {
+		release := make(chan struct{})
+		started := make(chan struct{}, 2)
+		openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+			started <- struct{}{}
+			<-release
+			return nil, errors.New("connection refused")
+		}
+		done := make(chan error)
+		go func() {
+			_, err := session.findDbConn("replicated", "")
+			done <- err
+		}()
+		<-started
+
+		locked := session.dbsMutex.TryLock()
+		assert.True(t, locked, "dbsMutex is held while connecting")
+		if locked {
+			session.dbsMutex.Unlock()
+		}
+		close(release)
+		assert.ErrorContains(t, <-done, "connection refused")
+	})
+
+	t.Run("connection that loses a race is closed", func(t *testing.T) {
+		winner := &reportingDb{name: "replicated"}
+		opened := []pgxmock.PgxPoolIface{}
+		openReportingDb = func(ctx context.Context, dbUrl string, dbUser string, dbPass string, refresh credentialsFunc) (PgxIface, error) {
+			mock := Must(pgxmock.NewPool())
+			if len(opened) == 0 {
+				mock.ExpectQuery("SELECT 1 FROM pg_class").WillReturnError(pgx.ErrNoRows)
+				// Another request connects while this one is connecting
+				session.dbsMutex.Lock()
+				session.dbs["replicated"] = winner
+				session.dbsMutex.Unlock()
+			}
+			mock.ExpectClose()
+			opened = append(opened, mock)
+			return mock, nil
+		}
+
+		db, err := session.findDbConn("replicated", "")
+		assert.Nil(t, err)
+		assert.Same(t, winner, db)
+		assert.Len(t, opened, 2)
+		for _, mock := range opened {
+			assert.Nil(t, mock.ExpectationsWereMet())
+		}
+	})
+}
@@ -0,0 +1,93 @@
+// Preview of the SQL generated from a JSON query, for use in other tools
+package main
+
+import "fmt"
+import "strconv"
+import "strings"
+import "net/http"
+
+type sqlPreview struct {
+	Sql        string `json:"sql"`
+	Params     []any  `json:"params"`
+	InlinedSql string `json:"inlinedSql,omitempty"` // Only if requested
+}
+
+// The SQL is generated and checked exactly as by handleQuery, but not run
+func handleQuerySql(w http.ResponseWriter, req *http.Request, session *ModReportingSession) (err error) {
+	audit := session.startAudit(req, "/ldp/db/query/sql")
+	defer func() { audit.finish(err) }()
+
+	db, err := session.findRequestedDb(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	audit.setDatabase(db.name)
+
+	policy, err := fetchQueryPolicy(req, session)
+	if err != nil {
+		return err
+	}
+	_, sql, params, err := session.prepareQuery(req, db, audit, policy)
+	if err != nil {
+		return err
+	}
+
+	preview := sqlPreview{Sql: sql, Params: params}
+	if req.URL.Query().Get("inline") == "true" {
+		preview.InlinedSql, err = inlineParams(sql, params)
+		if err != nil {
+			return err
+		}
+	}
+	return sendJSON(w, preview, "SQL preview")
+}
+
+// Quotes a value as Postgres's quote_literal does, so that it is
+// safe to include in SQL whatever the setting of
+// standard_conforming_strings. Values are left for Postgres to
+// convert to the column's type, as when they are sent as parameters.
+func quoteLiteral(val any) string {
+	if val == nil {
+		return "NULL"
+	}
+	s := strings.ReplaceAll(fmt.Sprint(val), "'", "''")
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.ReplaceAll(s, `\`, `\\`) + `'`
+	}
+	return "'" + s + "'"
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Replaces each parameter reference $N with the quoted value of the
+// Nth parameter. Quoted identifiers and string literals are copied
+// unchanged, in case they contain something that looks like one.
+func inlineParams(sql string, params []any) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '"' || c == '\'':
+			end := skipQuoted(sql, i, false)
+			sb.WriteString(sql[i:end])
+			i = end
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			end := i + 1
+			for end < len(sql) && isDigit(sql[end]) {
+				end++
+			}
+			n, _ := strconv.Atoi(sql[i+1 : end])
+			if n < 1 || n > len(params) {
+				return "", newHTTPErrorf(http.StatusUnprocessableEntity, errInvalidQuery, "no value for parameter $%d", n)
+			}
+			sb.WriteString(quoteLiteral(params[n-1]))
+			i = end
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import "strings"
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+func Test_quoteLiteral(t *testing.T) {
+	assert.Equal(t, "NULL", quoteLiteral(nil))
+	assert.Equal(t, "'mike'", quoteLiteral("mike"))
+	assert.Equal(t, "'42'", quoteLiteral(42))
+	assert.Equal(t, "'O''Reilly'", quoteLiteral("O'Reilly"))
+	assert.Equal(t, `E'a\\b'' OR 1=1 --'`, quoteLiteral(`a\b' OR 1=1 --`))
+}
+
+func Test_inlineParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		params   []any
+		expected string
+		errorstr string
+	}{
+		{
+			name:     "no parameters",
+			sql:      `SELECT * FROM "folio_users"."users" LIMIT 10`,
+			expected: `SELECT * FROM "folio_users"."users" LIMIT 10`,
+		},
+		{
+			name:     "several parameters",
+			sql:      `SELECT * FROM "t" WHERE a = $1 AND b > $2 AND c = $10`,
+			params:   []any{"x", "2", "3", "4", "5", "6", "7", "8", "9", "ten"},
+			expected: `SELECT * FROM "t" WHERE a = 'x' AND b > '2' AND c = 'ten'`,
+		},
+		{
+			name:     "quoted text is left alone",
+			sql:      `SELECT "col$1", 'it''s $1' FROM "we""ird$2" WHERE a = $1`,
+			params:   []any{"it's"},
+			expected: `SELECT "col$1", 'it''s $1' FROM "we""ird$2" WHERE a = 'it''s'`,
+		},
+		{
+			name:     "missing parameter",
+			sql:      `SELECT * FROM "t" WHERE b = $2`,
+			params:   []any{"x"},
+			errorstr: "no value for parameter $2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inlined, err := inlineParams(test.sql, test.params)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, inlined)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
+
+func Test_handleQuerySql(t *testing.T) {
+	ts := MakeMockHTTPServer()
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		expected string
+		errorstr string
+	}{
+		{
+			name:     "parameters",
+			path:     "/ldp/db/query/sql",
+			body:     `{ "tables": [{ "schema": "folio_users", "tableName": "users", "columnFilters": [{ "key": "user", "value": "mike" }], "limit": 5 }] }`,
+			expected: `{"sql":"SELECT * FROM \"folio_users\".\"users\" WHERE \"user\" = $1 LIMIT 5","params":["mike"]}`,
+		},
+		{
+			name:     "inlined",
+			path:     "/ldp/db/query/sql?inline=true",
+			body:     `{ "tables": [{ "schema": "folio_users", "tableName": "users", "columnFilters": [{ "key": "user", "value": "mike" }], "limit": 5 }] }`,
+			expected: `{"sql":"SELECT * FROM \"folio_users\".\"users\" WHERE \"user\" = $1 LIMIT 5","params":["mike"],"inlinedSql":"SELECT * FROM \"folio_users\".\"users\" WHERE \"user\" = 'mike' LIMIT 5"}`,
+		},
+		{
+			name:     "validated as for a query",
+			path:     "/ldp/db/query/sql",
+			body:     `{ "tables": [{ "schema": "folio_users", "tableName": "users", "columnFilters": [{ "key": "id", "value": "not-a-uuid" }] }] }`,
+			errorstr: "invalid UUID not-a-uuid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := Must(pgxmock.NewPool())
+			assert.Nil(t, establishMockForColumns(mock))
+			useMockDb(session, "", mock, true)
+			delete(session2columns, session.key()+"::folio_users:users")
+
+			req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			err := handleQuerySql(w, req, session)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, w.Body.String())
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Restrict access to schemas and tables according to the caller's FOLIO permissions
+package main
+
+import "fmt"
+import "net/http"
+import "encoding/json"
+
+// The mod-settings key of the per-tenant access policy
+const tableAccessKey = "table-access"
+
+// The permissions that a policy may require. They are declared in the
+// module descriptor, and listed as permissionsDesired by the handlers
+// that apply the policy, so that Okapi tells us in X-Okapi-Permissions
+// which of them the caller has.
+var tableAccessPermissions = []string{
+	"ldp.access.personal-data",
+	"ldp.access.restricted",
+}
+
+type tableAccessRule struct {
+	Schema     string `json:"schema"`
+	Table      string `json:"table,omitempty"` // If omitted, the rule covers the whole schema
+	Permission string `json:"permission"`
+}
+
+// The policy in force for a request, and the permissions of the caller
+type tableAccess struct {
+	rules       []tableAccessRule
+	permissions []string
+}
+
+// Okapi sends the caller's desired permissions as a JSON array. If
+// the header is missing or malformed, the caller has none of them.
+func okapiPermissions(req *http.Request) []string {
+	var perms []string
+	err := json.Unmarshal([]byte(req.Header.Get("X-Okapi-Permissions")), &perms)
+	if err != nil {
+		return []string{}
+	}
+	return perms
+}
+
+// Reads the tenant's policy from mod-settings
+func fetchTableAccess(req *http.Request, session *ModReportingSession) (*tableAccess, error) {
+	values, err := fetchSettingsValues(req, session, tableAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	return makeTableAccess(req, values[tableAccessKey])
+}
+
+// Parses the policy stored under tableAccessKey. If there is none,
+// every table is accessible, as in earlier releases.
+func makeTableAccess(req *http.Request, value string) (*tableAccess, error) {
+	ta := &tableAccess{permissions: okapiPermissions(req)}
+	if value == "" {
+		return ta, nil
+	}
+	err := json.Unmarshal([]byte(value), &ta.rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s' policy: %w", tableAccessKey, err)
+	}
+	return ta, nil
+}
+
+// Reports whether the policy denies the caller any table
+func (ta *tableAccess) restricts() bool {
+	for _, rule := range ta.rules {
+		if !containsString(ta.permissions, rule.Permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the permission needed to read the table, or "" if none is.
+// A rule for the table takes precedence over one for its schema.
+func (ta *tableAccess) requiredPermission(schema string, table string) string {
+	perm := ""
+	for _, rule := range ta.rules {
+		if rule.Schema != schema {
+			continue
+		}
+		if rule.Table == table {
+			return rule.Permission
+		} else if rule.Table == "" {
+			perm = rule.Permission
+		}
+	}
+	return perm
+}
+
+func (ta *tableAccess) check(schema string, table string) error {
+	perm := ta.requiredPermission(schema, table)
+	if perm == "" || containsString(ta.permissions, perm) {
+		return nil
+	}
+	httpErr := newHTTPErrorf(http.StatusForbidden, errAccessDenied,
+		"access to %s.%s requires permission '%s'", schema, table, perm)
+	httpErr.details = map[string]interface{}{"permission": perm}
+	return httpErr
+}
+
+// Returns only those tables that the caller may read
+func (ta *tableAccess) filter(tables []dbTable) []dbTable {
+	allowed := []dbTable{}
+	for _, t := range tables {
+		if ta.check(t.SchemaName, t.TableName) == nil {
+			allowed = append(allowed, t)
+		}
+	}
+	return allowed
+}
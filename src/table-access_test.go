@@ -0,0 +1,151 @@
+package main
+
+import "os"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/stretchr/testify/assert"
+
+func Test_requiredPermission(t *testing.T) {
+	ta := &tableAccess{rules: []tableAccessRule{
+		{Schema: "folio_users", Permission: "ldp.access.personal-data"},
+		{Schema: "folio_inventory", Table: "holdings_record", Permission: "ldp.access.restricted"},
+		{Schema: "folio_finance", Permission: "ldp.access.restricted"},
+		{Schema: "folio_finance", Table: "fiscal_year", Permission: "ldp.access.personal-data"},
+	}}
+
+	tests := []struct {
+		schema   string
+		table    string
+		expected string
+	}{
+		{schema: "folio_users", table: "users", expected: "ldp.access.personal-data"},
+		{schema: "folio_inventory", table: "holdings_record", expected: "ldp.access.restricted"},
+		{schema: "folio_inventory", table: "records_instances", expected: ""},
+		{schema: "folio_finance", table: "budget", expected: "ldp.access.restricted"},
+		{schema: "folio_finance", table: "fiscal_year", expected: "ldp.access.personal-data"},
+		{schema: "FOLIO_USERS", table: "users", expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.schema+"."+test.table, func(t *testing.T) {
+			assert.Equal(t, test.expected, ta.requiredPermission(test.schema, test.table))
+		})
+	}
+}
+
+func Test_okapiPermissions(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+	assert.Equal(t, []string{}, okapiPermissions(req))
+	req.Header.Set("X-Okapi-Permissions", `["ldp.access.restricted"]`)
+	assert.Equal(t, []string{"ldp.access.restricted"}, okapiPermissions(req))
+	req.Header.Set("X-Okapi-Permissions", `ldp.access.restricted`)
+	assert.Equal(t, []string{}, okapiPermissions(req))
+}
+
+func Test_tableAccessHandlers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{
+		  "items": [{
+		    "id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43f",
+		    "scope": "ui-ldp.admin",
+		    "key": "table-access",
+		    "value": [
+		      { "schema": "folio_users", "permission": "ldp.access.personal-data" },
+		      { "schema": "folio_inventory", "table": "holdings_record", "permission": "ldp.access.restricted" }
+		    ]
+		  }],
+		  "resultInfo": { "totalRecords": 1 }
+		}`))
+	}))
+	defer ts.Close()
+	server := Must(MakeConfiguredServer("../etc/silent.json", "."))
+	session := Must(NewModReportingSession(server, ts.URL, "dummyTenant", "dummyToken"))
+
+	t.Run("restricted table is not listed", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		assert.Nil(t, establishMockForTables(mock))
+		useMockDb(session, "", mock, true)
+		w := httptest.NewRecorder()
+		err := handleTables(w, httptest.NewRequest("GET", "/ldp/db/tables", nil), session)
+		assert.Nil(t, err)
+		assert.JSONEq(t, `[{"tableSchema":"folio_inventory","tableName":"records_instances"}]`, w.Body.String())
+	})
+
+	t.Run("restricted table is listed with permission", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		assert.Nil(t, establishMockForTables(mock))
+		useMockDb(session, "", mock, true)
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		req.Header.Set("X-Okapi-Permissions", `["ldp.access.restricted"]`)
+		w := httptest.NewRecorder()
+		err := handleTables(w, req, session)
+		assert.Nil(t, err)
+		assert.JSONEq(t, `[
+		  {"tableSchema":"folio_inventory","tableName":"records_instances"},
+		  {"tableSchema":"folio_inventory","tableName":"holdings_record"}
+		]`, w.Body.String())
+	})
+
+	t.Run("columns of restricted schema", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/columns?schema=folio_users&table=users", nil)
+		req.Header.Set("X-Okapi-Permissions", `["ldp.access.restricted"]`)
+		err := handleColumns(httptest.NewRecorder(), req, session)
+		assert.ErrorContains(t, err, "access to folio_users.users requires permission 'ldp.access.personal-data'")
+		status, code := classifyError(err)
+		assert.Equal(t, 403, status)
+		assert.Equal(t, errAccessDenied, code)
+		assert.Equal(t, map[string]interface{}{"permission": "ldp.access.personal-data"}, errorDetails(err))
+	})
+
+	t.Run("query on restricted schema", func(t *testing.T) {
+		mock := Must(pgxmock.NewPool())
+		useMockDb(session, "", mock, true)
+		body := `{ "tables": [{ "schema": "folio_users", "tableName": "users" }] }`
+		req := httptest.NewRequest("POST", "/ldp/db/query", strings.NewReader(body))
+		err := handleQuery(httptest.NewRecorder(), req, session)
+		assert.ErrorContains(t, err, "requires permission 'ldp.access.personal-data'")
+		// Rejected before the database is consulted
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
+
+// The permissions a policy may name must be declared in the module
+// descriptor and requested by each handler that applies the policy
+func Test_tableAccessPermissionsDeclared(t *testing.T) {
+	var md struct {
+		Provides []struct {
+			Handlers []struct {
+				PathPattern        string   `json:"pathPattern"`
+				PermissionsDesired []string `json:"permissionsDesired"`
+			} `json:"handlers"`
+		} `json:"provides"`
+		PermissionSets []struct {
+			PermissionName string `json:"permissionName"`
+		} `json:"permissionSets"`
+	}
+	bytes := Must(os.ReadFile("../descriptors/ModuleDescriptor-template.json"))
+	assert.Nil(t, json.Unmarshal(bytes, &md))
+
+	declared := []string{}
+	for _, ps := range md.PermissionSets {
+		declared = append(declared, ps.PermissionName)
+	}
+	assert.Subset(t, declared, tableAccessPermissions)
+
+	for _, h := range md.Provides[0].Handlers {
+		switch h.PathPattern {
+		case "/ldp/db/tables", "/ldp/db/columns", "/ldp/db/query":
+			assert.Subset(t, h.PermissionsDesired, tableAccessPermissions, h.PathPattern)
+		}
+	}
+
+	enum := []string{}
+	for _, perm := range configSchemas[tableAccessKey].Items.Properties["permission"].Enum {
+		enum = append(enum, perm.(string))
+	}
+	assert.Equal(t, tableAccessPermissions, enum)
+}
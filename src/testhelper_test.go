@@ -3,6 +3,8 @@ package main
 import "errors"
 import "time"
 import "fmt"
+import "strings"
+import "strconv"
 import "net/http"
 import "net/http/httptest"
 import "github.com/pashagolub/pgxmock/v3"
@@ -44,11 +46,27 @@ type testT struct {
 	use2ndConfig  bool
 }
 
+// Writes the page of n dummy settings entries specified by the request's limit and offset
+func writeSettingsPage(w http.ResponseWriter, req *http.Request, n int) {
+	limit := Must(strconv.Atoi(req.URL.Query().Get("limit")))
+	offset := Must(strconv.Atoi(req.URL.Query().Get("offset")))
+	items := []string{}
+	for i := offset; i < n && i < offset+limit; i++ {
+		items = append(items, fmt.Sprintf(`{"id":"%d","scope":"ui-ldp.admin","key":"page%03d","value":"v%d"}`, i, i, i))
+	}
+	fmt.Fprintf(w, `{"items":[%s],"resultInfo":{"totalRecords":%d}}`, strings.Join(items, ","), n)
+}
+
+// Makes the session use the mock as the named reporting database
+func useMockDb(session *ModReportingSession, dbName string, mock PgxIface, isMDB bool) {
+	session.dbs[dbName] = &reportingDb{name: dbName, dbConn: mock, isMDB: isMDB}
+}
+
 // Dummy HTTP server used by multiple tests
 func MakeMockHTTPServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/settings/entries" &&
-			req.URL.RawQuery == "query=scope==%22ui-ldp.admin%22" {
+			req.URL.Query().Get("query") == `scope=="ui-ldp.admin" not key=="saved-query.*" sortby key` {
 			_, _ = w.Write([]byte(`
 			  {
 			    "items": [
@@ -79,6 +97,29 @@ func MakeMockHTTPServer() *httptest.Server {
 				  "url": "dummyUrl",
 				  "user": "fiona",
 				  "pass": "pw"
+				},
+				"_version": 3
+			      }
+			    ],
+			    "resultInfo": {
+			      "totalRecords": 1,
+			      "diagnostics": []
+			    }
+			  }
+			`))
+		} else if req.URL.Path == "/settings/entries" &&
+			req.URL.RawQuery == "query=scope==%22ui-ldp.admin%22+and+key==%22dbinfo.ldp%22" {
+			_, _ = w.Write([]byte(`
+			  {
+			    "items": [
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43d",
+				"scope": "ui-ldp.admin",
+				"key": "dbinfo.ldp",
+				"value": {
+				  "url": "ldpUrl",
+				  "user": "lenny",
+				  "pass": "pw2"
 				}
 			      }
 			    ],
@@ -88,6 +129,65 @@ func MakeMockHTTPServer() *httptest.Server {
 			    }
 			  }
 			`))
+		} else if req.URL.Path == "/settings/entries" &&
+			req.URL.RawQuery == "query=scope==%22ui-ldp.admin%22+and+key==%22dbinfo.replicated%22" {
+			_, _ = w.Write([]byte(`
+			  {
+			    "items": [
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43f",
+				"scope": "ui-ldp.admin",
+				"key": "dbinfo.replicated",
+				"value": {
+				  "url": "postgres://ignored:5432/metadb",
+				  "user": "fiona",
+				  "pass": "pw",
+				  "hosts": [
+				    { "host": "pg1:5432", "role": "primary" },
+				    { "host": "pg2:5432", "role": "primary" },
+				    { "host": "pg3:5432", "role": "replica" }
+				  ]
+				}
+			      }
+			    ],
+			    "resultInfo": {
+			      "totalRecords": 1,
+			      "diagnostics": []
+			    }
+			  }
+			`))
+		} else if req.URL.Path == "/settings/entries" &&
+			req.URL.Query().Get("query") == `scope=="ui-ldp.admin" and key=="dbinfo*" sortby key` {
+			// All named databases, plus a key that merely starts with "dbinfo"
+			_, _ = w.Write([]byte(`
+			  {
+			    "items": [
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43c",
+				"scope": "ui-ldp.admin",
+				"key": "dbinfo",
+				"value": { "url": "dummyUrl", "user": "fiona", "pass": "pw" },
+				"_version": 3
+			      },
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43d",
+				"scope": "ui-ldp.admin",
+				"key": "dbinfo.ldp",
+				"value": { "url": "ldpUrl", "user": "lenny", "pass": "enc:v1:AAAA" }
+			      },
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43e",
+				"scope": "ui-ldp.admin",
+				"key": "dbinfoNotes",
+				"value": "not a database"
+			      }
+			    ],
+			    "resultInfo": {
+			      "totalRecords": 3,
+			      "diagnostics": []
+			    }
+			  }
+			`))
 		} else if req.URL.Path == "/settings/entries" &&
 			req.URL.RawQuery == "query=scope==%22ui-ldp.admin%22+and+key==%22non-string%22" {
 			_, _ = w.Write([]byte(`
@@ -106,6 +206,10 @@ func MakeMockHTTPServer() *httptest.Server {
 			    }
 			  }
 			`))
+		} else if req.URL.Path == "/settings/entries" &&
+			req.URL.Query().Get("query") == `scope=="ui-ldp.admin" and key=="page*" not key=="saved-query.*" sortby key` {
+			// Enough entries that they have to be fetched in several pages
+			writeSettingsPage(w, req, 250)
 		} else if req.URL.Path == "/settings/entries" &&
 			req.URL.RawQuery == "query=scope==%22ui-ldp.admin%22+and+key==%22bad%22" {
 			_, _ = w.Write([]byte("some bit of text"))